@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/go-chi/chi/v5"
@@ -19,6 +20,15 @@ func main() {
 
 	config, err := service.GetConfiguration()
 
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrate(config, flag.Args()[1:]))
+	}
+
 	router := chi.NewRouter()
 
 	// Basic CORS
@@ -28,13 +38,12 @@ func main() {
 		AllowedOrigins: []string{"https://*", "http://*"},
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
-	router.Use(middleware.Timeout(time.Second * 30))
 	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
 	router.Use(middleware.Compress(5))
@@ -48,7 +57,6 @@ func main() {
 		})
 	}
 	router.Use(configMiddleware)
-	router.Use(service.JwtAuthMiddleware)
 
 	repo, err := service.NewMessageRepository(config)
 
@@ -57,18 +65,128 @@ func main() {
 		os.Exit(-1)
 	}
 
+	broker, err := service.NewBroker(config, repo)
+
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	webhooks, err := service.NewWebhookRepository(repo)
+
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	go service.NewWebhookDispatcher(webhooks, service.NewWebhookClient()).Run(context.Background())
+
+	presence, err := service.NewPresenceRepository(repo)
+
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	go service.ExpirePresence(context.Background(), presence)
+
+	apiKeys, err := service.NewApiKeyRepository(repo)
+
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	repo = service.NewPublishingRepository(repo, broker)
+
+	if config.GetMqttUrl() != nil {
+		bridge, err := service.MakeMqttBridge(config.GetMqttUrl(), config)
+
+		if err != nil {
+			log.Println(err)
+			os.Exit(-1)
+		}
+
+		repo = service.NewPublishingRepository(repo, bridge)
+		err = bridge.Ingest(repo)
+
+		if err != nil {
+			log.Println(err)
+			os.Exit(-1)
+		}
+	}
+
 	repoMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			ctx := context.WithValue(request.Context(), "repo", repo)
+			ctx = context.WithValue(ctx, "broker", broker)
+			ctx = context.WithValue(ctx, "webhookRepo", webhooks)
+			ctx = context.WithValue(ctx, "presenceRepo", presence)
+			ctx = context.WithValue(ctx, "apiKeyRepo", apiKeys)
 			next.ServeHTTP(writer, request.WithContext(ctx))
 		})
 	}
 	router.Use(repoMiddleware)
 
+	read := service.RequireScopes(service.ScopeMessagesRead)
+	write := service.RequireScopes(service.ScopeMessagesWrite)
+
 	router.Route("/messages", func(r chi.Router) {
-		r.With(service.GetMessagesMiddleware).Get("/", service.GetMessages)
-		r.With(service.GetMessageMiddleware).Get("/{id}", service.GetMessage)
-		r.With(service.AddMessageMiddleware).Put("/", service.AddMessage)
+		// The public map reads messages without a token when anonymous reads are enabled.
+		r.With(middleware.Timeout(time.Second*30), service.AnonymousReadMiddleware, read,
+			service.GetMessagesMiddleware).Get("/", service.GetMessages)
+
+		r.Group(func(r chi.Router) {
+			r.Use(service.JwtAuthMiddleware)
+			// Streams stay open for as long as the client listens, so they are exempt from the request timeout.
+			r.With(read, service.StreamMessagesMiddleware).Get("/stream", service.StreamMessages)
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Timeout(time.Second * 30))
+				r.With(read, service.GetUnreadCountMiddleware).Get("/unread-count", service.GetUnreadCount)
+				r.With(read, service.MarkReadMiddleware).Put("/read", service.MarkRead)
+				r.With(read, service.GetMessageMiddleware).Get("/{id}", service.GetMessage)
+				r.With(write, service.AddMessageMiddleware).Put("/", service.AddMessage)
+				// Moderators, allowed messages:moderate, may also delete messages that other users sent.
+				r.With(write, service.DeleteMessageMiddleware).Delete("/{id}", service.DeleteMessage)
+				r.With(write, service.EditMessageMiddleware).Patch("/{id}", service.EditMessage)
+				r.With(read, service.GetRevisionsMiddleware).Get("/{id}/revisions", service.GetRevisions)
+			})
+		})
+	})
+
+	router.Route("/presence", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.Use(middleware.Timeout(time.Second * 30))
+		r.With(read, service.GetPresenceMiddleware).Get("/", service.GetPresence)
+		r.With(write, service.HeartbeatMiddleware).Put("/", service.Heartbeat)
+	})
+
+	// The event log spans every message, so only administrators, such as the services indexing messages, may read it.
+	router.Route("/events", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.Use(service.AdminMiddleware)
+		r.Get("/stream", service.StreamEvents)
+		r.With(middleware.Timeout(time.Second*30), service.GetEventsMiddleware).Get("/", service.GetEvents)
+	})
+
+	router.Route("/webhooks", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.Use(service.AdminMiddleware)
+		r.Use(middleware.Timeout(time.Second * 30))
+		r.With(service.GetWebhooksMiddleware).Get("/", service.GetWebhooks)
+		r.With(service.AddWebhookMiddleware).Post("/", service.AddWebhook)
+		r.With(service.DeleteWebhookMiddleware).Delete("/{id}", service.DeleteWebhook)
+		r.With(service.GetDeadLettersMiddleware).Get("/dead-letters", service.GetDeadLetters)
+	})
+
+	router.Route("/api-keys", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.Use(service.AdminMiddleware)
+		r.Use(middleware.Timeout(time.Second * 30))
+		r.With(service.GetApiKeysMiddleware).Get("/", service.GetApiKeys)
+		r.With(service.AddApiKeyMiddleware).Post("/", service.AddApiKey)
+		r.With(service.DeleteApiKeyMiddleware).Delete("/{id}", service.DeleteApiKey)
 	})
 
 	err = http.ListenAndServe(fmt.Sprintf(":%d", config.GetPort()), router)
@@ -78,3 +196,54 @@ func main() {
 		os.Exit(-1)
 	}
 }
+
+// runMigrate implements the migrate command, "migrate [-dry-run] [up]" applies pending PostgreSQL schema migrations
+// and "migrate status" lists every migration and when it was applied. Returns the process exit code.
+func runMigrate(config service.Configuration, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print pending migrations without applying them")
+	_ = flags.Parse(args)
+
+	if config.GetRepoType() != service.PostgreSqlRepo {
+		log.Printf("migrations only apply to the %s repo type", service.PostgreSqlRepo)
+		return 1
+	}
+
+	db, err := sql.Open("postgres", config.GetPgUrl())
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	switch flags.Arg(0) {
+	case "", "up":
+		_, err = service.MigratePostgresql(ctx, db, *dryRun, os.Stdout)
+	case "status":
+		var statuses []service.MigrationStatus
+		statuses, err = service.PostgresqlMigrationStatus(ctx, db)
+
+		for _, status := range statuses {
+			applied := "pending"
+
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		log.Printf("unknown migrate command %s, expected up or status", flags.Arg(0))
+		return 1
+	}
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type addApiKeyRequest struct {
+	Service Sender   `json:"service"`
+	Scopes  []string `json:"scopes"`
+}
+
+func AddApiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys, ok := request.Context().Value("apiKeyRepo").(ApiKeyRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("api keys not configured"))
+			return
+		}
+
+		var akr addApiKeyRequest
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&akr)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		apiKey := ApiKey{Service: akr.Service, Scopes: akr.Scopes}
+		err = ValidateApiKey(apiKey)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr(err.Error()))
+			return
+		}
+
+		key, hash, err := generateApiKey()
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewInternalServerErr("unable to generate api key"))
+			return
+		}
+
+		apiKey.Hash = hash
+		apiKey, err = keys.AddApiKey(request.Context(), apiKey)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		apiKey.Key = key
+		apiKey.Hash = ""
+		ctx := context.WithValue(request.Context(), "apiKey", &apiKey)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// AddApiKey responds with the created key, this is the only response that includes the key itself.
+func AddApiKey(writer http.ResponseWriter, request *http.Request) {
+	apiKey, ok := request.Context().Value("apiKey").(*ApiKey)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("unable to create api key"))
+		return
+	}
+
+	RenderResponse(writer, request, apiKey)
+}
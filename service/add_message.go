@@ -7,6 +7,10 @@ import (
 	"net/http"
 )
 
+// replayedHeader is set on the response to an add that matched a message the sender had already stored under the same
+// ClientId, so clients can tell a retried submission apart from a new one.
+const replayedHeader = "Idempotent-Replayed"
+
 type addMessageRequest struct {
 	Content  string `json:"content"`
 	Location `json:"location"`
@@ -33,7 +37,7 @@ func AddMessageMiddleware(next http.Handler) http.Handler {
 
 		sender := request.Context().Value("sender").(Sender)
 
-		storedMessage, err := repo.AddMessage(Message{
+		storedMessage, added, err := repo.AddMessage(request.Context(), Message{
 			Sender:  sender,
 			Content: amr.Content,
 			Location: Location{
@@ -45,10 +49,14 @@ func AddMessageMiddleware(next http.Handler) http.Handler {
 
 		if err != nil {
 			log.Println(err)
-			RenderResponse(writer, request, NewInternalServerErr("repo error"))
+			RenderResponse(writer, request, NewRepoErr(err))
 			return
 		}
 
+		if !added {
+			writer.Header().Set(replayedHeader, "true")
+		}
+
 		ctx := context.WithValue(request.Context(), "message", &storedMessage)
 		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
@@ -0,0 +1,51 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func addMessage(tb testing.TB, repo service.MessageRepository, sender service.Sender,
+	body map[string]interface{}) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.With(service.AddMessageMiddleware).Put("/messages", service.AddMessage)
+
+	encoded, err := json.Marshal(body)
+	ok(tb, err)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"repo": repo, "sender": sender}).ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodPut, "/messages", bytes.NewReader(encoded)))
+
+	return recorder
+}
+
+// TestAddMessage_Replayed ensures that retrying a submission with the same client id returns the stored message and
+// marks the response as a replay.
+func TestAddMessage_Replayed(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	sender := service.Sender{Id: "1", Username: "someone"}
+	body := map[string]interface{}{
+		"content":  "hello",
+		"location": map[string]float64{"lat": 40.0, "long": -105.0},
+		"clientId": "client-1",
+	}
+
+	first := addMessage(t, repo, sender, body)
+	equals(t, http.StatusOK, first.Code)
+	equals(t, "", first.Header().Get("Idempotent-Replayed"))
+
+	second := addMessage(t, repo, sender, body)
+	equals(t, http.StatusOK, second.Code)
+	equals(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	var stored, replayed service.StoredMessage
+	ok(t, json.Unmarshal(first.Body.Bytes(), &stored))
+	ok(t, json.Unmarshal(second.Body.Bytes(), &replayed))
+	equals(t, stored.Id, replayed.Id)
+}
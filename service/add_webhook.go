@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// webhookSecretBytes is the length of the random secret generated for each webhook.
+const webhookSecretBytes = 32
+
+type addWebhookRequest struct {
+	Url     string     `json:"url"`
+	Center  *Location  `json:"center"`
+	Radius  float64    `json:"radius"`
+	Polygon []Location `json:"polygon"`
+}
+
+func AddWebhookMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webhooks, ok := request.Context().Value("webhookRepo").(WebhookRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("webhooks not configured"))
+			return
+		}
+
+		var awr addWebhookRequest
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&awr)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		webhook := Webhook{Url: awr.Url, Center: awr.Center, Radius: awr.Radius, Polygon: awr.Polygon}
+		err = ValidateWebhook(webhook)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr(err.Error()))
+			return
+		}
+
+		secret := make([]byte, webhookSecretBytes)
+		_, err = rand.Read(secret)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewInternalServerErr("unable to generate secret"))
+			return
+		}
+
+		webhook.Secret = hex.EncodeToString(secret)
+		webhook, err = webhooks.AddWebhook(request.Context(), webhook)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "webhook", &webhook)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// AddWebhook responds with the registered webhook, this is the only response that includes its secret.
+func AddWebhook(writer http.ResponseWriter, request *http.Request) {
+	webhook, ok := request.Context().Value("webhook").(*Webhook)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("unable to register webhook"))
+		return
+	}
+
+	RenderResponse(writer, request, webhook)
+}
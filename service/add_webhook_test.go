@@ -0,0 +1,84 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func webhooksRouter(repo service.MessageRepository, admin bool) http.Handler {
+	router := chi.NewRouter()
+	router.Route("/webhooks", func(r chi.Router) {
+		r.Use(service.AdminMiddleware)
+		r.With(service.GetWebhooksMiddleware).Get("/", service.GetWebhooks)
+		r.With(service.AddWebhookMiddleware).Post("/", service.AddWebhook)
+	})
+
+	webhooks, _ := service.NewWebhookRepository(repo)
+
+	return withValues(router, map[string]interface{}{"webhookRepo": webhooks, "grants": adminGrants(admin)})
+}
+
+func postWebhook(tb testing.TB, handler http.Handler, body map[string]interface{}) *httptest.ResponseRecorder {
+	encoded, err := json.Marshal(body)
+	ok(tb, err)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(encoded)))
+
+	return recorder
+}
+
+// TestAddWebhook_AdminOnly ensures that only administrators may register webhooks.
+func TestAddWebhook_AdminOnly(t *testing.T) {
+	recorder := postWebhook(t, webhooksRouter(makeInMemoryRepo(t), false), map[string]interface{}{
+		"url":    "https://example.com/hook",
+		"center": map[string]float64{"lat": 40.0, "long": -105.0},
+		"radius": 1000,
+	})
+	equals(t, http.StatusForbidden, recorder.Code)
+}
+
+// TestAddWebhook_SecretShownOnce ensures that a registered webhook's secret is returned when it is registered but not
+// when webhooks are listed.
+func TestAddWebhook_SecretShownOnce(t *testing.T) {
+	handler := webhooksRouter(makeInMemoryRepo(t), true)
+	recorder := postWebhook(t, handler, map[string]interface{}{
+		"url":    "https://example.com/hook",
+		"center": map[string]float64{"lat": 40.0, "long": -105.0},
+		"radius": 1000,
+	})
+	equals(t, http.StatusOK, recorder.Code)
+
+	var added service.Webhook
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &added))
+	equals(t, 64, len(added.Secret))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	equals(t, http.StatusOK, recorder.Code)
+
+	var listed []service.Webhook
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+	equals(t, 1, len(listed))
+	equals(t, added.Id, listed[0].Id)
+	equals(t, "", listed[0].Secret)
+}
+
+// TestAddWebhook_InvalidArea ensures that a webhook must be given exactly one valid area.
+func TestAddWebhook_InvalidArea(t *testing.T) {
+	handler := webhooksRouter(makeInMemoryRepo(t), true)
+
+	for _, body := range []map[string]interface{}{
+		{"url": "https://example.com/hook"},
+		{"url": "https://example.com/hook", "center": map[string]float64{"lat": 40.0, "long": -105.0}},
+		{"url": "https://example.com/hook", "polygon": []map[string]float64{{"lat": 40.0, "long": -105.0}}},
+		{"url": "ftp://example.com/hook", "center": map[string]float64{"lat": 40.0, "long": -105.0}, "radius": 10},
+	} {
+		equals(t, http.StatusBadRequest, postWebhook(t, handler, body).Code)
+	}
+}
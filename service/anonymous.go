@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"math"
+	"net/http"
+)
+
+// AnonymousReadMiddleware lets requests without an Authorization header through as anonymous when the configuration
+// allows anonymous reads, granting them only ScopeMessagesRead. Any other request is authenticated by
+// JwtAuthMiddleware.
+func AnonymousReadMiddleware(next http.Handler) http.Handler {
+	authenticated := JwtAuthMiddleware(next)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		config, ok := request.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
+			return
+		}
+
+		if request.Header.Get("Authorization") != "" || !config.GetAnonymousRead() {
+			authenticated.ServeHTTP(writer, request)
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "anonymous", true)
+		ctx = context.WithValue(ctx, "grants", Grants{Scopes: []string{ScopeMessagesRead}})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// coarsenLocation rounds the coordinates of location to precision decimal places.
+func coarsenLocation(location Location, precision int) Location {
+	scale := math.Pow10(precision)
+
+	return Location{
+		Lat:  math.Round(location.Lat*scale) / scale,
+		Long: math.Round(location.Long*scale) / scale,
+	}
+}
+
+// coarseMargin is the farthest, in meters, coarsenLocation can move a location rounded to precision decimal places,
+// half the diagonal of a cell of the grid it rounds to.
+func coarseMargin(precision int) float64 {
+	const metersPerDegree = 111320
+
+	return math.Sqrt2 / 2 * metersPerDegree / math.Pow10(precision)
+}
+
+// withinCoarsened keeps those of the anonymized messages whose coarsened location is within radiusMeters of center.
+func withinCoarsened(messages []StoredMessage, center Location, radiusMeters float64) []StoredMessage {
+	within := messages[:0]
+
+	for _, message := range messages {
+		if distance(center, message.Location) <= radiusMeters {
+			within = append(within, message)
+		}
+	}
+
+	return within
+}
+
+// anonymize strips what identifies the senders of messages shown to anonymous callers, and coarsens their locations
+// to precision decimal places.
+func anonymize(messages []StoredMessage, precision int) {
+	for i := range messages {
+		messages[i].Sender = Sender{}
+		messages[i].ClientId = ""
+		messages[i].Location = coarsenLocation(messages[i].Location, precision)
+	}
+}
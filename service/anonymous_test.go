@@ -0,0 +1,109 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// getMessagesAnonymously sends a request without a token through AnonymousReadMiddleware to GET /messages.
+func getMessagesAnonymously(tb testing.TB, repo service.MessageRepository, query string) *httptest.ResponseRecorder {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.With(service.AnonymousReadMiddleware, service.RequireScopes(service.ScopeMessagesRead),
+		service.GetMessagesMiddleware).Get("/messages", service.GetMessages)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"repo": repo, "config": config}).ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodGet, "/messages?"+query, nil))
+
+	return recorder
+}
+
+// TestGetMessages_AnonymousDisabled ensures that requests without a token are rejected unless anonymous reads are
+// enabled.
+func TestGetMessages_AnonymousDisabled(t *testing.T) {
+	recorder := getMessagesAnonymously(t, makeInMemoryRepo(t), "lat=40&long=-105")
+	equals(t, http.StatusUnauthorized, recorder.Code)
+}
+
+// TestGetMessages_Anonymous ensures that anonymous callers get messages without their senders and with coarsened
+// locations, are held to the anonymous radius and limit, and query around a center snapped to the anonymous precision.
+func TestGetMessages_Anonymous(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_READ", "true")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_PRECISION", "2")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_MAX_RADIUS", "500")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_MIN_RADIUS", "100")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_MAX_LIMIT", "2")
+
+	repo := makeInMemoryRepo(t)
+	alice := service.Sender{Id: "1", Username: "alice"}
+
+	for i := 0; i < 3; i++ {
+		_, _, err := repo.AddMessage(context.Background(), service.Message{Sender: alice, Content: "hello",
+			ClientId: strconv.Itoa(i), Location: service.Location{Lat: 40.001234, Long: -105.005678}})
+		ok(t, err)
+	}
+
+	recorder := getMessagesAnonymously(t, repo, "lat=40.001&long=-105.005&radius=500")
+	equals(t, http.StatusOK, recorder.Code)
+
+	var messages []service.StoredMessage
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+	equals(t, 2, len(messages))
+
+	for _, message := range messages {
+		equals(t, service.Sender{}, message.Sender)
+		equals(t, "", message.ClientId)
+		equals(t, service.Location{Lat: 40.0, Long: -105.01}, message.Location)
+		equals(t, "hello", message.Content)
+		equals(t, true, message.Seen == nil)
+	}
+
+	// The center is snapped to 40.0, -105.01, where the messages are shown, rather than about 560 meters from them.
+	recorder = getMessagesAnonymously(t, repo, "lat=40.004&long=-105.014&radius=100")
+	equals(t, http.StatusOK, recorder.Code)
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+	equals(t, 2, len(messages))
+
+	equals(t, http.StatusBadRequest, getMessagesAnonymously(t, repo, "lat=40&long=-105&radius=501").Code)
+	equals(t, http.StatusBadRequest, getMessagesAnonymously(t, repo, "lat=40&long=-105&radius=99").Code)
+	equals(t, http.StatusBadRequest, getMessagesAnonymously(t, repo, "lat=40&long=-105&limit=3").Code)
+	equals(t, http.StatusOK, getMessagesAnonymously(t, repo, "lat=40&long=-105&radius=500&limit=2").Code)
+}
+
+// TestGetMessages_AnonymousRadiusCoarsened ensures that anonymous callers cannot learn how far a message was sent from
+// by varying the radius, radii differing by less than a grid cell return the same messages.
+func TestGetMessages_AnonymousRadiusCoarsened(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_READ", "true")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_PRECISION", "2")
+	t.Setenv("MESSAGE_SERVICE_ANONYMOUS_MIN_RADIUS", "100")
+
+	repo := makeInMemoryRepo(t)
+	near := service.Location{Lat: 40.001234, Long: -105.005678}
+	far := service.Location{Lat: 40.004, Long: -105.014}
+
+	for i, location := range []service.Location{near, far} {
+		_, _, err := repo.AddMessage(context.Background(), service.Message{Content: "hello",
+			Sender: service.Sender{Id: "1", Username: "alice"}, ClientId: strconv.Itoa(i), Location: location})
+		ok(t, err)
+	}
+
+	// Both messages are shown at 40.0, -105.01, the snapped center, although they were sent about 390 and 560 meters
+	// from it.
+	for _, radius := range []string{"100", "380", "400", "550", "570", "1000"} {
+		recorder := getMessagesAnonymously(t, repo, "lat=40.0&long=-105.01&radius="+radius)
+		equals(t, http.StatusOK, recorder.Code)
+
+		var messages []service.StoredMessage
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+		equals(t, 2, len(messages))
+	}
+}
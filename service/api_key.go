@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ApiKeyPrefix starts every API key, telling them apart from JWTs in the Authorization header.
+	ApiKeyPrefix = "yk_"
+	// ServiceIdPrefix starts the id of every service identity an API key acts as. Tokens naming such an id are
+	// refused, so a key and a user never share an identity.
+	ServiceIdPrefix = "service:"
+	// apiKeyBytes is the length of the random part of each API key.
+	apiKeyBytes = 32
+)
+
+// apiKeyScopes are the scopes an API key may be granted, keys never hold roles.
+var apiKeyScopes = []string{ScopeMessagesRead, ScopeMessagesWrite, ScopeMessagesModerate}
+
+// ApiKey is a long lived credential for an integration that cannot log in, such as a bot. Requests bearing it act as
+// its service identity with its scopes.
+type ApiKey struct {
+	Id string `json:"id"`
+	// Key is the credential itself, it is only revealed when the key is created.
+	Key string `json:"key,omitempty"`
+	// Hash is the SHA-256 of Key, the only form in which the key is stored.
+	Hash      string    `json:"hash,omitempty"`
+	Service   Sender    `json:"service"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (ak ApiKey) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// ValidateApiKey reports why an API key cannot be created, if it cannot.
+func ValidateApiKey(key ApiKey) error {
+	if key.Service.Id == "" || key.Service.Username == "" {
+		return errors.New("service id and username are required")
+	}
+
+	if !strings.HasPrefix(key.Service.Id, ServiceIdPrefix) || key.Service.Id == ServiceIdPrefix {
+		return errors.New("service id must start with " + ServiceIdPrefix)
+	}
+
+	if len(key.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range key.Scopes {
+		if !contains(apiKeyScopes, scope) {
+			return errors.New("unknown scope " + scope)
+		}
+	}
+
+	return nil
+}
+
+// generateApiKey creates a new random API key, returning it along with its hash.
+func generateApiKey() (string, string, error) {
+	secret := make([]byte, apiKeyBytes)
+	_, err := rand.Read(secret)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	key := ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	return key, hashApiKey(key), nil
+}
+
+// hashApiKey hashes an API key for storage and lookup. Keys are random rather than chosen by people, so a fast hash
+// is as hard to reverse as a slow one.
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// ApiKeyRepository stores the hashes of API keys along with the identity and scopes each is bound to.
+type ApiKeyRepository interface {
+	// AddApiKey stores a key, which must carry its Hash but not the Key itself.
+	AddApiKey(ctx context.Context, key ApiKey) (ApiKey, error)
+	// GetApiKeys retrieves every key, oldest first.
+	GetApiKeys(ctx context.Context) ([]ApiKey, error)
+	// GetApiKeyByHash retrieves the key with the given hash, returning ErrApiKeyNotFound if there is none.
+	GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error)
+	// DeleteApiKey revokes a key, returning ErrApiKeyNotFound if there is none.
+	DeleteApiKey(ctx context.Context, id string) error
+}
+
+// ErrApiKeyNotFound is returned by ApiKeyRepository methods that require an existing key when there is none.
+var ErrApiKeyNotFound error = errRepository{errors.New("api key not found")}
+
+// NewApiKeyRepository retrieves the ApiKeyRepository sharing storage with repo.
+func NewApiKeyRepository(repo MessageRepository) (ApiKeyRepository, error) {
+	keys, ok := repo.(ApiKeyRepository)
+
+	if !ok {
+		return nil, newErrRepository("repository does not support api keys")
+	}
+
+	return keys, nil
+}
+
+// authenticateApiKey looks up an API key, returning the service identity it is bound to and the scopes it grants.
+func authenticateApiKey(ctx context.Context, keys ApiKeyRepository, key string) (Sender, Grants, error) {
+	stored, err := keys.GetApiKeyByHash(ctx, hashApiKey(strings.TrimSpace(key)))
+
+	if err != nil {
+		return Sender{}, Grants{}, err
+	}
+
+	return stored.Service, Grants{Scopes: stored.Scopes}, nil
+}
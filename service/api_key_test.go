@@ -0,0 +1,115 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiKeysRouter serves the API key endpoints to an administrator, along with a route reporting who the bearer of a
+// key is once they are allowed messages:write.
+func apiKeysRouter(tb testing.TB, repo service.MessageRepository) http.Handler {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	keys, err := service.NewApiKeyRepository(repo)
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.Route("/api-keys", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return withValues(next, map[string]interface{}{"grants": adminGrants(true)})
+		})
+		r.With(service.GetApiKeysMiddleware).Get("/", service.GetApiKeys)
+		r.With(service.AddApiKeyMiddleware).Post("/", service.AddApiKey)
+		r.With(service.DeleteApiKeyMiddleware).Delete("/{id}", service.DeleteApiKey)
+	})
+	router.With(service.JwtAuthMiddleware, service.RequireScopes(service.ScopeMessagesWrite)).Get("/whoami",
+		func(writer http.ResponseWriter, request *http.Request) {
+			_ = json.NewEncoder(writer).Encode(request.Context().Value("sender"))
+		})
+
+	return withValues(router, map[string]interface{}{"config": config, "apiKeyRepo": keys})
+}
+
+func serveApiKeys(handler http.Handler, method string, path string, body string,
+	authorization string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// TestApiKeys_Lifecycle ensures that a created key is revealed once, authenticates as its service identity with its
+// scopes, is listed without its key or hash, and is rejected once revoked.
+func TestApiKeys_Lifecycle(t *testing.T) {
+	handler := apiKeysRouter(t, makeInMemoryRepo(t))
+
+	recorder := serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"service": {"id": "service:alerts", "username": "Alerts"}, "scopes": ["messages:read", "messages:write"]}`, "")
+	equals(t, http.StatusOK, recorder.Code)
+
+	var created service.ApiKey
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+	equals(t, true, strings.HasPrefix(created.Key, service.ApiKeyPrefix))
+	equals(t, "", created.Hash)
+
+	recorder = serveApiKeys(handler, http.MethodGet, "/whoami", "", "Bearer "+created.Key)
+	equals(t, http.StatusOK, recorder.Code)
+
+	var sender service.Sender
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &sender))
+	equals(t, service.Sender{Id: "service:alerts", Username: "Alerts"}, sender)
+
+	equals(t, http.StatusUnauthorized, serveApiKeys(handler, http.MethodGet, "/whoami", "",
+		"Bearer "+created.Key+"x").Code)
+
+	recorder = serveApiKeys(handler, http.MethodGet, "/api-keys", "", "")
+	equals(t, http.StatusOK, recorder.Code)
+
+	var listed []service.ApiKey
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+	equals(t, 1, len(listed))
+	equals(t, created.Id, listed[0].Id)
+	equals(t, "", listed[0].Key)
+	equals(t, "", listed[0].Hash)
+
+	equals(t, http.StatusNoContent, serveApiKeys(handler, http.MethodDelete, "/api-keys/"+created.Id, "", "").Code)
+	equals(t, http.StatusNotFound, serveApiKeys(handler, http.MethodDelete, "/api-keys/"+created.Id, "", "").Code)
+	equals(t, http.StatusUnauthorized, serveApiKeys(handler, http.MethodGet, "/whoami", "",
+		"Bearer "+created.Key).Code)
+}
+
+// TestApiKeys_Scopes ensures that keys only hold the scopes they were created with, and that keys with unknown scopes
+// or without a service identity in the service namespace are refused.
+func TestApiKeys_Scopes(t *testing.T) {
+	handler := apiKeysRouter(t, makeInMemoryRepo(t))
+
+	recorder := serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"service": {"id": "service:kiosk", "username": "Lobby kiosk"}, "scopes": ["messages:read"]}`, "")
+	equals(t, http.StatusOK, recorder.Code)
+
+	var created service.ApiKey
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+	equals(t, http.StatusForbidden, serveApiKeys(handler, http.MethodGet, "/whoami", "", "Bearer "+created.Key).Code)
+
+	equals(t, http.StatusBadRequest, serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"service": {"id": "service:kiosk", "username": "Lobby kiosk"}, "scopes": ["admin"]}`, "").Code)
+	equals(t, http.StatusBadRequest, serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"service": {"id": "service:kiosk", "username": "Lobby kiosk"}, "scopes": []}`, "").Code)
+	equals(t, http.StatusBadRequest, serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"scopes": ["messages:read"]}`, "").Code)
+	equals(t, http.StatusBadRequest, serveApiKeys(handler, http.MethodPost, "/api-keys",
+		`{"service": {"id": "1", "username": "someone"}, "scopes": ["messages:read"]}`, "").Code)
+}
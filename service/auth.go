@@ -4,10 +4,98 @@ import (
 	"context"
 	"errors"
 	"github.com/golang-jwt/jwt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// errUnauthorized is returned by authenticate for a token that is valid but lacks the claims identifying a user.
+var errUnauthorized = errors.New("unauthorized")
+
+// authenticate validates a bearer token, returning the sender it identifies and the roles and scopes it grants.
+// Only the algorithms allowed by config are accepted, each validated with the key of its own kind so that a token
+// cannot pass off the public key as an HMAC secret.
+func authenticate(config Configuration, jwtToken string) (Sender, Grants, error) {
+	// Claims are validated below, allowing for clock skew.
+	parser := jwt.Parser{ValidMethods: config.GetTokenAlgorithms(), SkipClaimsValidation: true}
+	token, err := parser.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if config.GetTokenSecretKey() != "" {
+				return []byte(config.GetTokenSecretKey()), nil
+			}
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			kid, _ := token.Header["kid"].(string)
+
+			// A token naming its key is verified with that key from the JWKS document, so keys can be rotated.
+			if config.GetTokenKeySet() != nil && (kid != "" || config.GetTokenPublicKey() == nil) {
+				return config.GetTokenKeySet().Key(kid, token.Method.Alg())
+			}
+
+			if config.GetTokenPublicKey() != nil {
+				return config.GetTokenPublicKey(), nil
+			}
+		}
+
+		return nil, errors.New("unexpected signing method " + token.Method.Alg())
+	})
+
+	if err != nil {
+		return Sender{}, Grants{}, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+
+	if !ok || !token.Valid {
+		return Sender{}, Grants{}, errUnauthorized
+	}
+
+	err = validateClaims(config, claims, time.Now())
+
+	if err != nil {
+		return Sender{}, Grants{}, err
+	}
+
+	if _, ok := claims["email"]; !ok {
+		return Sender{}, Grants{}, errUnauthorized
+	}
+
+	sub, subOk := claims["sub"].(string)
+	username, usernameOk := claims["username"].(string)
+
+	// Ids in the service namespace belong to API keys, which a token must not be able to act as.
+	if !subOk || !usernameOk || sub == "" || strings.HasPrefix(sub, ServiceIdPrefix) {
+		return Sender{}, Grants{}, errUnauthorized
+	}
+
+	return Sender{Id: sub, Username: username}, grantsFromClaims(claims), nil
+}
+
+// validateClaims checks the exp, nbf, iss and aud claims of a token as config requires, tolerating
+// GetTokenLeeway of difference between the issuer's clock and now.
+func validateClaims(config Configuration, claims jwt.MapClaims, now time.Time) error {
+	leeway := int64(config.GetTokenLeeway() / time.Second)
+
+	if !claims.VerifyExpiresAt(now.Unix()-leeway, config.GetTokenRequireExp()) {
+		return errors.New("token is expired")
+	}
+
+	if !claims.VerifyNotBefore(now.Unix()+leeway, false) {
+		return errors.New("token is not valid yet")
+	}
+
+	if config.GetTokenIssuer() != "" && !claims.VerifyIssuer(config.GetTokenIssuer(), true) {
+		return errors.New("token has the wrong issuer")
+	}
+
+	if config.GetTokenAudience() != "" && !claims.VerifyAudience(config.GetTokenAudience(), true) {
+		return errors.New("token is not intended for this service")
+	}
+
+	return nil
+}
+
 func JwtAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		authHeader := strings.Split(request.Header.Get("Authorization"), "Bearer ")
@@ -23,46 +111,43 @@ func JwtAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		jwtToken := authHeader[1]
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-			if config.GetTokenSecretKey() != "" {
-				return []byte(config.GetTokenSecretKey()), nil
-			}
-
-			if config.GetTokenPrivateKey() != nil {
-				return config.GetTokenPrivateKey(), nil
-			}
+		var sender Sender
+		var grants Grants
+		var err error
 
-			return "", errors.New("unknown signing method")
+		// Integrations that cannot log in present an API key in place of a JWT.
+		if strings.HasPrefix(authHeader[1], ApiKeyPrefix) {
+			keys, ok := request.Context().Value("apiKeyRepo").(ApiKeyRepository)
 
-		})
+			if !ok {
+				RenderResponse(writer, request, NewInternalServerErr("api keys not configured"))
+				return
+			}
 
-		if err != nil {
-			RenderResponse(writer, request, NewUnauthorizedErr(err.Error()))
-			return
-		}
+			sender, grants, err = authenticateApiKey(request.Context(), keys, authHeader[1])
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			if _, ok := claims["username"]; !ok {
-				RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
+			if errors.Is(err, ErrApiKeyNotFound) {
+				RenderResponse(writer, request, NewUnauthorizedErr("unknown api key"))
+				return
+			} else if err != nil {
+				log.Println(err)
+				RenderResponse(writer, request, NewRepoErr(err))
 				return
 			}
+		} else {
+			sender, grants, err = authenticate(config, authHeader[1])
 
-			if _, ok := claims["email"]; !ok {
-				RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
+			if err != nil {
+				RenderResponse(writer, request, NewUnauthorizedErr(err.Error()))
 				return
 			}
+		}
 
-			ctx := context.WithValue(request.Context(), "sender", Sender{
-				Id:       claims["sub"].(string),
-				Username: claims["username"].(string),
-			})
+		ctx := context.WithValue(request.Context(), "sender", sender)
+		ctx = context.WithValue(ctx, "grants", grants)
 
-			// Access context values in handlers like this
-			// props, _ := r.Context().Value("props").(jwt.MapClaims)
-			next.ServeHTTP(writer, request.WithContext(ctx))
-		} else {
-			RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-		}
+		// Access context values in handlers like this
+		// props, _ := r.Context().Value("props").(jwt.MapClaims)
+		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
 }
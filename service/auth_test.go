@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRsaKey generates an RSA key for the duration of the test, configuring only its public half for validating
+// tokens. Returns the private key and the PEM encoded public key.
+func writeRsaKey(tb testing.TB) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	ok(tb, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ok(tb, err)
+
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(tb.TempDir(), "token.pub")
+	ok(tb, os.WriteFile(path, publicPem, 0o600))
+
+	tb.Setenv("MESSAGE_SERVICE_TOKEN_SECRET", "")
+	tb.Setenv("MESSAGE_SERVICE_TOKEN_PRIV", "")
+	tb.Setenv("MESSAGE_SERVICE_TOKEN_PUB", path)
+
+	return key, publicPem
+}
+
+// userClaims are the claims of a valid token identifying a user.
+func userClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":      "1",
+		"username": "someone",
+		"email":    "someone@example.com",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// authenticateToken sends a request bearing token through JwtAuthMiddleware, returning the response status.
+func authenticateToken(tb testing.TB, token string) int {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.With(service.JwtAuthMiddleware).Get("/", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"config": config}).ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+// TestJwtAuthMiddleware_RS256PublicKeyOnly ensures that RS256 tokens are validated with the public key alone, and that
+// tokens using an algorithm outside the allow-list, or passing off the public key as an HMAC secret, are rejected.
+func TestJwtAuthMiddleware_RS256PublicKeyOnly(t *testing.T) {
+	key, publicPem := writeRsaKey(t)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, userClaims()).SignedString(key)
+	ok(t, err)
+	equals(t, http.StatusNoContent, authenticateToken(t, token))
+
+	confused, err := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims()).SignedString(publicPem)
+	ok(t, err)
+	equals(t, http.StatusUnauthorized, authenticateToken(t, confused))
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, userClaims()).SignedString(
+		jwt.UnsafeAllowNoneSignatureType)
+	ok(t, err)
+	equals(t, http.StatusUnauthorized, authenticateToken(t, unsigned))
+
+	rs512, err := jwt.NewWithClaims(jwt.SigningMethodRS512, userClaims()).SignedString(key)
+	ok(t, err)
+	equals(t, http.StatusUnauthorized, authenticateToken(t, rs512))
+
+	t.Setenv("MESSAGE_SERVICE_TOKEN_ALGORITHMS", "RS256, RS512")
+	equals(t, http.StatusNoContent, authenticateToken(t, rs512))
+}
+
+// TestJwtAuthMiddleware_Claims ensures that the exp, nbf, iss and aud claims are enforced as configured, with leeway
+// for clock skew, and that tokens without usable sub and username claims, or naming a service identity, are rejected
+// rather than panicking.
+func TestJwtAuthMiddleware_Claims(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_TOKEN_SECRET", "secret")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_ISSUER", "https://auth.example.com")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_AUDIENCE", "message")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_REQUIRE_EXP", "true")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_LEEWAY", "30")
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		change   func(claims jwt.MapClaims)
+		expected int
+	}{
+		{"valid", func(claims jwt.MapClaims) {}, http.StatusNoContent},
+		{"audience list", func(claims jwt.MapClaims) { claims["aud"] = []string{"other", "message"} },
+			http.StatusNoContent},
+		{"expired within leeway", func(claims jwt.MapClaims) { claims["exp"] = now.Add(-10 * time.Second).Unix() },
+			http.StatusNoContent},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = now.Add(-time.Minute).Unix() },
+			http.StatusUnauthorized},
+		{"missing exp", func(claims jwt.MapClaims) { delete(claims, "exp") }, http.StatusUnauthorized},
+		{"non-numeric exp", func(claims jwt.MapClaims) { claims["exp"] = "tomorrow" }, http.StatusUnauthorized},
+		{"not yet valid within leeway", func(claims jwt.MapClaims) { claims["nbf"] = now.Add(10 * time.Second).Unix() },
+			http.StatusNoContent},
+		{"not yet valid", func(claims jwt.MapClaims) { claims["nbf"] = now.Add(time.Minute).Unix() },
+			http.StatusUnauthorized},
+		{"wrong issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" },
+			http.StatusUnauthorized},
+		{"missing issuer", func(claims jwt.MapClaims) { delete(claims, "iss") }, http.StatusUnauthorized},
+		{"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "other" }, http.StatusUnauthorized},
+		{"missing sub", func(claims jwt.MapClaims) { delete(claims, "sub") }, http.StatusUnauthorized},
+		{"numeric sub", func(claims jwt.MapClaims) { claims["sub"] = 1 }, http.StatusUnauthorized},
+		{"service sub", func(claims jwt.MapClaims) { claims["sub"] = service.ServiceIdPrefix + "alerts" },
+			http.StatusUnauthorized},
+		{"non-string username", func(claims jwt.MapClaims) { claims["username"] = []string{"someone"} },
+			http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := userClaims()
+			claims["iss"] = "https://auth.example.com"
+			claims["aud"] = "message"
+			test.change(claims)
+
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			ok(t, err)
+			equals(t, test.expected, authenticateToken(t, token))
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ScopeMessagesRead allows reading messages and presence, and marking messages read.
+	ScopeMessagesRead = "messages:read"
+	// ScopeMessagesWrite allows sending, editing and deleting one's own messages, and sending heartbeats.
+	ScopeMessagesWrite = "messages:write"
+	// ScopeMessagesModerate allows deleting messages that other users sent.
+	ScopeMessagesModerate = "messages:moderate"
+
+	// RoleAdmin may do anything, including reading the event log and managing webhooks.
+	RoleAdmin = "admin"
+	// RoleModerator may delete messages that other users sent.
+	RoleModerator = "moderator"
+)
+
+// defaultScopes are granted to tokens that carry no scope claim, so that tokens issued before scopes were introduced
+// keep working.
+var defaultScopes = []string{ScopeMessagesRead, ScopeMessagesWrite}
+
+// roleScopes are the scopes each role grants on top of those the token carries.
+var roleScopes = map[string][]string{
+	RoleAdmin:     {ScopeMessagesRead, ScopeMessagesWrite, ScopeMessagesModerate},
+	RoleModerator: {ScopeMessagesRead, ScopeMessagesWrite, ScopeMessagesModerate},
+}
+
+// Grants are the roles and scopes a token carries, JwtAuthMiddleware puts them in the request context as "grants".
+type Grants struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasRole reports whether the grants include role.
+func (g Grants) HasRole(role string) bool {
+	return contains(g.Roles, role)
+}
+
+// Allows reports whether the grants include scope, either directly or through one of their roles.
+func (g Grants) Allows(scope string) bool {
+	if contains(g.Scopes, scope) {
+		return true
+	}
+
+	for _, role := range g.Roles {
+		if contains(roleScopes[role], scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grantsFromClaims reads the roles in the "roles" claim, and the scopes in the "scope" claim or failing that the "scp"
+// claim. Either may be a space separated string or a list of strings. The legacy "admin" claim grants RoleAdmin.
+func grantsFromClaims(claims jwt.MapClaims) Grants {
+	var grants Grants
+	grants.Roles = claimValues(claims["roles"])
+
+	if admin, _ := claims["admin"].(bool); admin && !grants.HasRole(RoleAdmin) {
+		grants.Roles = append(grants.Roles, RoleAdmin)
+	}
+
+	scopes, found := claims["scope"]
+
+	if !found {
+		scopes, found = claims["scp"]
+	}
+
+	if found {
+		grants.Scopes = claimValues(scopes)
+	} else {
+		grants.Scopes = append([]string(nil), defaultScopes...)
+	}
+
+	return grants
+}
+
+// claimValues splits a claim holding either a space separated string or a list of strings, ignoring anything else.
+func claimValues(claim interface{}) []string {
+	var values []string
+
+	switch claim := claim.(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok && value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values
+}
+
+// RequireScopes builds middleware rejecting requests whose grants do not allow every one of scopes, it must follow
+// JwtAuthMiddleware.
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			grants, _ := request.Context().Value("grants").(Grants)
+
+			for _, scope := range scopes {
+				if !grants.Allows(scope) {
+					RenderResponse(writer, request, NewForbiddenErr("token lacks the "+scope+" scope"))
+					return
+				}
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// RequireRole builds middleware rejecting requests whose grants include none of roles, it must follow
+// JwtAuthMiddleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			grants, _ := request.Context().Value("grants").(Grants)
+
+			for _, role := range roles {
+				if grants.HasRole(role) {
+					next.ServeHTTP(writer, request)
+					return
+				}
+			}
+
+			RenderResponse(writer, request, NewForbiddenErr("requires the "+strings.Join(roles, " or ")+" role"))
+		})
+	}
+}
+
+// AdminMiddleware rejects requests from users who are not administrators, it must follow JwtAuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return RequireRole(RoleAdmin)(next)
+}
@@ -0,0 +1,100 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminGrants are the grants of an administrator when admin is set, and of a user holding no role otherwise.
+func adminGrants(admin bool) service.Grants {
+	if admin {
+		return service.Grants{Roles: []string{service.RoleAdmin}}
+	}
+
+	return service.Grants{Scopes: []string{service.ScopeMessagesRead, service.ScopeMessagesWrite}}
+}
+
+// authorizeToken sends a request bearing a token with claims through JwtAuthMiddleware and policy, returning the
+// response status.
+func authorizeToken(tb testing.TB, claims jwt.MapClaims, policy func(http.Handler) http.Handler) int {
+	tb.Setenv("MESSAGE_SERVICE_TOKEN_SECRET", "secret")
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.With(service.JwtAuthMiddleware, policy).Get("/", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"config": config}).ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+// TestRequireScopes_Claims ensures that scopes are read from the scope or scp claims, that roles grant the scopes that
+// go with them, and that tokens carrying no scope claim keep the read and write access they had before scopes.
+func TestRequireScopes_Claims(t *testing.T) {
+	read := service.RequireScopes(service.ScopeMessagesRead)
+	write := service.RequireScopes(service.ScopeMessagesWrite)
+	moderate := service.RequireScopes(service.ScopeMessagesModerate)
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		policy   func(http.Handler) http.Handler
+		expected int
+	}{
+		{"no scope claim reads", map[string]interface{}{}, read, http.StatusNoContent},
+		{"no scope claim writes", map[string]interface{}{}, write, http.StatusNoContent},
+		{"no scope claim moderates", map[string]interface{}{}, moderate, http.StatusForbidden},
+		{"read only reads", map[string]interface{}{"scope": "messages:read"}, read, http.StatusNoContent},
+		{"read only writes", map[string]interface{}{"scope": "messages:read"}, write, http.StatusForbidden},
+		{"scope string", map[string]interface{}{"scope": "profile messages:write"}, write, http.StatusNoContent},
+		{"scp list", map[string]interface{}{"scp": []string{"messages:write"}}, write, http.StatusNoContent},
+		{"empty scope", map[string]interface{}{"scope": ""}, read, http.StatusForbidden},
+		{"moderator role", map[string]interface{}{"roles": []string{"moderator"}, "scope": ""}, moderate,
+			http.StatusNoContent},
+		{"unknown role", map[string]interface{}{"roles": "reviewer", "scope": ""}, read, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := userClaims()
+
+			for key, value := range test.claims {
+				claims[key] = value
+			}
+
+			equals(t, test.expected, authorizeToken(t, claims, test.policy))
+		})
+	}
+}
+
+// TestRequireRole_Claims ensures that only tokens holding one of the required roles are let through, with the legacy
+// admin claim standing for the admin role.
+func TestRequireRole_Claims(t *testing.T) {
+	claims := userClaims()
+	equals(t, http.StatusForbidden, authorizeToken(t, claims, service.AdminMiddleware))
+
+	claims["roles"] = []string{service.RoleModerator}
+	equals(t, http.StatusForbidden, authorizeToken(t, claims, service.AdminMiddleware))
+	equals(t, http.StatusNoContent, authorizeToken(t, claims,
+		service.RequireRole(service.RoleAdmin, service.RoleModerator)))
+
+	claims["roles"] = "admin"
+	equals(t, http.StatusNoContent, authorizeToken(t, claims, service.AdminMiddleware))
+
+	delete(claims, "roles")
+	claims["admin"] = true
+	equals(t, http.StatusNoContent, authorizeToken(t, claims, service.AdminMiddleware))
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"log"
+)
+
+// Publisher announces newly stored messages.
+type Publisher interface {
+	Publish(ctx context.Context, msg StoredMessage) error
+}
+
+// Broker carries new message events to the live subscribers of every instance of the service.
+type Broker interface {
+	// Publish announces a newly stored message to the subscribers watching its location, on this instance and
+	// every other instance sharing the broker.
+	Publish(ctx context.Context, msg StoredMessage) error
+	// Subscribe starts delivering the messages published within radiusMeters of center. The subscription must be
+	// closed once it is no longer needed.
+	Subscribe(center Location, radiusMeters float64) *Subscription
+	// Close stops the broker from receiving events.
+	Close() error
+}
+
+// NewBroker constructs a Broker from the given configuration. repo is where a broker looks up messages announced by
+// other instances.
+func NewBroker(config Configuration, repo MessageRepository) (Broker, error) {
+	switch config.GetBrokerType() {
+	case PostgreSqlBroker:
+		// Announcements share the repository's connection pool.
+		pg, ok := repo.(*postgresqlMessageRepository)
+
+		if !ok {
+			return nil, newErrRepository("the " + PostgreSqlBroker.String() + " broker requires the " +
+				PostgreSqlRepo.String() + " repository")
+		}
+
+		return MakePostgresqlBroker(pg.db, config.GetPgUrl(), repo)
+	default:
+		return NewInProcessBroker(), nil
+	}
+}
+
+// inProcessBroker only reaches subscribers of the instance a message was published on.
+type inProcessBroker struct {
+	feed *Feed
+}
+
+// NewInProcessBroker constructs a Broker for a single instance of the service.
+func NewInProcessBroker() Broker {
+	return &inProcessBroker{NewFeed()}
+}
+
+func (ipb *inProcessBroker) Publish(_ context.Context, msg StoredMessage) error {
+	ipb.feed.Publish(msg)
+
+	return nil
+}
+
+func (ipb *inProcessBroker) Subscribe(center Location, radiusMeters float64) *Subscription {
+	return ipb.feed.Subscribe(center, radiusMeters)
+}
+
+func (ipb *inProcessBroker) Close() error {
+	return nil
+}
+
+// publishingRepository publishes every message it adds to a Publisher, such as a Broker.
+type publishingRepository struct {
+	MessageRepository
+	publisher Publisher
+}
+
+// NewPublishingRepository wraps repo so that each message it stores through AddMessage is published to publisher.
+// Replayed submissions are not published again.
+func NewPublishingRepository(repo MessageRepository, publisher Publisher) MessageRepository {
+	return &publishingRepository{repo, publisher}
+}
+
+func (pr *publishingRepository) AddMessage(ctx context.Context, message Message) (StoredMessage, bool, error) {
+	msg, added, err := pr.MessageRepository.AddMessage(ctx, message)
+
+	if err == nil && added {
+		// The message is stored either way, live subscribers can catch up on it through GetMessagesForLocation.
+		if publishErr := pr.publisher.Publish(ctx, msg); publishErr != nil {
+			log.Println(publishErr)
+		}
+	}
+
+	return msg, added, err
+}
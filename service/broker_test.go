@@ -0,0 +1,42 @@
+package service_test
+
+import (
+	"context"
+	"github.com/stone1549/yapyapyap/message/service"
+	"testing"
+)
+
+// TestInProcessBroker_PublishWithinRadius ensures that subscribers only receive messages stored inside the area they
+// watch, and that replayed submissions are not published twice.
+func TestInProcessBroker_PublishWithinRadius(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	defer broker.Close()
+
+	sub := broker.Subscribe(service.Location{Lat: 40.0, Long: -105.0}, 1000)
+	defer sub.Close()
+
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+	nearMsg := service.Message{Content: "near", Location: service.Location{Lat: 40.001, Long: -105.0},
+		ClientId: "client-1"}
+	near, _, err := repo.AddMessage(context.Background(), nearMsg)
+	ok(t, err)
+	_, _, err = repo.AddMessage(context.Background(), nearMsg)
+	ok(t, err)
+	_, _, err = repo.AddMessage(context.Background(), service.Message{Content: "far",
+		Location: service.Location{Lat: 41.0, Long: -105.0}})
+	ok(t, err)
+
+	equals(t, near, <-sub.Messages())
+	equals(t, 0, len(sub.Messages()))
+}
+
+// TestNewBroker_InProcessByDefault ensures that an in process broker is used unless another is configured.
+func TestNewBroker_InProcessByDefault(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, service.InProcessBroker, config.GetBrokerType())
+
+	broker, err := service.NewBroker(config, makeInMemoryRepo(t))
+	ok(t, err)
+	ok(t, broker.Close())
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
+	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -12,15 +16,40 @@ import (
 )
 
 const (
-	lifeCycleKey      string = "MESSAGE_SERVICE_ENVIRONMENT"
-	repoTypeKey       string = "MESSAGE_SERVICE_REPO_TYPE"
-	timeoutSecondsKey string = "MESSAGE_SERVICE_TIMEOUT"
-	portKey           string = "MESSAGE_SERVICE_PORT"
-	pgUrlKey          string = "MESSAGE_SERVICE_PG_URL"
-	initDatasetKey    string = "MESSAGE_SERVICE_INIT_DATASET"
-	tokenSecretKeyKey string = "MESSAGE_SERVICE_TOKEN_SECRET"
-	tokenPrivateKey   string = "MESSAGE_SERVICE_TOKEN_PRIV"
-	tokenPublicKey    string = "MESSAGE_SERVICE_TOKEN_PUB"
+	lifeCycleKey       string = "MESSAGE_SERVICE_ENVIRONMENT"
+	repoTypeKey        string = "MESSAGE_SERVICE_REPO_TYPE"
+	timeoutSecondsKey  string = "MESSAGE_SERVICE_TIMEOUT"
+	portKey            string = "MESSAGE_SERVICE_PORT"
+	pgUrlKey           string = "MESSAGE_SERVICE_PG_URL"
+	pgAutoMigrateKey   string = "MESSAGE_SERVICE_PG_AUTO_MIGRATE"
+	initDatasetKey     string = "MESSAGE_SERVICE_INIT_DATASET"
+	initDatasetModeKey string = "MESSAGE_SERVICE_INIT_DATASET_MODE"
+	tokenSecretKeyKey  string = "MESSAGE_SERVICE_TOKEN_SECRET"
+	tokenPrivateKey    string = "MESSAGE_SERVICE_TOKEN_PRIV"
+	tokenPublicKey     string = "MESSAGE_SERVICE_TOKEN_PUB"
+	cursorSecretKey    string = "MESSAGE_SERVICE_CURSOR_SECRET"
+	dataDirKey         string = "MESSAGE_SERVICE_DATA_DIR"
+	sqlitePathKey      string = "MESSAGE_SERVICE_SQLITE_PATH"
+	snapshotSecondsKey string = "MESSAGE_SERVICE_SNAPSHOT_INTERVAL"
+	editWindowKey      string = "MESSAGE_SERVICE_EDIT_WINDOW"
+	brokerTypeKey      string = "MESSAGE_SERVICE_BROKER"
+	mqttUrlKey         string = "MESSAGE_SERVICE_MQTT_URL"
+	tokenAlgorithmsKey string = "MESSAGE_SERVICE_TOKEN_ALGORITHMS"
+	tokenIssuerKey     string = "MESSAGE_SERVICE_TOKEN_ISSUER"
+	tokenAudienceKey   string = "MESSAGE_SERVICE_TOKEN_AUDIENCE"
+	tokenRequireExpKey string = "MESSAGE_SERVICE_TOKEN_REQUIRE_EXP"
+	tokenLeewayKey     string = "MESSAGE_SERVICE_TOKEN_LEEWAY"
+	tokenJwksKey       string = "MESSAGE_SERVICE_TOKEN_JWKS"
+	jwksRefreshKey     string = "MESSAGE_SERVICE_TOKEN_JWKS_REFRESH"
+	jwksGraceKey       string = "MESSAGE_SERVICE_TOKEN_JWKS_GRACE"
+	anonReadKey        string = "MESSAGE_SERVICE_ANONYMOUS_READ"
+	anonPrecisionKey   string = "MESSAGE_SERVICE_ANONYMOUS_PRECISION"
+	anonRadiusKey      string = "MESSAGE_SERVICE_ANONYMOUS_MAX_RADIUS"
+	anonMinRadiusKey   string = "MESSAGE_SERVICE_ANONYMOUS_MIN_RADIUS"
+	anonLimitKey       string = "MESSAGE_SERVICE_ANONYMOUS_MAX_LIMIT"
+	presPrecisionKey   string = "MESSAGE_SERVICE_PRESENCE_PRECISION"
+	presMinRadiusKey   string = "MESSAGE_SERVICE_PRESENCE_MIN_RADIUS"
+	presMaxRadiusKey   string = "MESSAGE_SERVICE_PRESENCE_MAX_RADIUS"
 )
 
 // LifeCycle represents a particular application life cycle.
@@ -56,6 +85,8 @@ const (
 	InMemoryRepo MessageRepositoryType = 0
 	// PostgreSqlRepo represents a UserRepository that utilizes a PostgreSQL database.
 	PostgreSqlRepo MessageRepositoryType = iota
+	// SqliteRepo represents a MessageRepository that utilizes an embedded SQLite database file.
+	SqliteRepo MessageRepositoryType = iota
 )
 
 func (prt MessageRepositoryType) String() string {
@@ -64,6 +95,51 @@ func (prt MessageRepositoryType) String() string {
 		return "POSTGRESQL"
 	case InMemoryRepo:
 		return "IN_MEMORY"
+	case SqliteRepo:
+		return "SQLITE"
+	default:
+		return ""
+	}
+}
+
+// BrokerType represents a type of Broker.
+type BrokerType int
+
+const (
+	// InProcessBroker represents a Broker that only reaches subscribers of the instance a message was stored on.
+	InProcessBroker BrokerType = 0
+	// PostgreSqlBroker represents a Broker that relays messages between instances with PostgreSQL LISTEN/NOTIFY.
+	PostgreSqlBroker BrokerType = iota
+)
+
+func (bt BrokerType) String() string {
+	switch bt {
+	case InProcessBroker:
+		return "IN_PROCESS"
+	case PostgreSqlBroker:
+		return "POSTGRESQL"
+	default:
+		return ""
+	}
+}
+
+// DatasetLoadMode represents how records in an initial dataset are handled when a message with the same id is already
+// stored.
+type DatasetLoadMode int
+
+const (
+	// SkipExistingMode leaves already stored messages untouched.
+	SkipExistingMode DatasetLoadMode = 0
+	// UpsertMode replaces already stored messages with the dataset's version.
+	UpsertMode DatasetLoadMode = iota
+)
+
+func (dlm DatasetLoadMode) String() string {
+	switch dlm {
+	case SkipExistingMode:
+		return "SKIP"
+	case UpsertMode:
+		return "UPSERT"
 	default:
 		return ""
 	}
@@ -83,29 +159,127 @@ type Configuration interface {
 	// GetInitDataSet retrieves the path to an initial dataset to load on app launch, mostly for testing and dev use.
 	GetInitDataSet() string
 
+	// GetInitDataSetMode retrieves how the initial dataset treats messages that are already stored.
+	GetInitDataSetMode() DatasetLoadMode
+
 	// GetPgUrl retrieves the configured url string for connecting to PostgreSQL.
 	GetPgUrl() string
 
+	// GetPgAutoMigrate retrieves whether pending PostgreSQL schema migrations are applied on startup.
+	GetPgAutoMigrate() bool
+
+	// GetSqlitePath retrieves the configured path of the SQLite database file.
+	GetSqlitePath() string
+
 	// GetTokenSecretKey a shared secret key for signing tokens
 	GetTokenSecretKey() string
 
-	// GetTokenPrivateKey retrieves the the private key used to sign tokens.
+	// GetTokenPrivateKey retrieves the the private key used to sign tokens, it is never used to validate them.
 	GetTokenPrivateKey() *rsa.PrivateKey
 
 	// GetTokenPublicKey retrieves public key used to validate JWT tokens.
 	GetTokenPublicKey() *rsa.PublicKey
+
+	// GetTokenKeySet retrieves the JWKS document RSA signed tokens are validated with, picking the key by the token's
+	// kid, nil when tokens are validated with GetTokenPublicKey instead.
+	GetTokenKeySet() *JwksKeySet
+
+	// GetTokenAlgorithms retrieves the signing algorithms tokens are accepted with.
+	GetTokenAlgorithms() []string
+
+	// GetTokenIssuer retrieves the iss claim tokens must carry, any issuer is accepted when empty.
+	GetTokenIssuer() string
+
+	// GetTokenAudience retrieves the audience the aud claim of tokens must include, any audience is accepted when
+	// empty.
+	GetTokenAudience() string
+
+	// GetTokenRequireExp retrieves whether tokens without an exp claim are rejected.
+	GetTokenRequireExp() bool
+
+	// GetTokenLeeway retrieves how much clock skew is tolerated when checking the exp and nbf claims of tokens.
+	GetTokenLeeway() time.Duration
+
+	// GetCursorSecret retrieves the key used to sign pagination cursors.
+	GetCursorSecret() []byte
+
+	// GetDataDir retrieves the directory an in memory repo persists its messages to, persistence is disabled when
+	// empty.
+	GetDataDir() string
+
+	// GetSnapshotInterval retrieves how often a persistent in memory repo compacts its write-ahead log into a
+	// snapshot.
+	GetSnapshotInterval() time.Duration
+
+	// GetEditWindow retrieves how long after sending a message its sender may edit it, zero allows edits at any time.
+	GetEditWindow() time.Duration
+
+	// GetBrokerType retrieves the configured broker type.
+	GetBrokerType() BrokerType
+
+	// GetMqttUrl retrieves the url of the MQTT broker messages are bridged to, the bridge is disabled when it is nil.
+	GetMqttUrl() *url.URL
+
+	// GetAnonymousRead retrieves whether messages may be read without a token.
+	GetAnonymousRead() bool
+
+	// GetAnonymousPrecision retrieves the number of decimal places the coordinates of messages read without a token
+	// are rounded to.
+	GetAnonymousPrecision() int
+
+	// GetAnonymousMaxRadius retrieves the largest radius, in meters, messages may be read within without a token.
+	GetAnonymousMaxRadius() float64
+
+	// GetAnonymousMinRadius retrieves the smallest radius, in meters, messages may be read within without a token.
+	GetAnonymousMinRadius() float64
+
+	// GetAnonymousMaxLimit retrieves the most messages a page read without a token may hold.
+	GetAnonymousMaxLimit() int
+
+	// GetPresencePrecision retrieves the number of decimal places the locations of heartbeats are rounded to before
+	// they are stored.
+	GetPresencePrecision() int
+
+	// GetPresenceMinRadius retrieves the smallest radius, in meters, active users may be counted within.
+	GetPresenceMinRadius() float64
+
+	// GetPresenceMaxRadius retrieves the largest radius, in meters, active users may be counted within.
+	GetPresenceMaxRadius() float64
 }
 
 type configuration struct {
-	lifeCycle   LifeCycle
-	repoType    MessageRepositoryType
-	timeout     time.Duration
-	port        int
-	pgUrl       string
-	initDataset string
-	secretKey   string
-	privateKey  *rsa.PrivateKey
-	publicKey   *rsa.PublicKey
+	lifeCycle        LifeCycle
+	repoType         MessageRepositoryType
+	timeout          time.Duration
+	port             int
+	pgUrl            string
+	sqlitePath       string
+	pgAutoMigrate    bool
+	initDataset      string
+	initDatasetMode  DatasetLoadMode
+	secretKey        string
+	privateKey       *rsa.PrivateKey
+	publicKey        *rsa.PublicKey
+	tokenKeySet      *JwksKeySet
+	tokenAlgorithms  []string
+	tokenIssuer      string
+	tokenAudience    string
+	tokenRequireExp  bool
+	tokenLeeway      time.Duration
+	cursorSecret     []byte
+	dataDir          string
+	snapshotInterval time.Duration
+	editWindow       time.Duration
+	brokerType       BrokerType
+	mqttUrl          *url.URL
+	anonymousRead    bool
+	anonPrecision    int
+	anonMaxRadius    float64
+	anonMinRadius    float64
+	anonMaxLimit     int
+	presPrecision    int
+	presMinRadius    float64
+	presMaxRadius    float64
 }
 
 func (conf *configuration) GetLifeCycle() LifeCycle {
@@ -128,10 +302,22 @@ func (conf *configuration) GetPgUrl() string {
 	return conf.pgUrl
 }
 
+func (conf *configuration) GetPgAutoMigrate() bool {
+	return conf.pgAutoMigrate
+}
+
+func (conf *configuration) GetSqlitePath() string {
+	return conf.sqlitePath
+}
+
 func (conf *configuration) GetInitDataSet() string {
 	return conf.initDataset
 }
 
+func (conf *configuration) GetInitDataSetMode() DatasetLoadMode {
+	return conf.initDatasetMode
+}
+
 // GetTokenSecretKey retrieves the shared secret key for reading/signing JWT tokens
 func (conf *configuration) GetTokenSecretKey() string {
 	return conf.secretKey
@@ -147,6 +333,105 @@ func (conf *configuration) GetTokenPublicKey() *rsa.PublicKey {
 	return conf.publicKey
 }
 
+// GetTokenKeySet retrieves the JWKS document RSA signed tokens are validated with.
+func (conf *configuration) GetTokenKeySet() *JwksKeySet {
+	return conf.tokenKeySet
+}
+
+// GetTokenAlgorithms retrieves the signing algorithms tokens are accepted with.
+func (conf *configuration) GetTokenAlgorithms() []string {
+	return conf.tokenAlgorithms
+}
+
+// GetTokenIssuer retrieves the iss claim tokens must carry.
+func (conf *configuration) GetTokenIssuer() string {
+	return conf.tokenIssuer
+}
+
+// GetTokenAudience retrieves the audience the aud claim of tokens must include.
+func (conf *configuration) GetTokenAudience() string {
+	return conf.tokenAudience
+}
+
+// GetTokenRequireExp retrieves whether tokens without an exp claim are rejected.
+func (conf *configuration) GetTokenRequireExp() bool {
+	return conf.tokenRequireExp
+}
+
+// GetTokenLeeway retrieves how much clock skew is tolerated when checking the exp and nbf claims of tokens.
+func (conf *configuration) GetTokenLeeway() time.Duration {
+	return conf.tokenLeeway
+}
+
+// GetCursorSecret retrieves the key used to sign pagination cursors.
+func (conf *configuration) GetCursorSecret() []byte {
+	return conf.cursorSecret
+}
+
+// GetDataDir retrieves the directory an in memory repo persists its messages to.
+func (conf *configuration) GetDataDir() string {
+	return conf.dataDir
+}
+
+// GetSnapshotInterval retrieves how often a persistent in memory repo writes a snapshot.
+func (conf *configuration) GetSnapshotInterval() time.Duration {
+	return conf.snapshotInterval
+}
+
+// GetEditWindow retrieves how long after sending a message its sender may edit it.
+func (conf *configuration) GetEditWindow() time.Duration {
+	return conf.editWindow
+}
+
+func (conf *configuration) GetBrokerType() BrokerType {
+	return conf.brokerType
+}
+
+// GetMqttUrl retrieves the url of the MQTT broker messages are bridged to.
+func (conf *configuration) GetMqttUrl() *url.URL {
+	return conf.mqttUrl
+}
+
+// GetAnonymousRead retrieves whether messages may be read without a token.
+func (conf *configuration) GetAnonymousRead() bool {
+	return conf.anonymousRead
+}
+
+// GetAnonymousPrecision retrieves the number of decimal places anonymously read coordinates are rounded to.
+func (conf *configuration) GetAnonymousPrecision() int {
+	return conf.anonPrecision
+}
+
+// GetAnonymousMaxRadius retrieves the largest radius messages may be read within without a token.
+func (conf *configuration) GetAnonymousMaxRadius() float64 {
+	return conf.anonMaxRadius
+}
+
+// GetAnonymousMinRadius retrieves the smallest radius messages may be read within without a token.
+func (conf *configuration) GetAnonymousMinRadius() float64 {
+	return conf.anonMinRadius
+}
+
+// GetAnonymousMaxLimit retrieves the most messages a page read without a token may hold.
+func (conf *configuration) GetAnonymousMaxLimit() int {
+	return conf.anonMaxLimit
+}
+
+// GetPresencePrecision retrieves the number of decimal places heartbeat locations are rounded to.
+func (conf *configuration) GetPresencePrecision() int {
+	return conf.presPrecision
+}
+
+// GetPresenceMinRadius retrieves the smallest radius active users may be counted within.
+func (conf *configuration) GetPresenceMinRadius() float64 {
+	return conf.presMinRadius
+}
+
+// GetPresenceMaxRadius retrieves the largest radius active users may be counted within.
+func (conf *configuration) GetPresenceMaxRadius() float64 {
+	return conf.presMaxRadius
+}
+
 // GetConfiguration constructs a Configuration based on environment variables.
 func GetConfiguration() (Configuration, error) {
 	var err error
@@ -176,6 +461,8 @@ func GetConfiguration() (Configuration, error) {
 		config.repoType = InMemoryRepo
 	case PostgreSqlRepo.String():
 		config.repoType = PostgreSqlRepo
+	case SqliteRepo.String():
+		config.repoType = SqliteRepo
 	default:
 		if config.lifeCycle == DevLifeCycle {
 			config.repoType = InMemoryRepo
@@ -219,6 +506,10 @@ func GetConfiguration() (Configuration, error) {
 
 	if config.repoType == PostgreSqlRepo {
 		err = setPostgresqlConfig(&config)
+	} else if config.repoType == InMemoryRepo {
+		err = setInMemoryConfig(&config)
+	} else if config.repoType == SqliteRepo {
+		err = setSqliteConfig(&config)
 	}
 
 	if err != nil {
@@ -231,42 +522,420 @@ func GetConfiguration() (Configuration, error) {
 		return nil, err
 	}
 
+	datasetModeStr := os.Getenv(initDatasetModeKey)
+
+	switch datasetModeStr {
+	case "", SkipExistingMode.String():
+		config.initDatasetMode = SkipExistingMode
+	case UpsertMode.String():
+		config.initDatasetMode = UpsertMode
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid dataset mode %s, set %s environment variable to %s or %s",
+			datasetModeStr, initDatasetModeKey, SkipExistingMode, UpsertMode))
+	}
+
+	err = setTokenConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setCursorConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	editWindowStr := os.Getenv(editWindowKey)
+
+	if editWindowStr == "" {
+		editWindowStr = "900"
+	}
+
+	editWindowInt, err := strconv.Atoi(editWindowStr)
+
+	if err != nil || editWindowInt < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid edit window, set %s environment variable to a number of "+
+			"seconds", editWindowKey))
+	}
+
+	config.editWindow = time.Duration(editWindowInt) * time.Second
+
+	err = setBrokerConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setMqttConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setAnonymousConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setPresenceConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func setMqttConfig(config *configuration) error {
+	mqttUrlStr := strings.TrimSpace(os.Getenv(mqttUrlKey))
+
+	if mqttUrlStr == "" {
+		return nil
+	}
+
+	mqttUrl, err := url.Parse(mqttUrlStr)
+
+	if err != nil || mqttUrl.Host == "" {
+		return errors.New(fmt.Sprintf("Invalid MQTT url, set %s environment variable to a url such as "+
+			"tcp://host:1883", mqttUrlKey))
+	}
+
+	switch mqttUrl.Scheme {
+	case "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss":
+	default:
+		return errors.New(fmt.Sprintf("Unsupported MQTT url scheme %s, set %s environment variable to a tcp, "+
+			"ssl, ws or wss url", mqttUrl.Scheme, mqttUrlKey))
+	}
+
+	config.mqttUrl = mqttUrl
+
+	return nil
+}
+
+// setTokenConfig loads the keys tokens are validated with and the rules their claims must follow. Tokens signed with a
+// shared secret use HMAC, tokens signed with a private key are validated with the matching public key alone, either
+// given directly or found in a JWKS document.
+func setTokenConfig(config *configuration) error {
 	secretKey := os.Getenv(tokenSecretKeyKey)
 	privateKeyPath := os.Getenv(tokenPrivateKey)
 	publicKeyPath := os.Getenv(tokenPublicKey)
+	jwksSource := strings.TrimSpace(os.Getenv(tokenJwksKey))
 
-	if secretKey == "" && (privateKeyPath == "" || publicKeyPath == "") {
-		if config.lifeCycle == DevLifeCycle {
-			config.secretKey = "secret"
-		} else {
-			return nil, errors.New(fmt.Sprintf("must set either %s environment variable or both %s AND %s "+
-				"environment variables", tokenSecretKeyKey, tokenPublicKey, tokenPrivateKey))
+	if secretKey == "" && publicKeyPath == "" && jwksSource == "" {
+		if config.lifeCycle != DevLifeCycle {
+			return errors.New(fmt.Sprintf("must set either %s, %s or %s environment variable", tokenSecretKeyKey,
+				tokenPublicKey, tokenJwksKey))
 		}
-	} else if secretKey != "" {
-		config.secretKey = secretKey
-	} else {
+
+		secretKey = "secret"
+	}
+
+	config.secretKey = secretKey
+
+	if publicKeyPath != "" {
+		verifyBytes, err := os.ReadFile(publicKeyPath)
+
+		if err != nil {
+			return err
+		}
+
+		config.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if jwksSource != "" {
+		err := setJwksConfig(config, jwksSource)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The private key is only needed to sign tokens, such as by tools sharing this configuration.
+	if privateKeyPath != "" {
 		signBytes, err := os.ReadFile(privateKeyPath)
+
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(signBytes)
+		config.privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(signBytes)
+
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	algorithmsStr := strings.TrimSpace(os.Getenv(tokenAlgorithmsKey))
+
+	if algorithmsStr == "" {
+		if config.secretKey != "" {
+			config.tokenAlgorithms = append(config.tokenAlgorithms, jwt.SigningMethodHS256.Alg())
+		}
+
+		if config.publicKey != nil || config.tokenKeySet != nil {
+			config.tokenAlgorithms = append(config.tokenAlgorithms, jwt.SigningMethodRS256.Alg())
+		}
+	} else {
+		for _, algorithm := range strings.Split(algorithmsStr, ",") {
+			algorithm = strings.TrimSpace(algorithm)
+
+			switch jwt.GetSigningMethod(algorithm).(type) {
+			case *jwt.SigningMethodHMAC:
+				if config.secretKey == "" {
+					return errors.New(fmt.Sprintf("Token algorithm %s needs a shared secret, set %s environment "+
+						"variable", algorithm, tokenSecretKeyKey))
+				}
+			case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+				if config.publicKey == nil && config.tokenKeySet == nil {
+					return errors.New(fmt.Sprintf("Token algorithm %s needs a public key, set %s or %s "+
+						"environment variable", algorithm, tokenPublicKey, tokenJwksKey))
+				}
+			default:
+				return errors.New(fmt.Sprintf("Invalid token algorithm %s, set %s environment variable to a comma "+
+					"separated list of HS256, HS384, HS512, RS256, RS384, RS512, PS256, PS384 or PS512", algorithm,
+					tokenAlgorithmsKey))
+			}
+
+			config.tokenAlgorithms = append(config.tokenAlgorithms, algorithm)
+		}
+	}
+
+	config.tokenIssuer = strings.TrimSpace(os.Getenv(tokenIssuerKey))
+	config.tokenAudience = strings.TrimSpace(os.Getenv(tokenAudienceKey))
+
+	requireExpStr := os.Getenv(tokenRequireExpKey)
+
+	if requireExpStr != "" {
+		var err error
+		config.tokenRequireExp, err = strconv.ParseBool(requireExpStr)
 
-		verifyBytes, err := os.ReadFile(publicKeyPath)
 		if err != nil {
-			return nil, err
+			return errors.New(fmt.Sprintf("Invalid token exp requirement, set %s environment variable to true or "+
+				"false", tokenRequireExpKey))
 		}
+	}
 
-		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+	leewayStr := os.Getenv(tokenLeewayKey)
 
-		config.privateKey = privateKey
-		config.publicKey = publicKey
+	if leewayStr == "" {
+		leewayStr = "60"
 	}
 
-	return &config, nil
+	leewayInt, err := strconv.Atoi(leewayStr)
+
+	if err != nil || leewayInt < 0 {
+		return errors.New(fmt.Sprintf("Invalid token leeway, set %s environment variable to a number of seconds",
+			tokenLeewayKey))
+	}
+
+	config.tokenLeeway = time.Duration(leewayInt) * time.Second
+
+	return nil
+}
+
+// setJwksConfig loads the JWKS document at source, a file path or url, failing if it cannot be read.
+func setJwksConfig(config *configuration, source string) error {
+	refresh, err := parseSeconds(jwksRefreshKey, "300")
+
+	if err != nil {
+		return err
+	}
+
+	grace, err := parseSeconds(jwksGraceKey, "3600")
+
+	if err != nil {
+		return err
+	}
+
+	config.tokenKeySet, err = NewJwksKeySet(source, nil, refresh, grace)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to load %s: %s", tokenJwksKey, err))
+	}
+
+	return nil
+}
+
+func setAnonymousConfig(config *configuration) error {
+	anonymousReadStr := os.Getenv(anonReadKey)
+
+	if anonymousReadStr != "" {
+		var err error
+		config.anonymousRead, err = strconv.ParseBool(anonymousReadStr)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid anonymous read mode, set %s environment variable to true or "+
+				"false", anonReadKey))
+		}
+	}
+
+	precisionStr := os.Getenv(anonPrecisionKey)
+
+	if precisionStr == "" {
+		precisionStr = "2"
+	}
+
+	precision, err := strconv.Atoi(precisionStr)
+
+	// Beyond 6 decimal places coordinates are no coarser than they were sent.
+	if err != nil || precision < 0 || precision > 6 {
+		return errors.New(fmt.Sprintf("Invalid anonymous precision, set %s environment variable to a number of "+
+			"decimal places from 0 to 6", anonPrecisionKey))
+	}
+
+	config.anonPrecision = precision
+
+	radiusStr := os.Getenv(anonRadiusKey)
+
+	if radiusStr == "" {
+		radiusStr = "1000"
+	}
+
+	radius, err := strconv.ParseFloat(radiusStr, 64)
+
+	if err != nil || !(radius > 0) {
+		return errors.New(fmt.Sprintf("Invalid anonymous radius, set %s environment variable to a number of "+
+			"meters", anonRadiusKey))
+	}
+
+	config.anonMaxRadius = radius
+
+	minRadiusStr := os.Getenv(anonMinRadiusKey)
+	minRadius := 500.0
+
+	if minRadiusStr != "" {
+		minRadius, err = strconv.ParseFloat(minRadiusStr, 64)
+	} else if minRadius > radius {
+		minRadius = radius
+	}
+
+	// Small areas around a known point would give away where messages were sent however coarse their coordinates.
+	if err != nil || !(minRadius >= 0) || minRadius > radius {
+		return errors.New(fmt.Sprintf("Invalid anonymous minimum radius, set %s environment variable to a number "+
+			"of meters no greater than %s", anonMinRadiusKey, anonRadiusKey))
+	}
+
+	config.anonMinRadius = minRadius
+
+	limitStr := os.Getenv(anonLimitKey)
+
+	if limitStr == "" {
+		limitStr = "20"
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+
+	if err != nil || limit <= 0 {
+		return errors.New(fmt.Sprintf("Invalid anonymous limit, set %s environment variable to a number of "+
+			"messages", anonLimitKey))
+	}
+
+	config.anonMaxLimit = limit
+
+	return nil
+}
+
+// parseSeconds reads a non-negative number of seconds from the environment variable key, or from defaultValue when
+// it is unset.
+func parseSeconds(key string, defaultValue string) (time.Duration, error) {
+	secondsStr := os.Getenv(key)
+
+	if secondsStr == "" {
+		secondsStr = defaultValue
+	}
+
+	seconds, err := strconv.Atoi(secondsStr)
+
+	if err != nil || seconds < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid duration, set %s environment variable to a number of seconds",
+			key))
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func setBrokerConfig(config *configuration) error {
+	brokerTypeStr := os.Getenv(brokerTypeKey)
+
+	switch brokerTypeStr {
+	case "", InProcessBroker.String():
+		config.brokerType = InProcessBroker
+	case PostgreSqlBroker.String():
+		config.brokerType = PostgreSqlBroker
+	default:
+		return errors.New(fmt.Sprintf("Invalid broker type %s, set %s environment variable to %s or %s",
+			brokerTypeStr, brokerTypeKey, InProcessBroker, PostgreSqlBroker))
+	}
+
+	// Instances look up the messages others announce in the repository, which only finds them in a shared database.
+	if config.brokerType == PostgreSqlBroker && config.repoType != PostgreSqlRepo {
+		return errors.New(fmt.Sprintf("The %s broker requires the %s repo, set %s environment variable to %s",
+			PostgreSqlBroker, PostgreSqlRepo, repoTypeKey, PostgreSqlRepo))
+	}
+
+	return nil
+}
+
+func setSqliteConfig(config *configuration) error {
+	config.sqlitePath = strings.TrimSpace(os.Getenv(sqlitePathKey))
+
+	if config.sqlitePath == "" && config.lifeCycle == DevLifeCycle {
+		config.sqlitePath = "message.db"
+	} else if config.sqlitePath == "" {
+		return errors.New(fmt.Sprintf("No SqliteRepo path configured, set %s environment variable", sqlitePathKey))
+	}
+
+	return nil
+}
+
+func setInMemoryConfig(config *configuration) error {
+	config.dataDir = strings.TrimSpace(os.Getenv(dataDirKey))
+
+	snapshotStr := os.Getenv(snapshotSecondsKey)
+
+	if snapshotStr == "" {
+		snapshotStr = "300"
+	}
+
+	snapshotInt, err := strconv.Atoi(snapshotStr)
+
+	if err != nil || snapshotInt <= 0 {
+		return errors.New(fmt.Sprintf("Invalid snapshot interval, set %s environment variable to a number of "+
+			"seconds", snapshotSecondsKey))
+	}
+
+	config.snapshotInterval = time.Duration(snapshotInt) * time.Second
+
+	return nil
+}
+
+func setCursorConfig(config *configuration) error {
+	cursorSecret := os.Getenv(cursorSecretKey)
+
+	if cursorSecret != "" {
+		config.cursorSecret = []byte(cursorSecret)
+		return nil
+	}
+
+	if config.lifeCycle != DevLifeCycle {
+		return errors.New(fmt.Sprintf("No cursor secret configured, set %s environment variable", cursorSecretKey))
+	}
+
+	// A key is never used for two purposes, so in DEV the cursor secret is derived from the token secret under its
+	// own label. The token secret may be empty when tokens are RSA signed, the derived secret is stable regardless.
+	log.Printf("%s is not set, deriving the cursor secret from %s, which is only acceptable in %s", cursorSecretKey,
+		tokenSecretKeyKey, DevLifeCycle)
+	mac := hmac.New(sha256.New, []byte(config.secretKey))
+	mac.Write([]byte("message cursor secret"))
+	config.cursorSecret = mac.Sum(nil)
+
+	return nil
 }
 
 func setPostgresqlConfig(config *configuration) error {
@@ -278,5 +947,72 @@ func setPostgresqlConfig(config *configuration) error {
 		err = errors.New(fmt.Sprintf("No PostgreSqlRepo url configured, set %s environment variable", pgUrlKey))
 	}
 
+	if err != nil {
+		return err
+	}
+
+	autoMigrateStr := os.Getenv(pgAutoMigrateKey)
+	config.pgAutoMigrate = true
+
+	if autoMigrateStr != "" {
+		config.pgAutoMigrate, err = strconv.ParseBool(autoMigrateStr)
+
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Invalid %s environment variable, expected true or false",
+				pgAutoMigrateKey))
+		}
+	}
+
 	return err
 }
+
+func setPresenceConfig(config *configuration) error {
+	precisionStr := os.Getenv(presPrecisionKey)
+
+	if precisionStr == "" {
+		precisionStr = "3"
+	}
+
+	precision, err := strconv.Atoi(precisionStr)
+
+	if err != nil || precision < 0 || precision > 6 {
+		return errors.New(fmt.Sprintf("Invalid presence precision, set %s environment variable to a number of "+
+			"decimal places from 0 to 6", presPrecisionKey))
+	}
+
+	config.presPrecision = precision
+
+	maxRadiusStr := os.Getenv(presMaxRadiusKey)
+
+	if maxRadiusStr == "" {
+		maxRadiusStr = "5000"
+	}
+
+	maxRadius, err := strconv.ParseFloat(maxRadiusStr, 64)
+
+	if err != nil || !(maxRadius > 0) {
+		return errors.New(fmt.Sprintf("Invalid presence radius, set %s environment variable to a number of "+
+			"meters", presMaxRadiusKey))
+	}
+
+	config.presMaxRadius = maxRadius
+
+	minRadiusStr := os.Getenv(presMinRadiusKey)
+	minRadius := 250.0
+
+	if minRadiusStr != "" {
+		minRadius, err = strconv.ParseFloat(minRadiusStr, 64)
+	} else if minRadius > maxRadius {
+		minRadius = maxRadius
+	}
+
+	// Counting the users in a small area around a known point would tell whether a particular user is there.
+	if err != nil || !(minRadius >= 0) || minRadius > maxRadius {
+		return errors.New(fmt.Sprintf("Invalid presence minimum radius, set %s environment variable to a number "+
+			"of meters no greater than %s", presMinRadiusKey, presMaxRadiusKey))
+	}
+
+	config.presMinRadius = minRadius
+
+	return nil
+}
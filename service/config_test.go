@@ -143,3 +143,32 @@ func TestGetConfiguration_ImFailRsaJustPublicKey(t *testing.T) {
 	_, err := service.GetConfiguration()
 	notOk(t, err)
 }
+
+// TestGetConfiguration_FailBrokerType ensures that an error is returned when an unknown broker type is configured.
+func TestGetConfiguration_FailBrokerType(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_BROKER", "CARRIER_PIGEON")
+	_, err := service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_FailPgBrokerRepo ensures that an error is returned when the PostgreSQL broker is configured
+// with a repository other instances do not share.
+func TestGetConfiguration_FailPgBrokerRepo(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_BROKER", "POSTGRESQL")
+	t.Setenv("MESSAGE_SERVICE_PG_URL", "postgres://localhost/message")
+
+	for _, repoType := range []string{"IN_MEMORY", "SQLITE"} {
+		t.Setenv("MESSAGE_SERVICE_REPO_TYPE", repoType)
+		_, err := service.GetConfiguration()
+		notOk(t, err)
+	}
+}
+
+// TestGetConfiguration_FailPresenceRadius ensures that an error is returned when the smallest presence radius is
+// greater than the largest.
+func TestGetConfiguration_FailPresenceRadius(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_PRESENCE_MIN_RADIUS", "2000")
+	t.Setenv("MESSAGE_SERVICE_PRESENCE_MAX_RADIUS", "1000")
+	_, err := service.GetConfiguration()
+	notOk(t, err)
+}
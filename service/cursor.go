@@ -0,0 +1,130 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// PageDirection represents which way through the message ordering a page extends from its cursor.
+type PageDirection int
+
+const (
+	// OlderPage represents a page of messages created before the cursor.
+	OlderPage PageDirection = 0
+	// NewerPage represents a page of messages created after the cursor.
+	NewerPage PageDirection = iota
+)
+
+// maxCursorId sorts after every message id, both in Go and in the byte-wise collations the SQL repositories order
+// ids by, so a cursor carrying it is positioned after every message created at its instant.
+const maxCursorId = "\U0010FFFF"
+
+// MessageCursor identifies a position in the (createdAt, id) ordering that every MessageRepository shares.
+type MessageCursor struct {
+	CreatedAt time.Time
+	Id        string
+}
+
+// Before reports whether the cursor sorts before the given message.
+func (mc MessageCursor) Before(msg StoredMessage) bool {
+	return mc.CreatedAt.Before(msg.CreatedAt) || (mc.CreatedAt.Equal(msg.CreatedAt) && mc.Id < msg.Id)
+}
+
+// After reports whether the cursor sorts after the given message.
+func (mc MessageCursor) After(msg StoredMessage) bool {
+	return mc.CreatedAt.After(msg.CreatedAt) || (mc.CreatedAt.Equal(msg.CreatedAt) && mc.Id > msg.Id)
+}
+
+// Less reports whether the cursor sorts before another.
+func (mc MessageCursor) Less(other MessageCursor) bool {
+	return mc.CreatedAt.Before(other.CreatedAt) || (mc.CreatedAt.Equal(other.CreatedAt) && mc.Id < other.Id)
+}
+
+// Covers reports whether the given message sorts at or before the cursor.
+func (mc MessageCursor) Covers(msg StoredMessage) bool {
+	return !mc.Before(msg)
+}
+
+// CursorFor constructs the cursor positioned at the given message.
+func CursorFor(msg StoredMessage) MessageCursor {
+	return MessageCursor{CreatedAt: msg.CreatedAt, Id: msg.Id}
+}
+
+// MessagePage selects a page of messages relative to a cursor. A nil Cursor selects the newest messages.
+type MessagePage struct {
+	Cursor    *MessageCursor
+	Direction PageDirection
+}
+
+type cursorPayload struct {
+	CreatedAt int64         `json:"t"`
+	Id        string        `json:"i"`
+	Direction PageDirection `json:"d"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor produces an opaque token for the given page, signed with secret so that clients cannot forge
+// positions.
+func EncodeCursor(secret []byte, page MessagePage) string {
+	payload := cursorPayload{Direction: page.Direction}
+
+	if page.Cursor != nil {
+		payload.CreatedAt = page.Cursor.CreatedAt.UnixNano()
+		payload.Id = page.Cursor.Id
+	}
+
+	// Marshalling a struct of plain fields cannot fail.
+	payloadBytes, _ := json.Marshal(payload)
+	encoded := base64.RawURLEncoding.EncodeToString(payloadBytes)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signCursor(secret, encoded))
+}
+
+// DecodeCursor verifies and decodes a token produced by EncodeCursor.
+func DecodeCursor(secret []byte, token string) (MessagePage, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 {
+		return MessagePage{}, errInvalidCursor
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil || !hmac.Equal(signature, signCursor(secret, parts[0])) {
+		return MessagePage{}, errInvalidCursor
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return MessagePage{}, errInvalidCursor
+	}
+
+	var payload cursorPayload
+	err = json.Unmarshal(payloadBytes, &payload)
+
+	if err != nil || (payload.Direction != OlderPage && payload.Direction != NewerPage) {
+		return MessagePage{}, errInvalidCursor
+	}
+
+	return MessagePage{
+		Cursor: &MessageCursor{
+			CreatedAt: time.Unix(0, payload.CreatedAt).UTC(),
+			Id:        payload.Id,
+		},
+		Direction: payload.Direction,
+	}, nil
+}
+
+func signCursor(secret []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,61 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/message/service"
+	"testing"
+	"time"
+)
+
+// TestCursor_RoundTrip ensures that an encoded cursor decodes to the page it was built from.
+func TestCursor_RoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	page := service.MessagePage{
+		Cursor:    &service.MessageCursor{CreatedAt: time.Unix(1700000000, 123456789).UTC(), Id: "abc"},
+		Direction: service.NewerPage,
+	}
+
+	decoded, err := service.DecodeCursor(secret, service.EncodeCursor(secret, page))
+	ok(t, err)
+	equals(t, page, decoded)
+}
+
+// TestCursor_FailWrongSecret ensures that a cursor signed with another key is rejected.
+func TestCursor_FailWrongSecret(t *testing.T) {
+	page := service.MessagePage{Cursor: &service.MessageCursor{CreatedAt: time.Now().UTC(), Id: "abc"}}
+
+	_, err := service.DecodeCursor([]byte("secret"), service.EncodeCursor([]byte("other"), page))
+	notOk(t, err)
+}
+
+// TestCursor_FailMalformed ensures that garbage is rejected.
+func TestCursor_FailMalformed(t *testing.T) {
+	_, err := service.DecodeCursor([]byte("secret"), "not-a-cursor")
+	notOk(t, err)
+}
+
+// TestCursor_Secret ensures that a cursor secret must be configured outside DEV, and that in DEV the one derived in
+// its place is stable and differs from the token secret.
+func TestCursor_Secret(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_TOKEN_SECRET", "secret")
+	t.Setenv("MESSAGE_SERVICE_CURSOR_SECRET", "")
+
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	again, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, config.GetCursorSecret(), again.GetCursorSecret())
+	equals(t, false, string(config.GetCursorSecret()) == "secret")
+
+	t.Setenv("MESSAGE_SERVICE_ENVIRONMENT", "PROD")
+	t.Setenv("MESSAGE_SERVICE_REPO_TYPE", "IN_MEMORY")
+	t.Setenv("MESSAGE_SERVICE_TIMEOUT", "30")
+	t.Setenv("MESSAGE_SERVICE_PORT", "3333")
+
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	t.Setenv("MESSAGE_SERVICE_CURSOR_SECRET", "cursor")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, []byte("cursor"), config.GetCursorSecret())
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// maxDatasetLineBytes is the longest NDJSON record a dataset may contain.
+const maxDatasetLineBytes = 1024 * 1024
+
+// DatasetReport summarizes the outcome of loading a dataset.
+type DatasetReport struct {
+	// Loaded is the number of records written to the repository.
+	Loaded int
+	// Skipped is the number of records whose id, or sender and client id, was already stored.
+	Skipped int
+	// Failed is the number of records that were invalid or could not be written.
+	Failed int
+	// Errors holds the reason each failed record was rejected.
+	Errors []error
+}
+
+func (dr *DatasetReport) fail(record int, err error) {
+	dr.Failed++
+	dr.Errors = append(dr.Errors, fmt.Errorf("record %d: %w", record, err))
+}
+
+// LoadDatasetFile loads the dataset at path into repo, see LoadDataset.
+func LoadDatasetFile(ctx context.Context, repo MessageRepository, path string,
+	mode DatasetLoadMode) (DatasetReport, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return DatasetReport{}, err
+	}
+	defer file.Close()
+
+	return LoadDataset(ctx, repo, file, mode)
+}
+
+// LoadDataset reads either a JSON array or newline delimited JSON of messages from reader and stores them in repo.
+// Records with an id are imported as StoredMessages, keeping their id and creation time, and are skipped or replaced
+// according to mode when that id is already stored. Records without an id are added as new Messages. Invalid records
+// are counted in the report rather than aborting the load, an error is only returned if the input itself cannot be
+// read.
+func LoadDataset(ctx context.Context, repo MessageRepository, reader io.Reader,
+	mode DatasetLoadMode) (DatasetReport, error) {
+	var report DatasetReport
+	buffered := bufio.NewReader(reader)
+
+	first, err := peekNonSpace(buffered)
+
+	if err == io.EOF {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	if first == '[' {
+		decoder := json.NewDecoder(buffered)
+
+		// Consume the opening bracket.
+		_, err = decoder.Token()
+
+		if err != nil {
+			return report, err
+		}
+
+		for record := 1; decoder.More(); record++ {
+			// Decoding each element in two steps lets a record of the wrong shape be counted as failed, only
+			// malformed JSON stops the decoder from moving on to the next element.
+			var raw json.RawMessage
+			err = decoder.Decode(&raw)
+
+			if err != nil {
+				return report, err
+			}
+
+			var msg StoredMessage
+			err = json.Unmarshal(raw, &msg)
+
+			if err == nil {
+				err = loadRecord(ctx, repo, msg, mode, &report)
+			}
+
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			} else if err != nil {
+				report.fail(record, err)
+			}
+		}
+
+		return report, nil
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxDatasetLineBytes)
+
+	for record := 1; scanner.Scan(); record++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			record--
+			continue
+		}
+
+		var msg StoredMessage
+		err = json.Unmarshal(line, &msg)
+
+		if err == nil {
+			err = loadRecord(ctx, repo, msg, mode, &report)
+		}
+
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		} else if err != nil {
+			report.fail(record, err)
+		}
+	}
+
+	return report, scanner.Err()
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, reader.UnreadByte()
+		}
+	}
+}
+
+func loadRecord(ctx context.Context, repo MessageRepository, msg StoredMessage, mode DatasetLoadMode,
+	report *DatasetReport) error {
+	err := ValidateMessage(msg.Message)
+
+	if err != nil {
+		return err
+	}
+
+	if msg.Id == "" {
+		_, added, err := repo.AddMessage(ctx, msg.Message)
+
+		if err == nil && added {
+			report.Loaded++
+		} else if err == nil {
+			report.Skipped++
+		}
+
+		return err
+	}
+
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = msg.CreatedAt
+	}
+
+	written, err := repo.ImportMessage(ctx, msg, mode == UpsertMode)
+
+	if err != nil {
+		return err
+	}
+
+	if written {
+		report.Loaded++
+	} else {
+		report.Skipped++
+	}
+
+	return nil
+}
+
+// ValidateMessage reports why a message cannot be stored, if it cannot.
+func ValidateMessage(msg Message) error {
+	if msg.Sender.Id == "" {
+		return errors.New("missing sender id")
+	}
+
+	if msg.Content == "" {
+		return errors.New("missing content")
+	}
+
+	return ValidateLocation(msg.Location)
+}
+
+// ValidateLocation reports why a location is not a valid coordinate, if it is not.
+func ValidateLocation(location Location) error {
+	if location.Lat < -90 || location.Lat > 90 {
+		return errors.New("latitude out of range")
+	}
+
+	if location.Long < -180 || location.Long > 180 {
+		return errors.New("longitude out of range")
+	}
+
+	return nil
+}
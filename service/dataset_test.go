@@ -0,0 +1,93 @@
+package service_test
+
+import (
+	"context"
+	"github.com/stone1549/yapyapyap/message/service"
+	"strings"
+	"testing"
+)
+
+// TestLoadDatasetFile_SmallSet ensures that every record in the sample dataset is loaded.
+func TestLoadDatasetFile_SmallSet(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	report, err := service.LoadDatasetFile(context.Background(), repo, "../data/small_set.json",
+		service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 4, report.Loaded)
+	equals(t, 0, report.Failed)
+
+	msg, err := repo.GetMessage(context.Background(), "6f1b0c52-3f0e-4b8e-9a43-1c3e5d7f9a01")
+	ok(t, err)
+	equals(t, "alice", msg.Username)
+}
+
+// TestLoadDataset_NdjsonInvalidRecords ensures that invalid NDJSON records are counted without aborting the load.
+func TestLoadDataset_NdjsonInvalidRecords(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	dataset := `{"sender": {"id": "1", "username": "alice"}, "content": "hi", "location": {"lat": 40, "long": -105}}
+
+{"sender": {"id": "1", "username": "alice"}, "content": "", "location": {"lat": 40, "long": -105}}
+not json
+{"id": "x", "sender": {"id": "2", "username": "bob"}, "content": "hey", "location": {"lat": 91, "long": -105}}
+{"id": "y", "sender": {"id": "2", "username": "bob"}, "content": "hey", "location": {"lat": 40, "long": -105}}
+`
+
+	report, err := service.LoadDataset(context.Background(), repo, strings.NewReader(dataset),
+		service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 2, report.Loaded)
+	equals(t, 3, report.Failed)
+	equals(t, 3, len(report.Errors))
+}
+
+// TestLoadDataset_ArrayInvalidRecords ensures that array elements of the wrong shape are counted without aborting
+// the load, just as invalid NDJSON records are.
+func TestLoadDataset_ArrayInvalidRecords(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	dataset := `[
+{"sender": {"id": "1", "username": "alice"}, "content": 5, "location": {"lat": 40, "long": -105}},
+{"sender": {"id": "1", "username": "alice"}, "content": "hi", "location": {"lat": 40, "long": -105}}
+]`
+
+	report, err := service.LoadDataset(context.Background(), repo, strings.NewReader(dataset),
+		service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 1, report.Loaded)
+	equals(t, 1, report.Failed)
+}
+
+// TestLoadDataset_SkipOrUpsert ensures that already stored ids are skipped or replaced according to the mode.
+func TestLoadDataset_SkipOrUpsert(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	ctx := context.Background()
+	record := `[{"id": "x", "sender": {"id": "1", "username": "alice"}, "content": "%s", ` +
+		`"location": {"lat": 40, "long": -105}, "createdAt": "2023-05-01T12:00:00Z"}]`
+
+	_, err := service.LoadDataset(ctx, repo, strings.NewReader(strings.Replace(record, "%s", "first", 1)),
+		service.SkipExistingMode)
+	ok(t, err)
+
+	report, err := service.LoadDataset(ctx, repo, strings.NewReader(strings.Replace(record, "%s", "second", 1)),
+		service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 1, report.Skipped)
+
+	msg, err := repo.GetMessage(ctx, "x")
+	ok(t, err)
+	equals(t, "first", msg.Content)
+
+	report, err = service.LoadDataset(ctx, repo, strings.NewReader(strings.Replace(record, "%s", "second", 1)),
+		service.UpsertMode)
+	ok(t, err)
+	equals(t, 1, report.Loaded)
+
+	msg, err = repo.GetMessage(ctx, "x")
+	ok(t, err)
+	equals(t, "second", msg.Content)
+
+	messages, err := repo.GetMessagesForLocation(ctx, service.Location{Lat: 40, Long: -105}, 100, 10,
+		service.MessagePage{})
+	ok(t, err)
+	equals(t, 1, len(messages))
+}
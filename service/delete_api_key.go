@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+)
+
+func DeleteApiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys, ok := request.Context().Value("apiKeyRepo").(ApiKeyRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("api keys not configured"))
+			return
+		}
+
+		id := chi.URLParam(request, "id")
+
+		if id == "" {
+			RenderResponse(writer, request, NewBadRequestErr("invalid id parameter"))
+			return
+		}
+
+		err := keys.DeleteApiKey(request.Context(), id)
+
+		if errors.Is(err, ErrApiKeyNotFound) {
+			RenderResponse(writer, request, NewNotFoundErr("no api key found with that id"))
+			return
+		} else if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// DeleteApiKey responds once a key has been revoked, requests bearing it are rejected from then on.
+func DeleteApiKey(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+)
+
+func DeleteMessageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		id := chi.URLParam(request, "id")
+
+		if id == "" {
+			RenderResponse(writer, request, NewBadRequestErr("invalid id parameter"))
+			return
+		}
+
+		msg, err := repo.GetMessage(request.Context(), id)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		if msg.Id == "" {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		}
+
+		sender := request.Context().Value("sender").(Sender)
+		grants, _ := request.Context().Value("grants").(Grants)
+
+		if msg.Sender.Id != sender.Id && !grants.Allows(ScopeMessagesModerate) {
+			RenderResponse(writer, request, NewForbiddenErr("only the sender or a moderator may delete a message"))
+			return
+		}
+
+		tombstone, err := repo.DeleteMessage(request.Context(), id)
+
+		if errors.Is(err, ErrMessageNotFound) {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		} else if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "message", &tombstone)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func DeleteMessage(writer http.ResponseWriter, request *http.Request) {
+	msg, ok := request.Context().Value("message").(*StoredMessage)
+
+	if !ok {
+		RenderResponse(writer, request, NewNotFoundErr("unable to delete message"))
+		return
+	}
+
+	RenderResponse(writer, request, msg)
+}
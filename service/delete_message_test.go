@@ -0,0 +1,63 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withValues wraps a handler so that requests carry the given context values, standing in for the middleware that
+// main installs.
+func withValues(handler http.Handler, values map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		for key, value := range values {
+			ctx = context.WithValue(ctx, key, value)
+		}
+
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func deleteMessage(repo service.MessageRepository, sender service.Sender, grants service.Grants,
+	id string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.With(service.DeleteMessageMiddleware).Delete("/messages/{id}", service.DeleteMessage)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"repo": repo, "sender": sender, "grants": grants}).ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodDelete, "/messages/"+id, nil))
+
+	return recorder
+}
+
+// TestDeleteMessage_Authorization ensures that only the sender or a moderator may delete a message.
+func TestDeleteMessage_Authorization(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	alice := service.Sender{Id: "1", Username: "alice"}
+	bob := service.Sender{Id: "2", Username: "bob"}
+
+	stored, _, err := repo.AddMessage(context.Background(), service.Message{Sender: alice, Content: "hello"})
+	ok(t, err)
+
+	equals(t, http.StatusForbidden, deleteMessage(repo, bob, service.Grants{}, stored.Id).Code)
+	equals(t, http.StatusNotFound, deleteMessage(repo, alice, service.Grants{}, "missing").Code)
+
+	recorder := deleteMessage(repo, alice, service.Grants{}, stored.Id)
+	equals(t, http.StatusOK, recorder.Code)
+
+	var tombstone service.StoredMessage
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &tombstone))
+	equals(t, stored.Id, tombstone.Id)
+	equals(t, true, tombstone.DeletedAt != nil)
+
+	other, _, err := repo.AddMessage(context.Background(), service.Message{Sender: alice, Content: "hello"})
+	ok(t, err)
+	moderator := service.Grants{Roles: []string{service.RoleModerator}}
+	equals(t, http.StatusOK, deleteMessage(repo, bob, moderator, other.Id).Code)
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+)
+
+func DeleteWebhookMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webhooks, ok := request.Context().Value("webhookRepo").(WebhookRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("webhooks not configured"))
+			return
+		}
+
+		id := chi.URLParam(request, "id")
+
+		if id == "" {
+			RenderResponse(writer, request, NewBadRequestErr("invalid id parameter"))
+			return
+		}
+
+		err := webhooks.DeleteWebhook(request.Context(), id)
+
+		if errors.Is(err, ErrWebhookNotFound) {
+			RenderResponse(writer, request, NewNotFoundErr("no webhook found with that id"))
+			return
+		} else if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func DeleteWebhook(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -26,9 +26,82 @@ type StoredMessage struct {
 	Id         string    `json:"id"`
 	CreatedAt  time.Time `json:"createdAt"`
 	ReceivedAt time.Time `json:"receivedAt"`
+	// DeletedAt is set once the message has been deleted, its content is cleared but the rest of it remains as a
+	// tombstone so that clients holding a copy can learn that it is gone.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// EditedAt is set once the sender has changed the content, RevisionCount counts the prior versions kept.
+	EditedAt      *time.Time `json:"editedAt,omitempty"`
+	RevisionCount int        `json:"revisionCount"`
+	// Seen is only set on responses, reporting whether the user asking has read the message.
+	Seen *bool `json:"seen,omitempty"`
 	Message
 }
 
+// clientKey identifies a message by the sender that sent it and the id the sender's client gave it, so that a retried
+// submission can be recognised.
+type clientKey struct {
+	senderId string
+	clientId string
+}
+
+// clientKey retrieves the idempotency key of a message, ok is false if its client gave it no id.
+func (m Message) clientKey() (key clientKey, ok bool) {
+	return clientKey{m.Sender.Id, m.ClientId}, m.ClientId != ""
+}
+
+// MessageRevision is a prior version of a message's content.
+type MessageRevision struct {
+	// Revision numbers versions from 0 for the content the message was sent with.
+	Revision int    `json:"revision"`
+	Content  string `json:"content"`
+	// CreatedAt is when this version became the message's content.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MessageEventType identifies the change a MessageEvent records.
+type MessageEventType string
+
+const (
+	MessageCreatedEvent MessageEventType = "message.created"
+	MessageEditedEvent  MessageEventType = "message.edited"
+	MessageDeletedEvent MessageEventType = "message.deleted"
+	// MessageImportedEvent records a message loaded from a dataset, whether new or replacing one already stored.
+	MessageImportedEvent MessageEventType = "message.imported"
+)
+
+// MessageEvent is an entry in the log of every change made to messages.
+type MessageEvent struct {
+	// Seq numbers events in the order they were written, starting from 1.
+	Seq  int64            `json:"seq"`
+	Type MessageEventType `json:"type"`
+	// Message is the message as the change left it.
+	Message   StoredMessage `json:"message"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// edit returns a copy of the message with new content, along with the revision preserving the content it replaces.
+func (s StoredMessage) edit(content string, editedAt time.Time) (StoredMessage, MessageRevision) {
+	revision := MessageRevision{Revision: s.RevisionCount, Content: s.Content, CreatedAt: s.CreatedAt}
+
+	if s.EditedAt != nil {
+		revision.CreatedAt = *s.EditedAt
+	}
+
+	s.Content = content
+	s.EditedAt = &editedAt
+	s.RevisionCount++
+
+	return s, revision
+}
+
+// tombstone returns a copy of the message marked as deleted at the given time, with its content removed.
+func (s StoredMessage) tombstone(deletedAt time.Time) StoredMessage {
+	s.DeletedAt = &deletedAt
+	s.Content = ""
+
+	return s
+}
+
 func (s StoredMessage) Render(w http.ResponseWriter, _ *http.Request) error {
 	w.WriteHeader(http.StatusOK)
 
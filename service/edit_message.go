@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"time"
+)
+
+type editMessageRequest struct {
+	Content string `json:"content"`
+}
+
+func EditMessageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		config, ok := request.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
+			return
+		}
+
+		id := chi.URLParam(request, "id")
+
+		if id == "" {
+			RenderResponse(writer, request, NewBadRequestErr("invalid id parameter"))
+			return
+		}
+
+		var emr editMessageRequest
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&emr)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if emr.Content == "" {
+			RenderResponse(writer, request, NewBadRequestErr("missing content"))
+			return
+		}
+
+		msg, err := repo.GetMessage(request.Context(), id)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		if msg.Id == "" {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		}
+
+		sender := request.Context().Value("sender").(Sender)
+
+		if msg.Sender.Id != sender.Id {
+			RenderResponse(writer, request, NewForbiddenErr("only the sender may edit a message"))
+			return
+		}
+
+		if msg.DeletedAt != nil {
+			RenderResponse(writer, request, NewConflictErr("message has been deleted"))
+			return
+		}
+
+		editWindow := config.GetEditWindow()
+
+		if editWindow > 0 && time.Since(msg.CreatedAt) > editWindow {
+			RenderResponse(writer, request, NewForbiddenErr("message can no longer be edited"))
+			return
+		}
+
+		edited, err := repo.EditMessage(request.Context(), id, emr.Content)
+
+		if errors.Is(err, ErrMessageNotFound) {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		} else if errors.Is(err, ErrMessageDeleted) {
+			RenderResponse(writer, request, NewConflictErr("message has been deleted"))
+			return
+		} else if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "message", &edited)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func EditMessage(writer http.ResponseWriter, request *http.Request) {
+	msg, ok := request.Context().Value("message").(*StoredMessage)
+
+	if !ok {
+		RenderResponse(writer, request, NewNotFoundErr("unable to edit message"))
+		return
+	}
+
+	RenderResponse(writer, request, msg)
+}
@@ -0,0 +1,64 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func editMessage(tb testing.TB, repo service.MessageRepository, sender service.Sender, id string,
+	content string) *httptest.ResponseRecorder {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.With(service.EditMessageMiddleware).Patch("/messages/{id}", service.EditMessage)
+
+	body, err := json.Marshal(map[string]string{"content": content})
+	ok(tb, err)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"repo": repo, "config": config, "sender": sender}).ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodPatch, "/messages/"+id, bytes.NewReader(body)))
+
+	return recorder
+}
+
+// TestEditMessage_Authorization ensures that only the sender may edit a message, and only while it is editable.
+func TestEditMessage_Authorization(t *testing.T) {
+	t.Setenv("MESSAGE_SERVICE_EDIT_WINDOW", "60")
+	repo := makeInMemoryRepo(t)
+	alice := service.Sender{Id: "1", Username: "alice"}
+	bob := service.Sender{Id: "2", Username: "bob"}
+
+	stored, _, err := repo.AddMessage(context.Background(), service.Message{Sender: alice, Content: "helo"})
+	ok(t, err)
+
+	equals(t, http.StatusForbidden, editMessage(t, repo, bob, stored.Id, "hello").Code)
+	equals(t, http.StatusNotFound, editMessage(t, repo, alice, "missing", "hello").Code)
+	equals(t, http.StatusBadRequest, editMessage(t, repo, alice, stored.Id, "").Code)
+
+	recorder := editMessage(t, repo, alice, stored.Id, "hello")
+	equals(t, http.StatusOK, recorder.Code)
+
+	var edited service.StoredMessage
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &edited))
+	equals(t, "hello", edited.Content)
+	equals(t, 1, edited.RevisionCount)
+
+	old := service.StoredMessage{Id: "old", CreatedAt: time.Now().UTC().Add(-time.Hour),
+		Message: service.Message{Sender: alice, Content: "hello"}}
+	_, err = repo.ImportMessage(context.Background(), old, false)
+	ok(t, err)
+	equals(t, http.StatusForbidden, editMessage(t, repo, alice, old.Id, "hi").Code)
+
+	_, err = repo.DeleteMessage(context.Background(), stored.Id)
+	ok(t, err)
+	equals(t, http.StatusConflict, editMessage(t, repo, alice, stored.Id, "hi").Code)
+}
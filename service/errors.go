@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -47,3 +49,34 @@ func NewUnauthorizedErr(message string) ErrorResponse {
 		Message: message,
 	}
 }
+
+func NewForbiddenErr(message string) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusForbidden,
+		Message: message,
+	}
+}
+
+func NewConflictErr(message string) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusConflict,
+		Message: message,
+	}
+}
+
+func NewGatewayTimeoutErr(message string) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusGatewayTimeout,
+		Message: message,
+	}
+}
+
+// NewRepoErr converts an error returned by a MessageRepository into a response, reporting cancelled or timed out
+// requests as a gateway timeout rather than a generic repo error.
+func NewRepoErr(err error) ErrorResponse {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return NewGatewayTimeoutErr("request timed out")
+	}
+
+	return NewInternalServerErr("repo error")
+}
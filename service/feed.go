@@ -0,0 +1,147 @@
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+// subscriptionBuffer is how many messages may be waiting for a subscriber before it is considered too slow to keep.
+const subscriptionBuffer = 64
+
+// ErrSlowConsumer is reported by a Subscription that was dropped because its subscriber fell too far behind. The
+// subscriber can catch up through GetMessagesForLocation before subscribing again.
+var ErrSlowConsumer = errors.New("subscriber fell too far behind")
+
+// Feed fans newly stored messages out to the subscribers on this instance watching the area each one falls in, every
+// Broker delivers through one.
+type Feed struct {
+	mut         sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewFeed constructs a Feed without any subscribers.
+func NewFeed() *Feed {
+	return &Feed{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the messages published to a Feed within radiusMeters of a center.
+type Subscription struct {
+	feed *Feed
+	// The area is guarded by the feed's lock, which Publish holds while matching messages against it.
+	center       Location
+	radiusMeters float64
+
+	mut      sync.Mutex
+	messages chan StoredMessage
+	closed   bool
+	err      error
+}
+
+// Subscribe starts delivering messages published within radiusMeters of center. The subscription must be closed once
+// it is no longer needed.
+func (f *Feed) Subscribe(center Location, radiusMeters float64) *Subscription {
+	sub := &Subscription{
+		feed:         f,
+		center:       center,
+		radiusMeters: radiusMeters,
+		messages:     make(chan StoredMessage, subscriptionBuffer),
+	}
+
+	f.mut.Lock()
+	f.subscribers[sub] = struct{}{}
+	f.mut.Unlock()
+
+	return sub
+}
+
+// Publish delivers a message to every subscriber watching its location. Publishing never blocks, a subscriber whose
+// buffer is full is dropped with ErrSlowConsumer instead.
+func (f *Feed) Publish(msg StoredMessage) {
+	dropped := make([]*Subscription, 0)
+
+	f.mut.RLock()
+	for sub := range f.subscribers {
+		if distance(sub.center, msg.Location) <= sub.radiusMeters && !sub.deliver(msg) {
+			dropped = append(dropped, sub)
+		}
+	}
+	f.mut.RUnlock()
+
+	for _, sub := range dropped {
+		f.unsubscribe(sub)
+	}
+}
+
+func (f *Feed) unsubscribe(sub *Subscription) {
+	f.mut.Lock()
+	delete(f.subscribers, sub)
+	f.mut.Unlock()
+}
+
+// deliver queues a message for the subscriber, reporting false if the subscriber was dropped because its buffer is
+// full.
+func (s *Subscription) deliver(msg StoredMessage) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closed {
+		return true
+	}
+
+	select {
+	case s.messages <- msg:
+		return true
+	default:
+		s.closeLocked(ErrSlowConsumer)
+		return false
+	}
+}
+
+// Area retrieves the center and radius of the area the subscription watches.
+func (s *Subscription) Area() (Location, float64) {
+	s.feed.mut.RLock()
+	defer s.feed.mut.RUnlock()
+
+	return s.center, s.radiusMeters
+}
+
+// Move changes the area the subscription watches, messages published from then on are delivered if they fall inside
+// the new area.
+func (s *Subscription) Move(center Location, radiusMeters float64) {
+	s.feed.mut.Lock()
+	s.center = center
+	s.radiusMeters = radiusMeters
+	s.feed.mut.Unlock()
+}
+
+// Messages retrieves the channel messages are delivered on, it is closed once the subscription ends.
+func (s *Subscription) Messages() <-chan StoredMessage {
+	return s.messages
+}
+
+// Err reports why the subscription ended, nil if it is still open or was closed by its subscriber.
+func (s *Subscription) Err() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.mut.Lock()
+	s.closeLocked(nil)
+	s.mut.Unlock()
+
+	s.feed.unsubscribe(s)
+}
+
+func (s *Subscription) closeLocked(err error) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.err = err
+	close(s.messages)
+}
@@ -0,0 +1,29 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/message/service"
+	"testing"
+)
+
+// TestFeed_SlowConsumer ensures that a subscriber which stops reading is dropped rather than blocking publishers.
+func TestFeed_SlowConsumer(t *testing.T) {
+	feed := service.NewFeed()
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+	sub := feed.Subscribe(loc, 1000)
+
+	for i := 0; i < 1000; i++ {
+		feed.Publish(service.StoredMessage{Message: service.Message{Location: loc}})
+	}
+
+	received := 0
+
+	for range sub.Messages() {
+		received++
+	}
+
+	equals(t, true, received < 1000)
+	equals(t, service.ErrSlowConsumer, sub.Err())
+
+	// Closing a dropped subscription is harmless.
+	sub.Close()
+}
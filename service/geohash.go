@@ -0,0 +1,50 @@
+package service
+
+// geohashAlphabet is the base32 alphabet geohashes are written in.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// EncodeGeohash encodes a location as a geohash of precision characters. Each character narrows the cell the location
+// falls in, so locations sharing a prefix are near one another, a 6 character geohash is a cell of roughly 1.2km by
+// 0.6km.
+func EncodeGeohash(location Location, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLong, maxLong := -180.0, 180.0
+	hash := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+
+	for len(hash) < precision {
+		// Bits alternate between halving the longitude and the latitude range, starting with the longitude.
+		if even {
+			mid := (minLong + maxLong) / 2
+
+			if location.Long >= mid {
+				ch = ch<<1 | 1
+				minLong = mid
+			} else {
+				ch = ch << 1
+				maxLong = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+
+			if location.Lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch = ch << 1
+				maxLat = mid
+			}
+		}
+
+		even = !even
+		bit++
+
+		if bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return string(hash)
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type GetApiKeysResponse []ApiKey
+
+func (g GetApiKeysResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetApiKeysMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys, ok := request.Context().Value("apiKeyRepo").(ApiKeyRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("api keys not configured"))
+			return
+		}
+
+		stored, err := keys.GetApiKeys(request.Context())
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "apiKeys", stored)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// GetApiKeys responds with every API key, without their hashes.
+func GetApiKeys(writer http.ResponseWriter, request *http.Request) {
+	stored, ok := request.Context().Value("apiKeys").([]ApiKey)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	response := make(GetApiKeysResponse, len(stored))
+
+	for i, apiKey := range stored {
+		apiKey.Hash = ""
+		response[i] = apiKey
+	}
+
+	RenderResponse(writer, request, response)
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type GetDeadLettersResponse []WebhookDelivery
+
+func (g GetDeadLettersResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetDeadLettersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webhooks, ok := request.Context().Value("webhookRepo").(WebhookRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("webhooks not configured"))
+			return
+		}
+
+		dead, err := webhooks.GetDeadLetters(request.Context())
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "deliveries", dead)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// GetDeadLetters responds with the deliveries that were given up on, for an administrator to inspect.
+func GetDeadLetters(writer http.ResponseWriter, request *http.Request) {
+	dead, ok := request.Context().Value("deliveries").([]WebhookDelivery)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(writer, request, GetDeadLettersResponse(dead))
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxEventsLimit is the most events a single request may ask for.
+const maxEventsLimit = 1000
+
+type GetEventsResponse []MessageEvent
+
+func (g GetEventsResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetEventsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		from, errResp := parseEventSeq(request.URL.Query().Get("from"), "from parameter")
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
+		}
+
+		limitStr := request.URL.Query().Get("limit")
+		limit := 100
+
+		if limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+
+			if err != nil || limit <= 0 || limit > maxEventsLimit {
+				RenderResponse(writer, request, NewBadRequestErr("invalid limit parameter"))
+				return
+			}
+		}
+
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		events, err := repo.GetEvents(request.Context(), from, limit)
+
+		if err != nil {
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		// The next page starts after the last event returned, or where this one did when there were none yet.
+		nextFrom := from
+
+		if len(events) > 0 {
+			nextFrom = events[len(events)-1].Seq + 1
+		}
+
+		query := request.URL.Query()
+		query.Set("from", strconv.FormatInt(nextFrom, 10))
+		link := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+		writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.String()))
+
+		ctx := context.WithValue(request.Context(), "events", events)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// GetEvents responds with a page of the event log, in sequence order.
+func GetEvents(writer http.ResponseWriter, request *http.Request) {
+	events, ok := request.Context().Value("events").([]MessageEvent)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	response := make(GetEventsResponse, len(events))
+	copy(response, events)
+	RenderResponse(writer, request, response)
+}
+
+// parseEventSeq reads an event sequence number, which defaults to 1, the first event. name describes where the value
+// came from for the error returned when it is invalid.
+func parseEventSeq(value string, name string) (int64, *ErrorResponse) {
+	if value == "" {
+		return 1, nil
+	}
+
+	seq, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || seq < 1 {
+		errResp := NewBadRequestErr("invalid " + name)
+		return 0, &errResp
+	}
+
+	return seq, nil
+}
@@ -0,0 +1,103 @@
+package service_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func eventsRouter(repo service.MessageRepository, admin bool) http.Handler {
+	router := chi.NewRouter()
+	router.Route("/events", func(r chi.Router) {
+		r.Use(service.AdminMiddleware)
+		r.Get("/stream", service.StreamEvents)
+		r.With(service.GetEventsMiddleware).Get("/", service.GetEvents)
+	})
+
+	return withValues(router, map[string]interface{}{"repo": repo, "grants": adminGrants(admin)})
+}
+
+// readLogEvent reads the next event from a text/event-stream of the event log, skipping comments.
+func readLogEvent(tb testing.TB, reader *bufio.Reader) service.MessageEvent {
+	var event service.MessageEvent
+	found := false
+
+	for {
+		line, err := reader.ReadString('\n')
+		ok(tb, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && found:
+			return event
+		case strings.HasPrefix(line, "data: "):
+			ok(tb, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			found = true
+		}
+	}
+}
+
+// TestGetEvents_Paging ensures that the event log is read from the from parameter and links to the page after it.
+func TestGetEvents_Paging(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	addMessages(t, repo, 3)
+	handler := eventsRouter(repo, true)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events?from=2&limit=1", nil))
+	equals(t, http.StatusOK, recorder.Code)
+	equals(t, "</events?from=3&limit=1>; rel=\"next\"", recorder.Header().Get("Link"))
+
+	var events []service.MessageEvent
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &events))
+	equals(t, 1, len(events))
+	equals(t, int64(2), events[0].Seq)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events?from=0", nil))
+	equals(t, http.StatusBadRequest, recorder.Code)
+}
+
+// TestGetEvents_AdminOnly ensures that only administrators may read the event log.
+func TestGetEvents_AdminOnly(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	eventsRouter(makeInMemoryRepo(t), false).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events", nil))
+	equals(t, http.StatusForbidden, recorder.Code)
+}
+
+// TestStreamEvents_Resume ensures that an event stream resumed with Last-Event-ID starts after that event and then
+// follows events logged later.
+func TestStreamEvents_Resume(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	stored := addMessages(t, repo, 2)
+	server := httptest.NewServer(eventsRouter(repo, true))
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/events/stream", nil)
+	ok(t, err)
+	request.Header.Set("Last-Event-ID", "1")
+
+	response, err := http.DefaultClient.Do(request)
+	ok(t, err)
+	defer response.Body.Close()
+	equals(t, http.StatusOK, response.StatusCode)
+
+	reader := bufio.NewReader(response.Body)
+	event := readLogEvent(t, reader)
+	equals(t, int64(2), event.Seq)
+	equals(t, stored[1].Id, event.Message.Id)
+
+	_, err = repo.DeleteMessage(context.Background(), stored[0].Id)
+	ok(t, err)
+
+	event = readLogEvent(t, reader)
+	equals(t, int64(3), event.Seq)
+	equals(t, service.MessageDeletedEvent, event.Type)
+	equals(t, stored[0].Id, event.Message.Id)
+}
@@ -25,14 +25,30 @@ func GetMessageMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		msg, err := repo.GetMessage(id)
+		msg, err := repo.GetMessage(request.Context(), id)
 
 		if err != nil {
 			log.Println(err)
-			RenderResponse(writer, request, NewInternalServerErr("repo error"))
+			RenderResponse(writer, request, NewRepoErr(err))
 			return
 		}
 
+		if msg.Id == "" {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		}
+
+		seen := []StoredMessage{msg}
+		err = markSeen(request.Context(), repo, seen)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		msg = seen[0]
+
 		ctx := context.WithValue(request.Context(), "message", &msg)
 		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
@@ -2,11 +2,18 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// longPollMargin is how much of a request's deadline a long poll leaves for answering once it stops waiting.
+const longPollMargin = time.Second
+
 type GetMessagesResponse []StoredMessage
 
 func (g GetMessagesResponse) Render(w http.ResponseWriter, _ *http.Request) error {
@@ -17,70 +24,86 @@ func (g GetMessagesResponse) Render(w http.ResponseWriter, _ *http.Request) erro
 
 func GetMessagesMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		latStr := request.URL.Query().Get("lat")
+		center, radiusInMeters, errResp := parseArea(request)
 
-		if latStr == "" {
-			RenderResponse(writer, request, NewBadRequestErr("lat parameter not provided"))
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
 			return
 		}
 
-		lat, err := strconv.ParseFloat(latStr, 64)
+		config, ok := request.Context().Value("config").(Configuration)
 
-		if err != nil {
-			RenderResponse(writer, request, NewBadRequestErr("invalid lat parameter"))
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
 			return
 		}
 
-		longStr := request.URL.Query().Get("long")
+		anonymous, _ := request.Context().Value("anonymous").(bool)
+		limitStr := request.URL.Query().Get("limit")
+		limit := 100
 
-		if longStr == "" {
-			RenderResponse(writer, request, NewBadRequestErr("long parameter not provided"))
-			return
+		if limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+
+			if err != nil || limit <= 0 {
+				RenderResponse(writer, request, NewBadRequestErr("invalid limit parameter"))
+				return
+			}
 		}
 
-		long, err := strconv.ParseFloat(longStr, 64)
+		if anonymous {
+			// Snapping the center to the precision locations are shown at keeps a series of nearby queries from
+			// narrowing down where a message was sent.
+			center = coarsenLocation(center, config.GetAnonymousPrecision())
 
-		if err != nil {
-			RenderResponse(writer, request, NewBadRequestErr("invalid long parameter"))
-			return
-		}
+			if limitStr == "" && limit > config.GetAnonymousMaxLimit() {
+				limit = config.GetAnonymousMaxLimit()
+			}
 
-		radiusInMetersStr := request.URL.Query().Get("radius")
-		radiusInMeters := 100.0
+			if limit > config.GetAnonymousMaxLimit() {
+				RenderResponse(writer, request, NewBadRequestErr(fmt.Sprintf(
+					"limit may be at most %d without a token", config.GetAnonymousMaxLimit())))
+				return
+			}
 
-		if radiusInMetersStr != "" {
-			radiusInMeters, err = strconv.ParseFloat(radiusInMetersStr, 64)
+			radiusInMeters, errResp = limitRadius(request, radiusInMeters, config.GetAnonymousMinRadius(),
+				config.GetAnonymousMaxRadius())
 
-			if err != nil {
-				RenderResponse(writer, request, NewBadRequestErr("invalid radius parameter"))
+			if errResp != nil {
+				RenderResponse(writer, request, errResp)
 				return
 			}
 		}
 
-		limitStr := request.URL.Query().Get("limit")
-		limit := 100
+		// Deciding which messages anonymous callers see by their exact locations would let a caller narrow the radius
+		// until a message drops out, learning how far it was from the center. Messages are looked for as far out as
+		// their coarsened locations could have moved, and kept or dropped once coarsened.
+		queryRadius := radiusInMeters
 
-		if limitStr != "" {
-			limit, err = strconv.Atoi(limitStr)
+		if anonymous {
+			queryRadius += coarseMargin(config.GetAnonymousPrecision())
+		}
 
-			if err != nil {
-				RenderResponse(writer, request, NewBadRequestErr("invalid limit parameter"))
-				return
-			}
+		page, errResp := parsePage(request, config.GetCursorSecret())
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
 		}
 
-		afterStr := request.URL.Query().Get("after")
-		after := time.UnixMilli(0)
+		var wait time.Duration
+		waitStr := request.URL.Query().Get("wait")
 
-		if afterStr != "" {
-			afterInt, err := strconv.ParseInt(afterStr, 10, 64)
+		if waitStr != "" {
+			waitInt, err := strconv.Atoi(waitStr)
 
-			if err != nil {
-				RenderResponse(writer, request, NewBadRequestErr("invalid after parameter"))
+			if err != nil || waitInt < 0 {
+				RenderResponse(writer, request, NewBadRequestErr("invalid wait parameter"))
 				return
 			}
 
-			after = time.UnixMilli(afterInt)
+			wait = time.Duration(waitInt) * time.Second
 		}
 
 		repo, ok := request.Context().Value("repo").(MessageRepository)
@@ -90,16 +113,58 @@ func GetMessagesMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		messages, err := repo.GetMessagesForLocation(Location{
-			Long: long,
-			Lat:  lat,
-		}, radiusInMeters, limit, after)
+		// Only messages stored from now on can fill an empty page of newer messages, waiting for a page of older
+		// ones would be pointless. Subscribing before querying ensures that none stored in between are missed.
+		var sub *Subscription
+
+		if wait > 0 && (page.Cursor == nil || page.Direction == NewerPage) {
+			broker, ok := request.Context().Value("broker").(Broker)
+
+			if !ok {
+				RenderResponse(writer, request, NewInternalServerErr("broker not configured"))
+				return
+			}
+
+			sub = broker.Subscribe(center, queryRadius)
+			defer sub.Close()
+		}
+
+		messages, err := repo.GetMessagesForLocation(request.Context(), center, queryRadius, limit, page)
+
+		if err == nil && len(messages) == 0 && sub != nil {
+			timer := time.NewTimer(longPollWait(request.Context(), wait))
+			defer timer.Stop()
+
+			select {
+			case <-sub.Messages():
+				messages, err = repo.GetMessagesForLocation(request.Context(), center, queryRadius, limit, page)
+			case <-timer.C:
+			case <-request.Context().Done():
+				err = request.Context().Err()
+			}
+		}
+
+		if err == nil {
+			err = markSeen(request.Context(), repo, messages)
+		}
 
 		if err != nil {
-			RenderResponse(writer, request, NewInternalServerErr("repo error"))
+			RenderResponse(writer, request, NewRepoErr(err))
 			return
 		}
 
+		// The links continue from the messages looked at, so a page whose messages were all dropped still leads on.
+		links := pageLinks(request, config.GetCursorSecret(), page, messages, limit)
+
+		if len(links) > 0 {
+			writer.Header().Set("Link", strings.Join(links, ", "))
+		}
+
+		if anonymous {
+			anonymize(messages, config.GetAnonymousPrecision())
+			messages = withinCoarsened(messages, center, radiusInMeters)
+		}
+
 		ctx := context.WithValue(request.Context(), "messages", messages)
 		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
@@ -117,3 +182,149 @@ func GetMessages(writer http.ResponseWriter, request *http.Request) {
 	copy(response, messages)
 	RenderResponse(writer, request, response)
 }
+
+// pageLinks builds the next and prev entries of the Link header for a page of messages. next continues towards older
+// messages and prev towards newer ones, so a client can keep following prev to pick up new messages.
+func pageLinks(request *http.Request, secret []byte, page MessagePage, messages []StoredMessage, limit int) []string {
+	links := make([]string, 0, 2)
+
+	if len(messages) == 0 {
+		if page.Cursor != nil {
+			links = append(links, pageLink(request, secret, MessagePage{Cursor: page.Cursor, Direction: NewerPage},
+				"prev"))
+		}
+
+		return links
+	}
+
+	newest := CursorFor(messages[0])
+	oldest := CursorFor(messages[len(messages)-1])
+
+	if len(messages) == limit || (page.Cursor != nil && page.Direction == NewerPage) {
+		links = append(links, pageLink(request, secret, MessagePage{Cursor: &oldest, Direction: OlderPage}, "next"))
+	}
+
+	return append(links, pageLink(request, secret, MessagePage{Cursor: &newest, Direction: NewerPage}, "prev"))
+}
+
+func pageLink(request *http.Request, secret []byte, page MessagePage, rel string) string {
+	query := request.URL.Query()
+	query.Del("after")
+	query.Set("cursor", EncodeCursor(secret, page))
+
+	link := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+
+	return fmt.Sprintf("<%s>; rel=\"%s\"", link.String(), rel)
+}
+
+// longPollWait limits how long a request may wait for new messages so that it still answers before its deadline, as
+// set by the timeout middleware.
+func longPollWait(ctx context.Context, wait time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline) - longPollMargin; remaining < wait {
+			return remaining
+		}
+	}
+
+	return wait
+}
+
+// parseArea reads the lat, long and radius query parameters describing the circle a request is interested in. The
+// radius defaults to 100 meters.
+func parseArea(request *http.Request) (Location, float64, *ErrorResponse) {
+	badRequest := func(message string) (Location, float64, *ErrorResponse) {
+		errResp := NewBadRequestErr(message)
+		return Location{}, 0, &errResp
+	}
+
+	latStr := request.URL.Query().Get("lat")
+
+	if latStr == "" {
+		return badRequest("lat parameter not provided")
+	}
+
+	lat, err := strconv.ParseFloat(latStr, 64)
+
+	if err != nil {
+		return badRequest("invalid lat parameter")
+	}
+
+	longStr := request.URL.Query().Get("long")
+
+	if longStr == "" {
+		return badRequest("long parameter not provided")
+	}
+
+	long, err := strconv.ParseFloat(longStr, 64)
+
+	if err != nil {
+		return badRequest("invalid long parameter")
+	}
+
+	radiusInMetersStr := request.URL.Query().Get("radius")
+	radiusInMeters := 100.0
+
+	if radiusInMetersStr != "" {
+		radiusInMeters, err = strconv.ParseFloat(radiusInMetersStr, 64)
+
+		if err != nil || radiusInMeters < 0 {
+			return badRequest("invalid radius parameter")
+		}
+	}
+
+	return Location{Lat: lat, Long: long}, radiusInMeters, nil
+}
+
+// limitRadius holds a radius read by parseArea between minRadius and maxRadius. A radius the request gave outside them
+// is rejected, the default radius is moved to the nearest one inside them.
+func limitRadius(request *http.Request, radiusInMeters float64, minRadius float64,
+	maxRadius float64) (float64, *ErrorResponse) {
+	if request.URL.Query().Get("radius") == "" {
+		return math.Max(math.Min(radiusInMeters, maxRadius), minRadius), nil
+	}
+
+	if radiusInMeters > maxRadius {
+		errResp := NewBadRequestErr(fmt.Sprintf("radius may be at most %g meters", maxRadius))
+		return 0, &errResp
+	}
+
+	if radiusInMeters < minRadius {
+		errResp := NewBadRequestErr(fmt.Sprintf("radius must be at least %g meters", minRadius))
+		return 0, &errResp
+	}
+
+	return radiusInMeters, nil
+}
+
+// parsePage reads the cursor or after query parameters selecting which page of messages a request wants, the newest
+// messages are selected when neither is given.
+func parsePage(request *http.Request, secret []byte) (MessagePage, *ErrorResponse) {
+	cursorStr := request.URL.Query().Get("cursor")
+	afterStr := request.URL.Query().Get("after")
+
+	if cursorStr != "" {
+		page, err := DecodeCursor(secret, cursorStr)
+
+		if err != nil {
+			errResp := NewBadRequestErr("invalid cursor parameter")
+			return MessagePage{}, &errResp
+		}
+
+		return page, nil
+	} else if afterStr != "" {
+		afterInt, err := strconv.ParseInt(afterStr, 10, 64)
+
+		if err != nil {
+			errResp := NewBadRequestErr("invalid after parameter")
+			return MessagePage{}, &errResp
+		}
+
+		// after predates cursors, treat it as a position ahead of every message created at that instant.
+		return MessagePage{
+			Cursor:    &MessageCursor{CreatedAt: time.UnixMilli(afterInt).UTC(), Id: maxCursorId},
+			Direction: NewerPage,
+		}, nil
+	}
+
+	return MessagePage{}, nil
+}
@@ -0,0 +1,111 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getMessages(tb testing.TB, ctx context.Context, repo service.MessageRepository, broker service.Broker,
+	query string) *httptest.ResponseRecorder {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	router := chi.NewRouter()
+	router.With(service.GetMessagesMiddleware).Get("/messages", service.GetMessages)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"repo": repo, "broker": broker, "config": config}).ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodGet, "/messages?"+query, nil).WithContext(ctx))
+
+	return recorder
+}
+
+// TestGetMessages_LongPollWakes ensures that a long poll with nothing newer to return answers as soon as a message is
+// stored inside its area.
+func TestGetMessages_LongPollWakes(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+	after := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _, _ = repo.AddMessage(context.Background(), service.Message{Content: "far",
+			Location: service.Location{Lat: 41.0, Long: -105.0}})
+		_, _, _ = repo.AddMessage(context.Background(), service.Message{Content: "near",
+			Location: service.Location{Lat: 40.0, Long: -105.0}})
+	}()
+
+	start := time.Now()
+	recorder := getMessages(t, context.Background(), repo, broker, "lat=40&long=-105&after="+after+"&wait=10")
+	equals(t, http.StatusOK, recorder.Code)
+	equals(t, true, time.Since(start) < 5*time.Second)
+
+	var messages []service.StoredMessage
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+	equals(t, 1, len(messages))
+	equals(t, "near", messages[0].Content)
+}
+
+// TestGetMessages_LongPollExpires ensures that a long poll answers with an empty page once its wait expires.
+func TestGetMessages_LongPollExpires(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+
+	recorder := getMessages(t, context.Background(), repo, broker, "lat=40&long=-105&wait=1")
+	equals(t, http.StatusOK, recorder.Code)
+	equals(t, "[]\n", recorder.Body.String())
+}
+
+// TestGetMessages_LongPollWithinDeadline ensures that a long poll answers before the request's deadline rather than
+// waiting as long as it asked to.
+func TestGetMessages_LongPollWithinDeadline(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	recorder := getMessages(t, ctx, repo, broker, "lat=40&long=-105&wait=60")
+	equals(t, http.StatusOK, recorder.Code)
+	equals(t, nil, ctx.Err())
+}
+
+// TestGetMessages_InvalidWait ensures that a negative or malformed wait is rejected.
+func TestGetMessages_InvalidWait(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	for _, wait := range []string{"-1", "soon"} {
+		recorder := getMessages(t, context.Background(), repo, service.NewInProcessBroker(), "lat=40&long=-105&wait="+wait)
+		equals(t, http.StatusBadRequest, recorder.Code)
+	}
+}
+
+// TestGetMessages_AfterIsExclusive ensures that the legacy after parameter leaves out messages created at exactly that
+// instant.
+func TestGetMessages_AfterIsExclusive(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	createdAt := time.UnixMilli(time.Now().UnixMilli()).UTC()
+
+	_, err := repo.ImportMessage(context.Background(), service.StoredMessage{
+		Id:        "b6a7b8a0-5c9c-4c5e-9f0f-000000000001",
+		CreatedAt: createdAt,
+		Message:   service.Message{Content: "exact", Location: service.Location{Lat: 40.0, Long: -105.0}},
+	}, false)
+	ok(t, err)
+
+	for after, expected := range map[int64]int{createdAt.UnixMilli(): 0, createdAt.UnixMilli() - 1: 1} {
+		recorder := getMessages(t, context.Background(), repo, service.NewInProcessBroker(),
+			"lat=40&long=-105&after="+strconv.FormatInt(after, 10))
+		equals(t, http.StatusOK, recorder.Code)
+
+		var messages []service.StoredMessage
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+		equals(t, expected, len(messages))
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GetPresenceResponse counts the users active nearby, naming only those who opted in to being shown.
+type GetPresenceResponse struct {
+	Count     int      `json:"count"`
+	Usernames []string `json:"usernames"`
+}
+
+func (g GetPresenceResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetPresenceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		center, radiusInMeters, errResp := parseArea(request)
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
+		}
+
+		config, ok := request.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
+			return
+		}
+
+		// Heartbeats are stored coarsened, so however the radius is varied only the cell a user is in can be told.
+		radiusInMeters, errResp = limitRadius(request, radiusInMeters, config.GetPresenceMinRadius(),
+			config.GetPresenceMaxRadius())
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
+		}
+
+		presenceRepo, ok := request.Context().Value("presenceRepo").(PresenceRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("presence not configured"))
+			return
+		}
+
+		nearby, err := presenceRepo.GetPresence(request.Context(), center, radiusInMeters,
+			time.Now().UTC().Add(-PresenceTtl))
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "nearby", nearby)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// GetPresence responds with the users active nearby, not counting the user asking.
+func GetPresence(writer http.ResponseWriter, request *http.Request) {
+	nearby, ok := request.Context().Value("nearby").([]Presence)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	sender, _ := request.Context().Value("sender").(Sender)
+	response := GetPresenceResponse{Usernames: make([]string, 0)}
+
+	for _, presence := range nearby {
+		if presence.Sender.Id == sender.Id {
+			continue
+		}
+
+		response.Count++
+
+		if presence.Visible {
+			response.Usernames = append(response.Usernames, presence.Username)
+		}
+	}
+
+	RenderResponse(writer, request, response)
+}
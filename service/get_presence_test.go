@@ -0,0 +1,105 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestGetPresence_CountsOthersNearby ensures that users who sent a heartbeat nearby are counted, that only those who
+// opted in are named, and that the user asking is left out.
+func TestGetPresence_CountsOthersNearby(t *testing.T) {
+	presenceRepo, err := service.NewPresenceRepository(makeInMemoryRepo(t))
+	ok(t, err)
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	router := chi.NewRouter()
+	router.With(service.HeartbeatMiddleware).Put("/presence", service.Heartbeat)
+	router.With(service.GetPresenceMiddleware).Get("/presence", service.GetPresence)
+
+	heartbeat := func(sender service.Sender, visible bool) {
+		encoded, err := json.Marshal(map[string]interface{}{
+			"location": map[string]float64{"lat": 40.0, "long": -105.0},
+			"visible":  visible,
+		})
+		ok(t, err)
+
+		recorder := httptest.NewRecorder()
+		withValues(router, map[string]interface{}{"presenceRepo": presenceRepo, "sender": sender,
+			"config": config}).ServeHTTP(
+			recorder, httptest.NewRequest(http.MethodPut, "/presence", bytes.NewReader(encoded)))
+		equals(t, http.StatusOK, recorder.Code)
+	}
+
+	me := service.Sender{Id: "1", Username: "me"}
+	heartbeat(me, true)
+	heartbeat(service.Sender{Id: "2", Username: "shown"}, true)
+	heartbeat(service.Sender{Id: "3", Username: "hidden"}, false)
+
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"presenceRepo": presenceRepo, "sender": me, "config": config}).ServeHTTP(
+		recorder, httptest.NewRequest(http.MethodGet, "/presence?lat=40.0&long=-105.0&radius=500", nil))
+	equals(t, http.StatusOK, recorder.Code)
+
+	var response service.GetPresenceResponse
+	ok(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	equals(t, service.GetPresenceResponse{Count: 2, Usernames: []string{"shown"}}, response)
+}
+
+// TestHeartbeat_StoresCoarsenedLocation ensures that the location of a heartbeat is rounded to the configured precision
+// before it is stored.
+func TestHeartbeat_StoresCoarsenedLocation(t *testing.T) {
+	presenceRepo, err := service.NewPresenceRepository(makeInMemoryRepo(t))
+	ok(t, err)
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	encoded, err := json.Marshal(map[string]interface{}{
+		"location": map[string]float64{"lat": 40.00041, "long": -105.00038},
+		"visible":  true,
+	})
+	ok(t, err)
+
+	recorder := httptest.NewRecorder()
+	withValues(service.HeartbeatMiddleware(http.HandlerFunc(service.Heartbeat)), map[string]interface{}{
+		"presenceRepo": presenceRepo, "sender": service.Sender{Id: "1", Username: "me"}, "config": config,
+	}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/presence", bytes.NewReader(encoded)))
+	equals(t, http.StatusOK, recorder.Code)
+
+	presence, err := presenceRepo.GetPresence(context.Background(), service.Location{Lat: 40.0, Long: -105.0}, 1,
+		time.Now().Add(-time.Minute))
+	ok(t, err)
+	equals(t, 1, len(presence))
+	equals(t, service.Location{Lat: 40.0, Long: -105.0}, presence[0].Location)
+}
+
+// TestGetPresence_RadiusLimits ensures that a radius outside the configured bounds, or a negative one, is rejected.
+func TestGetPresence_RadiusLimits(t *testing.T) {
+	presenceRepo, err := service.NewPresenceRepository(makeInMemoryRepo(t))
+	ok(t, err)
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	handler := withValues(service.GetPresenceMiddleware(http.HandlerFunc(service.GetPresence)),
+		map[string]interface{}{"presenceRepo": presenceRepo, "sender": service.Sender{Id: "1"}, "config": config})
+
+	for query, code := range map[string]int{
+		"":             http.StatusOK,
+		"&radius=250":  http.StatusOK,
+		"&radius=5000": http.StatusOK,
+		"&radius=10":   http.StatusBadRequest,
+		"&radius=5001": http.StatusBadRequest,
+		"&radius=-1":   http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/presence?lat=40.0&long=-105.0"+query, nil))
+		equals(t, code, recorder.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+)
+
+type GetRevisionsResponse []MessageRevision
+
+func (g GetRevisionsResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetRevisionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		id := chi.URLParam(request, "id")
+
+		if id == "" {
+			RenderResponse(writer, request, NewBadRequestErr("invalid id parameter"))
+			return
+		}
+
+		revisions, err := repo.GetRevisions(request.Context(), id)
+
+		if errors.Is(err, ErrMessageNotFound) {
+			RenderResponse(writer, request, NewNotFoundErr("no message found with that id"))
+			return
+		} else if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "revisions", revisions)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func GetRevisions(writer http.ResponseWriter, request *http.Request) {
+	revisions, ok := request.Context().Value("revisions").([]MessageRevision)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	response := make(GetRevisionsResponse, len(revisions))
+	copy(response, revisions)
+	RenderResponse(writer, request, response)
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// GetUnreadCountResponse counts the messages in an area that the user asking has not read.
+type GetUnreadCountResponse struct {
+	Count int `json:"count"`
+}
+
+func (g GetUnreadCountResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetUnreadCountMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		center, radiusInMeters, errResp := parseArea(request)
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
+		}
+
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		sender := request.Context().Value("sender").(Sender)
+		count, err := repo.CountUnread(request.Context(), sender.Id, center, radiusInMeters)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "unreadCount", count)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func GetUnreadCount(writer http.ResponseWriter, request *http.Request) {
+	count, ok := request.Context().Value("unreadCount").(int)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(writer, request, GetUnreadCountResponse{Count: count})
+}
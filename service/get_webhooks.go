@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type GetWebhooksResponse []Webhook
+
+func (g GetWebhooksResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func GetWebhooksMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webhooks, ok := request.Context().Value("webhookRepo").(WebhookRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("webhooks not configured"))
+			return
+		}
+
+		registered, err := webhooks.GetWebhooks(request.Context())
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "webhooks", registered)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// GetWebhooks responds with every registered webhook, without their secrets.
+func GetWebhooks(writer http.ResponseWriter, request *http.Request) {
+	registered, ok := request.Context().Value("webhooks").([]Webhook)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	response := make(GetWebhooksResponse, len(registered))
+
+	for i, webhook := range registered {
+		webhook.Secret = ""
+		response[i] = webhook
+	}
+
+	RenderResponse(writer, request, response)
+}
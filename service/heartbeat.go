@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type heartbeatRequest struct {
+	Location `json:"location"`
+	Visible  bool `json:"visible"`
+}
+
+func HeartbeatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		config, ok := request.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
+			return
+		}
+
+		presenceRepo, ok := request.Context().Value("presenceRepo").(PresenceRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("presence not configured"))
+			return
+		}
+
+		var hr heartbeatRequest
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&hr)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		err = ValidateLocation(hr.Location)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr(err.Error()))
+			return
+		}
+
+		presence := Presence{
+			Sender:     request.Context().Value("sender").(Sender),
+			Location:   coarsenLocation(hr.Location, config.GetPresencePrecision()),
+			Visible:    hr.Visible,
+			LastSeenAt: time.Now().UTC(),
+		}
+		err = presenceRepo.Heartbeat(request.Context(), presence)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), "presence", &presence)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Heartbeat responds with the presence recorded, the user is shown as active until PresenceTtl has passed.
+func Heartbeat(writer http.ResponseWriter, request *http.Request) {
+	presence, ok := request.Context().Value("presence").(*Presence)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("unable to record presence"))
+		return
+	}
+
+	RenderResponse(writer, request, presence)
+}
@@ -1,39 +1,445 @@
 package service
 
 import (
+	"context"
 	"github.com/twinj/uuid"
 	"log"
 	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
 var mut sync.RWMutex
 
+// scanCheckInterval is how many messages a scan inspects between checks for a cancelled context.
+const scanCheckInterval = 1024
+
 type inMemoryMessageRepository struct {
-	messages     []StoredMessage
+	index        *spatialIndex
 	messagesById map[string]*StoredMessage
+	// revisionsById holds the prior versions of each edited message.
+	revisionsById map[string][]MessageRevision
+	// idsByClientKey finds the message a sender has already stored under a ClientId.
+	idsByClientKey map[clientKey]string
+	// events is the log of changes to messages, in sequence order.
+	events       []MessageEvent
+	webhooksById map[string]*Webhook
+	// deliveriesById holds the webhook outbox, leasedUntil when each claimed delivery may be claimed again.
+	deliveriesById map[string]*WebhookDelivery
+	leasedUntil    map[string]time.Time
+	// readPositions holds how far each user has read.
+	readPositions map[string]MessageCursor
+	// presenceById holds the latest heartbeat of each user.
+	presenceById map[string]*Presence
+	apiKeysById  map[string]*ApiKey
 	*sync.RWMutex
+	// durable is nil unless the repository persists its messages.
+	durable *durableLog
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	// closed makes Close safe to call more than once, closeErr holding what the first call returned.
+	closed   sync.Once
+	closeErr error
 }
 
-func (imr *inMemoryMessageRepository) GetMessage(id string) (StoredMessage, error) {
+func (imr *inMemoryMessageRepository) GetMessage(ctx context.Context, id string) (StoredMessage, error) {
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	}
+
 	imr.RLock()
 	defer imr.RUnlock()
 
-	return *imr.messagesById[id], nil
+	msg, found := imr.messagesById[id]
+
+	if !found {
+		return StoredMessage{}, nil
+	}
+
+	return *msg, nil
 }
 
-func (imr *inMemoryMessageRepository) AddMessage(message Message) (StoredMessage, error) {
+func (imr *inMemoryMessageRepository) DeleteMessage(ctx context.Context, id string) (StoredMessage, error) {
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	existing, found := imr.messagesById[id]
+
+	if !found {
+		return StoredMessage{}, ErrMessageNotFound
+	} else if existing.DeletedAt != nil {
+		return *existing, nil
+	}
+
+	msg := existing.tombstone(time.Now().UTC())
+	event := imr.nextEvent(MessageDeletedEvent, msg)
+	err := imr.persist(msg, nil, &event)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	imr.put(msg, nil)
+	imr.record(event)
+
+	return msg, nil
+}
+
+func (imr *inMemoryMessageRepository) EditMessage(ctx context.Context, id string, content string) (StoredMessage,
+	error) {
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	}
+
 	imr.Lock()
 	defer imr.Unlock()
 
+	existing, found := imr.messagesById[id]
+
+	if !found {
+		return StoredMessage{}, ErrMessageNotFound
+	} else if existing.DeletedAt != nil {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+
+	msg, revision := existing.edit(content, time.Now().UTC())
+	previous := imr.revisionsById[id]
+	revisions := make([]MessageRevision, len(previous), len(previous)+1)
+	copy(revisions, previous)
+	revisions = append(revisions, revision)
+
+	event := imr.nextEvent(MessageEditedEvent, msg)
+	err := imr.persist(msg, revisions, &event)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	imr.put(msg, revisions)
+	imr.record(event)
+
+	return msg, nil
+}
+
+func (imr *inMemoryMessageRepository) GetRevisions(ctx context.Context, id string) ([]MessageRevision, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	if _, found := imr.messagesById[id]; !found {
+		return nil, ErrMessageNotFound
+	}
+
+	revisions := make([]MessageRevision, len(imr.revisionsById[id]))
+	copy(revisions, imr.revisionsById[id])
+
+	return revisions, nil
+}
+
+func (imr *inMemoryMessageRepository) AddMessage(ctx context.Context, message Message) (StoredMessage, bool, error) {
+	if ctx.Err() != nil {
+		return StoredMessage{}, false, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	if key, ok := message.clientKey(); ok {
+		if id, found := imr.idsByClientKey[key]; found {
+			return *imr.messagesById[id], false, nil
+		}
+	}
+
 	id := uuid.NewV4().String()
 
 	msg := StoredMessage{Id: id, Message: message, CreatedAt: time.Now().UTC()}
-	imr.messages = append(imr.messages, msg)
-	imr.messagesById[id] = &msg
+	deliveries, err := imr.queueDeliveries(msg)
 
-	return msg, nil
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+
+	event := imr.nextEvent(MessageCreatedEvent, msg)
+	err = imr.log(walEntry{Op: walPut, Message: &msg, Event: &event, Deliveries: deliveries})
+
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+
+	imr.put(msg, nil)
+	imr.record(event)
+	imr.putDeliveries(deliveries)
+
+	return msg, true, nil
+}
+
+func (imr *inMemoryMessageRepository) ImportMessage(ctx context.Context, message StoredMessage,
+	overwrite bool) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	_, found := imr.messagesById[message.Id]
+
+	if found && !overwrite {
+		return false, nil
+	}
+
+	// Importing replaces the message itself but leaves the history of edits made here alone.
+	revisions := imr.revisionsById[message.Id]
+	event := imr.nextEvent(MessageImportedEvent, message)
+	err := imr.persist(message, revisions, &event)
+
+	if err != nil {
+		return false, err
+	}
+
+	imr.put(message, revisions)
+	imr.record(event)
+
+	return true, nil
+}
+
+// put stores a message and its revisions, replacing any message with the same id. Should an imported message share a
+// client key with one already stored, the key continues to find the earlier message. The write lock must be held.
+func (imr *inMemoryMessageRepository) put(message StoredMessage, revisions []MessageRevision) {
+	existing, found := imr.messagesById[message.Id]
+
+	if found {
+		imr.index.remove(existing)
+
+		if key, ok := existing.clientKey(); ok && imr.idsByClientKey[key] == existing.Id {
+			delete(imr.idsByClientKey, key)
+		}
+	}
+
+	msg := message
+	imr.index.insert(&msg)
+	imr.messagesById[msg.Id] = &msg
+
+	if key, ok := msg.clientKey(); ok {
+		if _, taken := imr.idsByClientKey[key]; !taken {
+			imr.idsByClientKey[key] = msg.Id
+		}
+	}
+
+	if len(revisions) > 0 {
+		imr.revisionsById[msg.Id] = revisions
+	} else {
+		delete(imr.revisionsById, msg.Id)
+	}
+}
+
+// apply replays a write-ahead log entry.
+func (imr *inMemoryMessageRepository) apply(entry walEntry) {
+	switch entry.Op {
+	case walPut:
+		imr.put(*entry.Message, entry.Revisions)
+
+		if entry.Event != nil {
+			imr.record(*entry.Event)
+		}
+
+		imr.putDeliveries(entry.Deliveries)
+	case walEvent:
+		imr.record(*entry.Event)
+	case walPutWebhook:
+		imr.webhooksById[entry.Webhook.Id] = entry.Webhook
+	case walDeleteWebhook:
+		imr.removeWebhook(entry.Id)
+	case walPutDelivery:
+		imr.deliveriesById[entry.Delivery.Id] = entry.Delivery
+	case walDeleteDelivery:
+		delete(imr.deliveriesById, entry.Id)
+	case walPutReadPosition:
+		imr.readPositions[entry.UserId] = *entry.ReadPosition
+	case walPutApiKey:
+		imr.apiKeysById[entry.ApiKey.Id] = entry.ApiKey
+	case walDeleteApiKey:
+		delete(imr.apiKeysById, entry.Id)
+	}
+}
+
+// persist records a message's new state in the write-ahead log along with the event logging the change, if the
+// repository is durable. Both share one entry so that neither is recovered without the other. The write lock must be
+// held.
+func (imr *inMemoryMessageRepository) persist(message StoredMessage, revisions []MessageRevision,
+	event *MessageEvent) error {
+	return imr.log(walEntry{Op: walPut, Message: &message, Revisions: revisions, Event: event})
+}
+
+// putDeliveries queues deliveries in the outbox. The write lock must be held.
+func (imr *inMemoryMessageRepository) putDeliveries(deliveries []WebhookDelivery) {
+	for _, delivery := range deliveries {
+		delivery := delivery
+		imr.deliveriesById[delivery.Id] = &delivery
+	}
+}
+
+// nextEvent builds the event logging a change to a message, numbered to follow the last event recorded. The write lock
+// must be held.
+func (imr *inMemoryMessageRepository) nextEvent(eventType MessageEventType, message StoredMessage) MessageEvent {
+	return MessageEvent{Seq: imr.lastSeq() + 1, Type: eventType, Message: message, CreatedAt: time.Now().UTC()}
+}
+
+func (imr *inMemoryMessageRepository) lastSeq() int64 {
+	if len(imr.events) == 0 {
+		return 0
+	}
+
+	return imr.events[len(imr.events)-1].Seq
+}
+
+// record appends an event to the log. An event that is already logged, as happens when recovery replays a
+// write-ahead log entry a snapshot also covers, is ignored. The write lock must be held.
+func (imr *inMemoryMessageRepository) record(event MessageEvent) {
+	if event.Seq > imr.lastSeq() {
+		imr.events = append(imr.events, event)
+	}
+}
+
+func (imr *inMemoryMessageRepository) GetEvents(ctx context.Context, from int64, limit int) ([]MessageEvent, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	start := sort.Search(len(imr.events), func(i int) bool {
+		return imr.events[i].Seq >= from
+	})
+	end := len(imr.events)
+
+	if end-start > limit {
+		end = start + limit
+	}
+
+	events := make([]MessageEvent, end-start)
+	copy(events, imr.events[start:end])
+
+	return events, nil
+}
+
+// log appends an entry to the write-ahead log, if the repository is durable. The write lock must be held.
+func (imr *inMemoryMessageRepository) log(entry walEntry) error {
+	if imr.durable == nil {
+		return nil
+	}
+
+	err := imr.durable.append(entry)
+
+	if err != nil {
+		return newErrRepository(err.Error())
+	}
+
+	return nil
+}
+
+// snapshot writes every message, event, webhook, queued delivery, read position and API key to a new snapshot and
+// drops the write-ahead log entries it covers. Writers are only blocked while the messages are copied and while the log
+// is compacted, not while the snapshot is written.
+func (imr *inMemoryMessageRepository) snapshot() error {
+	imr.RLock()
+	entries := make([]walEntry, 0, len(imr.messagesById))
+
+	for id, msg := range imr.messagesById {
+		msg := *msg
+		entries = append(entries, walEntry{Op: walPut, Message: &msg, Revisions: imr.revisionsById[id]})
+	}
+
+	for _, event := range imr.events {
+		event := event
+		entries = append(entries, walEntry{Op: walEvent, Event: &event})
+	}
+
+	for _, webhook := range imr.webhooksById {
+		webhook := *webhook
+		entries = append(entries, walEntry{Op: walPutWebhook, Webhook: &webhook})
+	}
+
+	for _, delivery := range imr.deliveriesById {
+		delivery := *delivery
+		entries = append(entries, walEntry{Op: walPutDelivery, Delivery: &delivery})
+	}
+
+	for userId, position := range imr.readPositions {
+		position := position
+		entries = append(entries, walEntry{Op: walPutReadPosition, UserId: userId, ReadPosition: &position})
+	}
+
+	for _, apiKey := range imr.apiKeysById {
+		apiKey := *apiKey
+		entries = append(entries, walEntry{Op: walPutApiKey, ApiKey: &apiKey})
+	}
+
+	covered := imr.durable.walSize
+	imr.RUnlock()
+
+	err := imr.durable.writeSnapshot(entries)
+
+	if err != nil {
+		return err
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	return imr.durable.compact(covered)
+}
+
+func (imr *inMemoryMessageRepository) snapshotLoop(interval time.Duration) {
+	defer imr.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := imr.snapshot()
+
+			if err != nil {
+				log.Println(err)
+			}
+		case <-imr.stop:
+			return
+		}
+	}
+}
+
+// Close stops a durable repository's snapshots, writes a final snapshot and closes its write-ahead log. It does
+// nothing for a repository that is not durable, and calling it again returns what the first call did.
+func (imr *inMemoryMessageRepository) Close() error {
+	if imr.durable == nil {
+		return nil
+	}
+
+	imr.closed.Do(func() {
+		close(imr.stop)
+		imr.stopped.Wait()
+
+		err := imr.snapshot()
+		closeErr := imr.durable.close()
+
+		if err == nil {
+			err = closeErr
+		}
+
+		imr.closeErr = err
+	})
+
+	return imr.closeErr
 }
 
 func distance(loc1 Location, loc2 Location) float64 {
@@ -49,7 +455,6 @@ func distance(loc1 Location, loc2 Location) float64 {
 			math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
 	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
 
-	log.Printf("distance: %f", earthRadius*c)
 	return earthRadius * c
 }
 
@@ -57,31 +462,60 @@ func toRadians(degrees float64) float64 {
 	return degrees * math.Pi / 180
 }
 
-func (imr *inMemoryMessageRepository) GetMessagesForLocation(location Location, radiusMeters float64, limit int,
-	after time.Time) ([]StoredMessage, error) {
+func (imr *inMemoryMessageRepository) GetMessagesForLocation(ctx context.Context, location Location,
+	radiusMeters float64, limit int, page MessagePage) ([]StoredMessage, error) {
 	imr.RLock()
 	defer imr.RUnlock()
 
-	messages := make([]StoredMessage, 0)
-	for i := len(imr.messages) - 1; i >= 0 && len(messages) < limit; i-- {
-		msg := imr.messages[i]
-
-		if !msg.CreatedAt.After(after) {
-			break
-		}
+	return imr.index.query(ctx, location, radiusMeters, limit, page, func(msg *StoredMessage) bool {
+		return distance(location, msg.Location) <= radiusMeters
+	})
+}
 
-		if distance(location, msg.Location) < radiusMeters {
-			messages = append(messages, msg)
-		}
+// reverseMessages reverses messages in place.
+func reverseMessages(messages []StoredMessage) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
-
-	return messages, nil
 }
 
+// MakeInMemoryRepository constructs an in memory MessageRepository. When the configuration names a data directory the
+// repository recovers its messages from it and persists every change back to it.
 func MakeInMemoryRepository(config Configuration) (MessageRepository, error) {
-	return &inMemoryMessageRepository{
-		make([]StoredMessage, 0),
-		make(map[string]*StoredMessage),
-		&mut,
-	}, nil
+	repo := &inMemoryMessageRepository{
+		index:          newSpatialIndex(),
+		messagesById:   make(map[string]*StoredMessage),
+		revisionsById:  make(map[string][]MessageRevision),
+		idsByClientKey: make(map[clientKey]string),
+		webhooksById:   make(map[string]*Webhook),
+		deliveriesById: make(map[string]*WebhookDelivery),
+		leasedUntil:    make(map[string]time.Time),
+		readPositions:  make(map[string]MessageCursor),
+		presenceById:   make(map[string]*Presence),
+		apiKeysById:    make(map[string]*ApiKey),
+		RWMutex:        &mut,
+	}
+
+	if config == nil || config.GetDataDir() == "" {
+		return repo, nil
+	}
+
+	durable, err := openDurableLog(config.GetDataDir())
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = durable.recover(repo.apply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	repo.durable = durable
+	repo.stop = make(chan struct{})
+	repo.stopped.Add(1)
+	go repo.snapshotLoop(config.GetSnapshotInterval())
+
+	return repo, nil
 }
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"github.com/twinj/uuid"
+	"sort"
+	"time"
+)
+
+func (imr *inMemoryMessageRepository) AddApiKey(ctx context.Context, key ApiKey) (ApiKey, error) {
+	if ctx.Err() != nil {
+		return ApiKey{}, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	key.Id = uuid.NewV4().String()
+	key.Key = ""
+	key.CreatedAt = time.Now().UTC()
+	err := imr.log(walEntry{Op: walPutApiKey, ApiKey: &key})
+
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	stored := key
+	imr.apiKeysById[stored.Id] = &stored
+
+	return key, nil
+}
+
+func (imr *inMemoryMessageRepository) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	keys := make([]ApiKey, 0, len(imr.apiKeysById))
+
+	for _, key := range imr.apiKeysById {
+		keys = append(keys, *key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+
+		return keys[i].Id < keys[j].Id
+	})
+
+	return keys, nil
+}
+
+// GetApiKeyByHash scans every key, there are only ever a handful of integrations.
+func (imr *inMemoryMessageRepository) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	if ctx.Err() != nil {
+		return ApiKey{}, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	for _, key := range imr.apiKeysById {
+		if key.Hash == hash {
+			return *key, nil
+		}
+	}
+
+	return ApiKey{}, ErrApiKeyNotFound
+}
+
+func (imr *inMemoryMessageRepository) DeleteApiKey(ctx context.Context, id string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	if _, found := imr.apiKeysById[id]; !found {
+		return ErrApiKeyNotFound
+	}
+
+	err := imr.log(walEntry{Op: walDeleteApiKey, Id: id})
+
+	if err != nil {
+		return err
+	}
+
+	delete(imr.apiKeysById, id)
+
+	return nil
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFileName      = "messages.wal"
+	snapshotFileName = "messages.snapshot"
+)
+
+type walOp string
+
+// Every entry records the full current state of what it describes, so replaying an entry more than once is harmless.
+const (
+	// walPut records a message, along with the event logging the change and the webhook deliveries of a new message
+	// when there are any.
+	walPut walOp = "put"
+	// walEvent records an event on its own, snapshots hold the event log this way.
+	walEvent walOp = "event"
+	// walPutWebhook records a webhook registration and walDeleteWebhook its removal.
+	walPutWebhook    walOp = "putWebhook"
+	walDeleteWebhook walOp = "deleteWebhook"
+	// walPutDelivery records a webhook delivery and walDeleteDelivery its completion.
+	walPutDelivery    walOp = "putDelivery"
+	walDeleteDelivery walOp = "deleteDelivery"
+	// walPutReadPosition records how far a user has read.
+	walPutReadPosition walOp = "putReadPosition"
+	// walPutApiKey records an API key and walDeleteApiKey its revocation.
+	walPutApiKey    walOp = "putApiKey"
+	walDeleteApiKey walOp = "deleteApiKey"
+)
+
+type walEntry struct {
+	Op        walOp             `json:"op"`
+	Message   *StoredMessage    `json:"message,omitempty"`
+	Revisions []MessageRevision `json:"revisions,omitempty"`
+	Event     *MessageEvent     `json:"event,omitempty"`
+	Webhook   *Webhook          `json:"webhook,omitempty"`
+	Delivery  *WebhookDelivery  `json:"delivery,omitempty"`
+	// UserId and ReadPosition record how far a user has read.
+	UserId       string         `json:"userId,omitempty"`
+	ReadPosition *MessageCursor `json:"readPosition,omitempty"`
+	ApiKey       *ApiKey        `json:"apiKey,omitempty"`
+	// Deliveries are queued along with a new message.
+	Deliveries []WebhookDelivery `json:"deliveries,omitempty"`
+	// Id names what a delete entry removes.
+	Id string `json:"id,omitempty"`
+}
+
+// valid reports whether the entry carries what its op needs.
+func (e walEntry) valid() bool {
+	switch e.Op {
+	case walPut:
+		return e.Message != nil
+	case walEvent:
+		return e.Event != nil
+	case walPutWebhook:
+		return e.Webhook != nil
+	case walPutDelivery:
+		return e.Delivery != nil
+	case walPutReadPosition:
+		return e.UserId != "" && e.ReadPosition != nil
+	case walPutApiKey:
+		return e.ApiKey != nil
+	case walDeleteWebhook, walDeleteDelivery, walDeleteApiKey:
+		return e.Id != ""
+	default:
+		return false
+	}
+}
+
+// durableLog persists an inMemoryMessageRepository to a directory as a snapshot plus a write-ahead log of every change
+// made since that snapshot was taken.
+type durableLog struct {
+	dir     string
+	wal     *os.File
+	walSize int64
+	// failed is set when a failed append could not be rolled back, after which nothing more is appended so that no
+	// entry is written after a torn one and then lost on recovery.
+	failed error
+}
+
+func openDurableLog(dir string) (*durableLog, error) {
+	err := os.MkdirAll(dir, 0o700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &durableLog{dir: dir}, nil
+}
+
+func (dl *durableLog) path(name string) string {
+	return filepath.Join(dl.dir, name)
+}
+
+// recover replays the snapshot and then the write-ahead log through apply, and opens the write-ahead log for
+// appending. A partially written entry at the end of the log, left by a crash mid append, is discarded.
+func (dl *durableLog) recover(apply func(walEntry)) error {
+	snapshot, err := os.Open(dl.path(snapshotFileName))
+
+	if err == nil {
+		_, err = replayEntries(snapshot, apply)
+		_ = snapshot.Close()
+
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	wal, err := os.OpenFile(dl.path(walFileName), os.O_RDWR|os.O_CREATE, 0o600)
+
+	if err != nil {
+		return err
+	}
+
+	good, err := replayEntries(wal, apply)
+
+	if err != nil {
+		log.Printf("discarding corrupt write-ahead log entries after byte %d: %s", good, err)
+	}
+
+	err = wal.Truncate(good)
+
+	if err == nil {
+		_, err = wal.Seek(good, io.SeekStart)
+	}
+
+	if err != nil {
+		_ = wal.Close()
+		return err
+	}
+
+	dl.wal = wal
+	dl.walSize = good
+
+	return nil
+}
+
+// replayEntries applies each complete entry read from reader, returning the number of bytes consumed by them.
+func replayEntries(reader io.Reader, apply func(walEntry)) (int64, error) {
+	buffered := bufio.NewReader(reader)
+	var consumed int64
+
+	for {
+		line, err := buffered.ReadBytes('\n')
+
+		if err == io.EOF && len(line) == 0 {
+			return consumed, nil
+		} else if err == io.EOF {
+			return consumed, errors.New("incomplete entry")
+		} else if err != nil {
+			return consumed, err
+		}
+
+		var entry walEntry
+		err = json.Unmarshal(line, &entry)
+
+		if err != nil {
+			return consumed, err
+		}
+
+		if !entry.valid() {
+			return consumed, errors.New("unknown entry")
+		}
+
+		apply(entry)
+		consumed += int64(len(line))
+	}
+}
+
+// append durably records an entry. It must be called with the repository's write lock held so that entries are logged
+// in the order they are applied.
+func (dl *durableLog) append(entry walEntry) error {
+	if dl.failed != nil {
+		return dl.failed
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	_, err = dl.wal.Write(line)
+
+	if err == nil {
+		err = dl.wal.Sync()
+	}
+
+	if err != nil {
+		dl.rollback(err)
+		return err
+	}
+
+	dl.walSize += int64(len(line))
+
+	return nil
+}
+
+// rollback discards whatever part of a failed append reached the write-ahead log. If it cannot, the log is marked
+// failed.
+func (dl *durableLog) rollback(cause error) {
+	err := dl.wal.Truncate(dl.walSize)
+
+	if err == nil {
+		_, err = dl.wal.Seek(dl.walSize, io.SeekStart)
+	}
+
+	if err != nil {
+		log.Printf("write-ahead log could not be rolled back after %s: %s", cause, err)
+		dl.failed = errors.New("write-ahead log failed: " + cause.Error())
+	}
+}
+
+// writeSnapshot atomically replaces the snapshot with the given entries.
+func (dl *durableLog) writeSnapshot(entries []walEntry) error {
+	tmp, err := os.CreateTemp(dl.dir, snapshotFileName+".*")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return dl.replace(tmp.Name(), snapshotFileName)
+}
+
+// compact drops the first offset bytes of the write-ahead log, which a snapshot now covers. It must be called with the
+// repository's write lock held.
+func (dl *durableLog) compact(offset int64) error {
+	tmp, err := os.CreateTemp(dl.dir, walFileName+".*")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = dl.wal.Seek(offset, io.SeekStart)
+
+	if err == nil {
+		_, err = io.Copy(tmp, dl.wal)
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err != nil {
+		_ = tmp.Close()
+		_, _ = dl.wal.Seek(0, io.SeekEnd)
+		return err
+	}
+
+	err = dl.replace(tmp.Name(), walFileName)
+
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	_ = dl.wal.Close()
+	dl.wal = tmp
+	dl.walSize -= offset
+
+	return nil
+}
+
+// replace renames the file at tmpPath over the named file and syncs the directory so that the rename survives a crash.
+func (dl *durableLog) replace(tmpPath, name string) error {
+	err := os.Rename(tmpPath, dl.path(name))
+
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dl.dir)
+
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+
+	return dirFile.Sync()
+}
+
+func (dl *durableLog) close() error {
+	return dl.wal.Close()
+}
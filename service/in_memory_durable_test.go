@@ -0,0 +1,272 @@
+package service_test
+
+import (
+	"context"
+	"github.com/stone1549/yapyapyap/message/service"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const dataDirKey = "MESSAGE_SERVICE_DATA_DIR"
+
+func makeDurableRepo(tb testing.TB) service.MessageRepository {
+	config, err := service.GetConfiguration()
+	ok(tb, err)
+
+	repo, err := service.MakeInMemoryRepository(config)
+	ok(tb, err)
+
+	return repo
+}
+
+func addMessages(tb testing.TB, repo service.MessageRepository, count int) []service.StoredMessage {
+	stored := make([]service.StoredMessage, 0, count)
+
+	for i := 0; i < count; i++ {
+		msg, _, err := repo.AddMessage(context.Background(), service.Message{
+			Sender:   service.Sender{Id: "1", Username: "someone"},
+			Content:  "hello",
+			Location: service.Location{Lat: 40.0, Long: -105.0},
+		})
+		ok(tb, err)
+		stored = append(stored, msg)
+	}
+
+	return stored
+}
+
+func assertStored(tb testing.TB, repo service.MessageRepository, expected []service.StoredMessage) {
+	for _, msg := range expected {
+		found, err := repo.GetMessage(context.Background(), msg.Id)
+		ok(tb, err)
+		equals(tb, msg.Id, found.Id)
+		equals(tb, true, msg.CreatedAt.Equal(found.CreatedAt))
+	}
+
+	messages, err := repo.GetMessagesForLocation(context.Background(), service.Location{Lat: 40.0, Long: -105.0},
+		100, 1000, service.MessagePage{})
+	ok(tb, err)
+	equals(tb, len(expected), len(messages))
+}
+
+// assertSurvivesRestart runs setup against a new durable repository, then runs check against the state recovered from
+// its write-ahead log alone, as after a crash, and against the state recovered from the snapshot written when it was
+// closed. Every repository is closed before the next one is opened.
+func assertSurvivesRestart(tb testing.TB, setup func(repo service.MessageRepository),
+	check func(repo service.MessageRepository)) {
+	dir := tb.TempDir()
+	crashed := tb.TempDir()
+	tb.Setenv(dataDirKey, dir)
+
+	repo := makeDurableRepo(tb)
+	setup(repo)
+	copyDir(tb, dir, crashed)
+	ok(tb, repo.(io.Closer).Close())
+
+	for _, recovered := range []string{crashed, dir} {
+		tb.Setenv(dataDirKey, recovered)
+		repo = makeDurableRepo(tb)
+		check(repo)
+		ok(tb, repo.(io.Closer).Close())
+	}
+}
+
+// copyDir copies the files in src to dst.
+func copyDir(tb testing.TB, src string, dst string) {
+	entries, err := os.ReadDir(src)
+	ok(tb, err)
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		ok(tb, err)
+		ok(tb, os.WriteFile(filepath.Join(dst, entry.Name()), data, 0o600))
+	}
+}
+
+// TestInMemoryDurable_RecoverFromWal ensures that messages survive a restart without a clean shutdown.
+func TestInMemoryDurable_RecoverFromWal(t *testing.T) {
+	t.Setenv(dataDirKey, t.TempDir())
+
+	stored := addMessages(t, makeDurableRepo(t), 3)
+	assertStored(t, makeDurableRepo(t), stored)
+}
+
+// TestInMemoryDurable_RecoverFromSnapshotAndWal ensures that messages in a snapshot and messages logged after it are
+// both recovered.
+func TestInMemoryDurable_RecoverFromSnapshotAndWal(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(dataDirKey, dir)
+
+	repo := makeDurableRepo(t)
+	stored := addMessages(t, repo, 3)
+	ok(t, repo.(io.Closer).Close())
+
+	wal, err := os.Stat(filepath.Join(dir, "messages.wal"))
+	ok(t, err)
+	equals(t, int64(0), wal.Size())
+
+	stored = append(stored, addMessages(t, makeDurableRepo(t), 2)...)
+	assertStored(t, makeDurableRepo(t), stored)
+}
+
+// TestInMemoryDurable_TornWalEntry ensures that a partially written entry left by a crash is discarded and later
+// entries are still recovered.
+func TestInMemoryDurable_TornWalEntry(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(dataDirKey, dir)
+
+	stored := addMessages(t, makeDurableRepo(t), 2)
+
+	wal, err := os.OpenFile(filepath.Join(dir, "messages.wal"), os.O_APPEND|os.O_WRONLY, 0o600)
+	ok(t, err)
+	_, err = wal.WriteString(`{"op":"put","message":{"id":"torn"`)
+	ok(t, err)
+	ok(t, wal.Close())
+
+	stored = append(stored, addMessages(t, makeDurableRepo(t), 1)...)
+	assertStored(t, makeDurableRepo(t), stored)
+}
+
+// TestInMemoryDurable_CloseTwice ensures that closing a repository again does nothing more than the first close.
+func TestInMemoryDurable_CloseTwice(t *testing.T) {
+	t.Setenv(dataDirKey, t.TempDir())
+
+	repo := makeDurableRepo(t)
+	stored := addMessages(t, repo, 2)
+	ok(t, repo.(io.Closer).Close())
+	ok(t, repo.(io.Closer).Close())
+
+	assertStored(t, makeDurableRepo(t), stored)
+}
+
+// TestInMemoryDurable_RecoverRevisions ensures that the revisions of edited messages are recovered from both the
+// write-ahead log and a snapshot.
+func TestInMemoryDurable_RecoverRevisions(t *testing.T) {
+	ctx := context.Background()
+	var stored service.StoredMessage
+	var expected []service.MessageRevision
+
+	assertSurvivesRestart(t, func(repo service.MessageRepository) {
+		stored = addMessages(t, repo, 1)[0]
+		_, err := repo.EditMessage(ctx, stored.Id, "edited")
+		ok(t, err)
+
+		expected, err = repo.GetRevisions(ctx, stored.Id)
+		ok(t, err)
+		equals(t, 1, len(expected))
+	}, func(repo service.MessageRepository) {
+		revisions, err := repo.GetRevisions(ctx, stored.Id)
+		ok(t, err)
+		equals(t, expected, revisions)
+	})
+}
+
+// TestInMemoryDurable_RecoverWebhooks ensures that webhooks and their queued deliveries are recovered from both the
+// write-ahead log and a snapshot, and that deleting a webhook is recovered too.
+func TestInMemoryDurable_RecoverWebhooks(t *testing.T) {
+	ctx := context.Background()
+	var kept service.Webhook
+
+	assertSurvivesRestart(t, func(repo service.MessageRepository) {
+		kept = queueDelivery(t, repo, "https://example.com/kept")
+		removed := queueDelivery(t, repo, "https://example.com/removed")
+		webhooks, err := service.NewWebhookRepository(repo)
+		ok(t, err)
+		ok(t, webhooks.DeleteWebhook(ctx, removed.Id))
+	}, func(repo service.MessageRepository) {
+		webhooks, err := service.NewWebhookRepository(repo)
+		ok(t, err)
+
+		registered, err := webhooks.GetWebhooks(ctx)
+		ok(t, err)
+		equals(t, []service.Webhook{kept}, registered)
+
+		// Both messages fall inside the kept webhook's area. Leases are not recovered, so its deliveries are due again
+		// after every restart.
+		due, err := webhooks.ClaimDeliveries(ctx, time.Now(), time.Minute, 10)
+		ok(t, err)
+		equals(t, 2, len(due))
+
+		for _, delivery := range due {
+			equals(t, kept.Id, delivery.WebhookId)
+		}
+	})
+}
+
+// TestInMemoryDurable_RecoverEvents ensures that the event log is recovered from both the write-ahead log and a
+// snapshot, without repeating events, and that numbering continues after the last recovered event.
+func TestInMemoryDurable_RecoverEvents(t *testing.T) {
+	ctx := context.Background()
+	var stored []service.StoredMessage
+	var expected []service.MessageEvent
+
+	assertSurvivesRestart(t, func(repo service.MessageRepository) {
+		stored = addMessages(t, repo, 2)
+		_, err := repo.EditMessage(ctx, stored[0].Id, "edited")
+		ok(t, err)
+
+		expected, err = repo.GetEvents(ctx, 1, 100)
+		ok(t, err)
+		equals(t, 3, len(expected))
+	}, func(repo service.MessageRepository) {
+		events, err := repo.GetEvents(ctx, 1, 100)
+		ok(t, err)
+		equals(t, expected, events)
+
+		_, err = repo.DeleteMessage(ctx, stored[1].Id)
+		ok(t, err)
+
+		events, err = repo.GetEvents(ctx, 4, 100)
+		ok(t, err)
+		equals(t, 1, len(events))
+		equals(t, int64(4), events[0].Seq)
+		equals(t, service.MessageDeletedEvent, events[0].Type)
+	})
+}
+
+// TestInMemoryDurable_RecoverReadPositions ensures that read positions survive a restart, whether recovered from the
+// write-ahead log or from a snapshot.
+func TestInMemoryDurable_RecoverReadPositions(t *testing.T) {
+	ctx := context.Background()
+	var read service.MessageCursor
+
+	assertSurvivesRestart(t, func(repo service.MessageRepository) {
+		stored := addMessages(t, repo, 2)
+		var err error
+		read, err = repo.MarkRead(ctx, "reader", service.CursorFor(stored[1]))
+		ok(t, err)
+	}, func(repo service.MessageRepository) {
+		position, err := repo.GetReadPosition(ctx, "reader")
+		ok(t, err)
+		equals(t, &read, position)
+	})
+}
+
+// TestInMemoryDurable_RecoverApiKeys ensures that API keys, and their revocation, survive a restart.
+func TestInMemoryDurable_RecoverApiKeys(t *testing.T) {
+	ctx := context.Background()
+	var kept service.ApiKey
+
+	assertSurvivesRestart(t, func(repo service.MessageRepository) {
+		keys, err := service.NewApiKeyRepository(repo)
+		ok(t, err)
+
+		kept, err = keys.AddApiKey(ctx, service.ApiKey{Hash: "kept",
+			Service: service.Sender{Id: "service:bot", Username: "Bot"}, Scopes: []string{service.ScopeMessagesRead}})
+		ok(t, err)
+		revoked, err := keys.AddApiKey(ctx, service.ApiKey{Hash: "revoked",
+			Service: service.Sender{Id: "service:bot", Username: "Bot"}, Scopes: []string{service.ScopeMessagesRead}})
+		ok(t, err)
+		ok(t, keys.DeleteApiKey(ctx, revoked.Id))
+	}, func(repo service.MessageRepository) {
+		keys, err := service.NewApiKeyRepository(repo)
+		ok(t, err)
+
+		stored, err := keys.GetApiKeys(ctx)
+		ok(t, err)
+		equals(t, []service.ApiKey{kept}, stored)
+	})
+}
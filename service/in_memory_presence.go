@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Heartbeats are not logged, after a restart users are simply shown as active again once they next send one.
+func (imr *inMemoryMessageRepository) Heartbeat(ctx context.Context, presence Presence) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	imr.presenceById[presence.Sender.Id] = &presence
+
+	return nil
+}
+
+func (imr *inMemoryMessageRepository) GetPresence(ctx context.Context, location Location, radiusMeters float64,
+	activeSince time.Time) ([]Presence, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	nearby := make([]Presence, 0)
+
+	for _, presence := range imr.presenceById {
+		if presence.LastSeenAt.After(activeSince) && distance(location, presence.Location) <= radiusMeters {
+			nearby = append(nearby, *presence)
+		}
+	}
+
+	sortPresence(nearby)
+
+	return nearby, nil
+}
+
+func (imr *inMemoryMessageRepository) ExpirePresence(ctx context.Context, activeSince time.Time) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	for id, presence := range imr.presenceById {
+		if !presence.LastSeenAt.After(activeSince) {
+			delete(imr.presenceById, id)
+		}
+	}
+
+	return nil
+}
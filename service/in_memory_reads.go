@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+)
+
+func (imr *inMemoryMessageRepository) MarkRead(ctx context.Context, userId string,
+	position MessageCursor) (MessageCursor, error) {
+	if ctx.Err() != nil {
+		return MessageCursor{}, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	if existing, found := imr.readPositions[userId]; found && !existing.Less(position) {
+		return existing, nil
+	}
+
+	err := imr.log(walEntry{Op: walPutReadPosition, UserId: userId, ReadPosition: &position})
+
+	if err != nil {
+		return MessageCursor{}, err
+	}
+
+	imr.readPositions[userId] = position
+
+	return position, nil
+}
+
+func (imr *inMemoryMessageRepository) GetReadPosition(ctx context.Context, userId string) (*MessageCursor, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	position, found := imr.readPositions[userId]
+
+	if !found {
+		return nil, nil
+	}
+
+	return &position, nil
+}
+
+func (imr *inMemoryMessageRepository) CountUnread(ctx context.Context, userId string, location Location,
+	radiusMeters float64) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	page := MessagePage{}
+
+	if position, found := imr.readPositions[userId]; found {
+		page = MessagePage{Cursor: &position, Direction: NewerPage}
+	}
+
+	count := 0
+
+	// Counted messages are never collected, so the query visits every message past the read position.
+	_, err := imr.index.query(ctx, location, radiusMeters, 1, page, func(msg *StoredMessage) bool {
+		if msg.DeletedAt == nil && msg.Sender.Id != userId && distance(location, msg.Location) <= radiusMeters {
+			count++
+		}
+
+		return false
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,170 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stone1549/yapyapyap/message/service"
+	"math/rand"
+	"testing"
+)
+
+func makeInMemoryRepo(tb testing.TB) service.MessageRepository {
+	repo, err := service.MakeInMemoryRepository(nil)
+	ok(tb, err)
+
+	return repo
+}
+
+// TestInMemory_AddGetSuccess ensures that a stored message can be retrieved by id.
+func TestInMemory_AddGetSuccess(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	ctx := context.Background()
+
+	stored, _, err := repo.AddMessage(ctx, service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: service.Location{Lat: 40.0, Long: -105.0},
+	})
+	ok(t, err)
+
+	msg, err := repo.GetMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, stored, msg)
+}
+
+// TestInMemory_GetMessagesForLocationCancelled ensures that a cancelled context aborts a location scan.
+func TestInMemory_GetMessagesForLocationCancelled(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	_, _, err := repo.AddMessage(context.Background(), service.Message{Location: service.Location{Lat: 40.0, Long: -105.0}})
+	ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = repo.GetMessagesForLocation(ctx, service.Location{Lat: 40.0, Long: -105.0}, 100, 10,
+		service.MessagePage{})
+	equals(t, true, errors.Is(err, context.Canceled))
+}
+
+// TestInMemory_AddMessageCancelled ensures that nothing is stored once the context has been cancelled.
+func TestInMemory_AddMessageCancelled(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := repo.AddMessage(ctx, service.Message{Content: "hello"})
+	notOk(t, err)
+}
+
+// TestInMemory_GetMessagesForLocationPaging ensures that paging in both directions visits every message exactly once
+// in newest first order.
+func TestInMemory_GetMessagesForLocationPaging(t *testing.T) {
+	testGetMessagesForLocationPaging(t, makeInMemoryRepo)
+}
+
+// TestInMemory_GetMessagesForLocationRadius ensures that only messages inside the radius are returned.
+func TestInMemory_GetMessagesForLocationRadius(t *testing.T) {
+	testGetMessagesForLocationRadius(t, makeInMemoryRepo)
+}
+
+var benchmarkRepos = make(map[int]service.MessageRepository)
+
+// benchmarkRepo builds an in memory repo holding 50 messages at a single location plus size messages scattered
+// across the globe, so that queries at that location return the same results however large the dataset grows.
+func benchmarkRepo(b *testing.B, size int) service.MessageRepository {
+	if repo, found := benchmarkRepos[size]; found {
+		return repo
+	}
+
+	repo := makeInMemoryRepo(b)
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < size; i++ {
+		_, _, err := repo.AddMessage(ctx, service.Message{Location: service.Location{
+			Lat:  random.Float64()*120 - 60,
+			Long: random.Float64()*360 - 180,
+		}})
+		ok(b, err)
+	}
+
+	for i := 0; i < 50; i++ {
+		_, _, err := repo.AddMessage(ctx, service.Message{Location: service.Location{Lat: 40.0, Long: -105.0}})
+		ok(b, err)
+	}
+
+	benchmarkRepos[size] = repo
+
+	return repo
+}
+
+func benchmarkGetMessagesForLocation(b *testing.B, size int) {
+	repo := benchmarkRepo(b, size)
+	ctx := context.Background()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		messages, err := repo.GetMessagesForLocation(ctx, service.Location{Lat: 40.0, Long: -105.0}, 100, 100,
+			service.MessagePage{})
+		ok(b, err)
+		equals(b, 50, len(messages))
+	}
+}
+
+func BenchmarkInMemory_GetMessagesForLocation1K(b *testing.B) {
+	benchmarkGetMessagesForLocation(b, 1000)
+}
+
+func BenchmarkInMemory_GetMessagesForLocation10K(b *testing.B) {
+	benchmarkGetMessagesForLocation(b, 10000)
+}
+
+func BenchmarkInMemory_GetMessagesForLocation100K(b *testing.B) {
+	benchmarkGetMessagesForLocation(b, 100000)
+}
+
+func BenchmarkInMemory_GetMessagesForLocation1M(b *testing.B) {
+	benchmarkGetMessagesForLocation(b, 1000000)
+}
+
+// TestInMemory_DeleteMessage ensures that deleted messages are replaced by tombstones.
+func TestInMemory_DeleteMessage(t *testing.T) {
+	testDeleteMessage(t, makeInMemoryRepo)
+}
+
+// TestInMemory_EditMessage ensures that edits keep the earlier versions of a message.
+func TestInMemory_EditMessage(t *testing.T) {
+	testEditMessage(t, makeInMemoryRepo)
+}
+
+// TestInMemory_AddMessageIdempotent ensures that retried submissions are stored once.
+func TestInMemory_AddMessageIdempotent(t *testing.T) {
+	testAddMessageIdempotent(t, makeInMemoryRepo)
+}
+
+// TestInMemory_WebhookOutbox ensures that webhook deliveries are queued, claimed, retried and dead lettered.
+func TestInMemory_WebhookOutbox(t *testing.T) {
+	testWebhookOutbox(t, makeInMemoryRepo)
+}
+
+// TestInMemory_EventLog ensures that changes to messages are logged in sequence.
+func TestInMemory_EventLog(t *testing.T) {
+	testEventLog(t, makeInMemoryRepo)
+}
+
+// TestInMemory_Presence ensures that heartbeats are found near where they were sent until they go stale.
+func TestInMemory_Presence(t *testing.T) {
+	testPresence(t, makeInMemoryRepo)
+}
+
+// TestInMemory_ReadReceipts ensures that unread messages are counted past each user's read position.
+func TestInMemory_ReadReceipts(t *testing.T) {
+	testReadReceipts(t, makeInMemoryRepo)
+}
+
+// TestInMemory_ApiKeys ensures that API keys are found by their hash until they are revoked.
+func TestInMemory_ApiKeys(t *testing.T) {
+	testApiKeys(t, makeInMemoryRepo)
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"github.com/twinj/uuid"
+	"sort"
+	"time"
+)
+
+func (imr *inMemoryMessageRepository) AddWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	if ctx.Err() != nil {
+		return Webhook{}, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	webhook.Id = uuid.NewV4().String()
+	webhook.CreatedAt = time.Now().UTC()
+	err := imr.log(walEntry{Op: walPutWebhook, Webhook: &webhook})
+
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	stored := webhook
+	imr.webhooksById[stored.Id] = &stored
+
+	return webhook, nil
+}
+
+func (imr *inMemoryMessageRepository) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	if ctx.Err() != nil {
+		return Webhook{}, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	webhook, found := imr.webhooksById[id]
+
+	if !found {
+		return Webhook{}, ErrWebhookNotFound
+	}
+
+	return *webhook, nil
+}
+
+func (imr *inMemoryMessageRepository) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(imr.webhooksById))
+
+	for _, webhook := range imr.webhooksById {
+		webhooks = append(webhooks, *webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+
+	return webhooks, nil
+}
+
+func (imr *inMemoryMessageRepository) DeleteWebhook(ctx context.Context, id string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	if _, found := imr.webhooksById[id]; !found {
+		return ErrWebhookNotFound
+	}
+
+	err := imr.log(walEntry{Op: walDeleteWebhook, Id: id})
+
+	if err != nil {
+		return err
+	}
+
+	imr.removeWebhook(id)
+
+	return nil
+}
+
+// removeWebhook drops a webhook and every delivery owed to it. The write lock must be held.
+func (imr *inMemoryMessageRepository) removeWebhook(id string) {
+	delete(imr.webhooksById, id)
+
+	for deliveryId, delivery := range imr.deliveriesById {
+		if delivery.WebhookId == id {
+			delete(imr.deliveriesById, deliveryId)
+			delete(imr.leasedUntil, deliveryId)
+		}
+	}
+}
+
+// queueDeliveries builds the deliveries of a new message to the webhooks whose area contains it. The write lock must
+// be held.
+func (imr *inMemoryMessageRepository) queueDeliveries(msg StoredMessage) ([]WebhookDelivery, error) {
+	registered := make([]Webhook, 0, len(imr.webhooksById))
+
+	for _, webhook := range imr.webhooksById {
+		registered = append(registered, *webhook)
+	}
+
+	return webhookDeliveries(registered, msg)
+}
+
+func (imr *inMemoryMessageRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]WebhookDelivery, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	due := make([]WebhookDelivery, 0)
+
+	for id, delivery := range imr.deliveriesById {
+		if delivery.DeadAt == nil && !delivery.NextAttemptAt.After(now) && !imr.leasedUntil[id].After(now) {
+			due = append(due, *delivery)
+		}
+	}
+
+	sortDeliveries(due)
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	// Leases are not logged, after a restart every delivery that was in flight is simply attempted again.
+	for _, delivery := range due {
+		imr.leasedUntil[delivery.Id] = now.Add(lease)
+	}
+
+	return due, nil
+}
+
+func (imr *inMemoryMessageRepository) CompleteDelivery(ctx context.Context, id string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	if _, found := imr.deliveriesById[id]; !found {
+		return nil
+	}
+
+	err := imr.log(walEntry{Op: walDeleteDelivery, Id: id})
+
+	if err != nil {
+		return err
+	}
+
+	delete(imr.deliveriesById, id)
+	delete(imr.leasedUntil, id)
+
+	return nil
+}
+
+func (imr *inMemoryMessageRepository) FailDelivery(ctx context.Context, id string, lastError string,
+	nextAttemptAt *time.Time) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	imr.Lock()
+	defer imr.Unlock()
+
+	existing, found := imr.deliveriesById[id]
+
+	if !found {
+		return nil
+	}
+
+	delivery := existing.fail(lastError, nextAttemptAt, time.Now().UTC())
+	err := imr.log(walEntry{Op: walPutDelivery, Delivery: &delivery})
+
+	if err != nil {
+		return err
+	}
+
+	imr.deliveriesById[id] = &delivery
+	delete(imr.leasedUntil, id)
+
+	return nil
+}
+
+func (imr *inMemoryMessageRepository) GetDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	imr.RLock()
+	defer imr.RUnlock()
+
+	dead := make([]WebhookDelivery, 0)
+
+	for _, delivery := range imr.deliveriesById {
+		if delivery.DeadAt != nil {
+			dead = append(dead, *delivery)
+		}
+	}
+
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].DeadAt.Before(*dead[j].DeadAt)
+	})
+
+	return dead, nil
+}
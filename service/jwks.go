@@ -0,0 +1,256 @@
+package service
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefreshInterval limits how often a token with an unknown kid can make a key set refetch its document.
+	jwksMinRefreshInterval = 10 * time.Second
+	// jwksTimeout bounds fetching a JWKS document from a url.
+	jwksTimeout = 10 * time.Second
+	// jwksMaxSize is the largest JWKS document read.
+	jwksMaxSize = 1 << 20
+)
+
+// jwk is a single key of a JWKS document, only RSA keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwksKey is a verification key along with the algorithm it is restricted to, if any, and when it disappeared from
+// the document, if it has.
+type jwksKey struct {
+	key       *rsa.PublicKey
+	alg       string
+	retiredAt *time.Time
+}
+
+// JwksKeySet holds the verification keys of a JWKS document read from a file or url, keyed by their kid. The document
+// is refetched once it is older than the refresh interval, and keys that are removed from it stay valid for a grace
+// period so that tokens signed before a rotation are not rejected.
+type JwksKeySet struct {
+	source  string
+	client  *http.Client
+	refresh time.Duration
+	grace   time.Duration
+
+	mut        sync.Mutex
+	keys       map[string]*jwksKey
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// NewJwksKeySet constructs a JwksKeySet reading the document at source, an http or https url or a file path, and loads
+// it, failing if it cannot be.
+func NewJwksKeySet(source string, client *http.Client, refresh time.Duration, grace time.Duration) (*JwksKeySet,
+	error) {
+	ks := &JwksKeySet{
+		source:  source,
+		client:  client,
+		refresh: refresh,
+		grace:   grace,
+		keys:    make(map[string]*jwksKey),
+	}
+
+	err := ks.Refresh()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Key retrieves the key a token with the given kid and signing algorithm is verified with. A stale document is
+// refreshed in the background, an unknown kid refreshes it straight away in case the key was just added.
+func (ks *JwksKeySet) Key(kid string, alg string) (*rsa.PublicKey, error) {
+	ks.mut.Lock()
+	now := time.Now()
+
+	if now.Sub(ks.fetchedAt) >= ks.refresh && !ks.refreshing {
+		ks.refreshing = true
+		go ks.refreshInBackground()
+	}
+
+	key := ks.lookup(kid, now)
+	fetchedAt := ks.fetchedAt
+	ks.mut.Unlock()
+
+	if key == nil && now.Sub(fetchedAt) >= jwksMinRefreshInterval {
+		if err := ks.Refresh(); err != nil {
+			log.Printf("jwks: %s", err)
+		}
+
+		ks.mut.Lock()
+		key = ks.lookup(kid, time.Now())
+		ks.mut.Unlock()
+	}
+
+	if key == nil {
+		return nil, errors.New("unknown key id " + kid)
+	}
+
+	if key.alg != "" && key.alg != alg {
+		return nil, errors.New("key " + kid + " is not used with " + alg)
+	}
+
+	return key.key, nil
+}
+
+// lookup finds a key that is current, or retired within the grace period. The lock must be held.
+func (ks *JwksKeySet) lookup(kid string, now time.Time) *jwksKey {
+	key, found := ks.keys[kid]
+
+	if !found || (key.retiredAt != nil && now.Sub(*key.retiredAt) > ks.grace) {
+		return nil
+	}
+
+	return key
+}
+
+func (ks *JwksKeySet) refreshInBackground() {
+	if err := ks.Refresh(); err != nil {
+		log.Printf("jwks: %s", err)
+	}
+
+	ks.mut.Lock()
+	ks.refreshing = false
+	ks.mut.Unlock()
+}
+
+// Refresh refetches the document. Keys missing from it are retired, and dropped once their grace period is over. When
+// the document cannot be fetched the keys already held are kept.
+func (ks *JwksKeySet) Refresh() error {
+	document, err := ks.fetch()
+	now := time.Now()
+
+	ks.mut.Lock()
+	defer ks.mut.Unlock()
+
+	// Failed attempts count too, so that an unreachable source is not hammered by every request.
+	ks.fetchedAt = now
+
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*jwksKey)
+
+	for _, entry := range document.Keys {
+		if entry.Kty != "RSA" || (entry.Use != "" && entry.Use != "sig") {
+			continue
+		}
+
+		key, err := parseRsaJwk(entry)
+
+		if err != nil {
+			log.Printf("jwks: skipping key %s: %s", entry.Kid, err)
+			continue
+		}
+
+		current[entry.Kid] = &jwksKey{key: key, alg: entry.Alg}
+	}
+
+	for kid, key := range ks.keys {
+		if _, found := current[kid]; found {
+			continue
+		}
+
+		if key.retiredAt == nil {
+			retiredAt := now
+			key.retiredAt = &retiredAt
+		}
+
+		if now.Sub(*key.retiredAt) <= ks.grace {
+			current[kid] = key
+		}
+	}
+
+	ks.keys = current
+
+	return nil
+}
+
+// fetch reads and decodes the document.
+func (ks *JwksKeySet) fetch() (jwksDocument, error) {
+	var reader io.Reader
+
+	if strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://") {
+		client := &http.Client{Timeout: jwksTimeout}
+
+		if ks.client != nil {
+			client = ks.client
+		}
+
+		response, err := client.Get(ks.source)
+
+		if err != nil {
+			return jwksDocument{}, err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return jwksDocument{}, errors.New("jwks url responded " + response.Status)
+		}
+
+		reader = response.Body
+	} else {
+		file, err := os.Open(ks.source)
+
+		if err != nil {
+			return jwksDocument{}, err
+		}
+		defer file.Close()
+
+		reader = file
+	}
+
+	var document jwksDocument
+	err := json.NewDecoder(io.LimitReader(reader, jwksMaxSize)).Decode(&document)
+
+	if err != nil {
+		return jwksDocument{}, errors.New("invalid jwks document: " + err.Error())
+	}
+
+	return document, nil
+}
+
+// parseRsaJwk decodes the modulus and exponent of an RSA key.
+func parseRsaJwk(entry jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(entry.N, "="))
+
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(entry.E, "="))
+
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
@@ -0,0 +1,136 @@
+package service_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/message/service"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// makeJwks encodes the public halves of keys as a JWKS document, keyed by their kid.
+func makeJwks(tb testing.TB, keys map[string]*rsa.PrivateKey) []byte {
+	entries := make([]map[string]string, 0, len(keys))
+
+	for kid, key := range keys {
+		entries = append(entries, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	document, err := json.Marshal(map[string]interface{}{"keys": entries})
+	ok(tb, err)
+
+	return document
+}
+
+func generateRsaKey(tb testing.TB) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	ok(tb, err)
+
+	return key
+}
+
+// TestJwksKeySet_Rotation ensures that keys added to the document are picked up on refresh, and that keys removed from
+// it remain valid only for the grace period.
+func TestJwksKeySet_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	oldKey, newKey := generateRsaKey(t), generateRsaKey(t)
+	ok(t, os.WriteFile(path, makeJwks(t, map[string]*rsa.PrivateKey{"old": oldKey}), 0o600))
+
+	graceful, err := service.NewJwksKeySet(path, nil, time.Hour, time.Hour)
+	ok(t, err)
+	strict, err := service.NewJwksKeySet(path, nil, time.Hour, 0)
+	ok(t, err)
+
+	key, err := graceful.Key("old", "RS256")
+	ok(t, err)
+	equals(t, oldKey.PublicKey.N, key.N)
+
+	_, err = graceful.Key("old", "RS512")
+	notOk(t, err)
+
+	ok(t, os.WriteFile(path, makeJwks(t, map[string]*rsa.PrivateKey{"new": newKey}), 0o600))
+	ok(t, graceful.Refresh())
+	ok(t, strict.Refresh())
+
+	key, err = graceful.Key("new", "RS256")
+	ok(t, err)
+	equals(t, newKey.PublicKey.N, key.N)
+
+	_, err = graceful.Key("old", "RS256")
+	ok(t, err)
+	_, err = strict.Key("old", "RS256")
+	notOk(t, err)
+}
+
+// TestJwksKeySet_UrlKeepsKeysOnFailure ensures that a document served from a url is loaded, and that the keys already
+// held keep being used while the url fails.
+func TestJwksKeySet_UrlKeepsKeysOnFailure(t *testing.T) {
+	key := generateRsaKey(t)
+	document := makeJwks(t, map[string]*rsa.PrivateKey{"current": key})
+	var failing atomic.Bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if failing.Load() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = writer.Write(document)
+	}))
+	defer server.Close()
+
+	keySet, err := service.NewJwksKeySet(server.URL, server.Client(), time.Hour, time.Hour)
+	ok(t, err)
+
+	failing.Store(true)
+	notOk(t, keySet.Refresh())
+
+	_, err = keySet.Key("current", "RS256")
+	ok(t, err)
+}
+
+// TestJwtAuthMiddleware_Jwks ensures that tokens are verified with the key their kid names in the configured JWKS
+// document, and that tokens naming no key or an unknown one are rejected.
+func TestJwtAuthMiddleware_Jwks(t *testing.T) {
+	key := generateRsaKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	ok(t, os.WriteFile(path, makeJwks(t, map[string]*rsa.PrivateKey{"current": key}), 0o600))
+
+	t.Setenv("MESSAGE_SERVICE_TOKEN_SECRET", "")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_PRIV", "")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_PUB", "")
+	t.Setenv("MESSAGE_SERVICE_TOKEN_JWKS", path)
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, userClaims())
+
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+
+		signed, err := token.SignedString(key)
+		ok(t, err)
+
+		return signed
+	}
+
+	equals(t, http.StatusNoContent, authenticateToken(t, sign("current")))
+	equals(t, http.StatusUnauthorized, authenticateToken(t, sign("unknown")))
+	equals(t, http.StatusUnauthorized, authenticateToken(t, sign("")))
+}
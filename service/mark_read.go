@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type markReadRequest struct {
+	Cursor string `json:"cursor"`
+}
+
+func MarkReadMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		repo, ok := request.Context().Value("repo").(MessageRepository)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+			return
+		}
+
+		config, ok := request.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("config not found"))
+			return
+		}
+
+		var mrr markReadRequest
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&mrr)
+
+		if err != nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		page, err := DecodeCursor(config.GetCursorSecret(), mrr.Cursor)
+
+		if err != nil || page.Cursor == nil {
+			RenderResponse(writer, request, NewBadRequestErr("invalid cursor"))
+			return
+		}
+
+		sender := request.Context().Value("sender").(Sender)
+		_, err = repo.MarkRead(request.Context(), sender.Id, *page.Cursor)
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(writer, request, NewRepoErr(err))
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// MarkRead marks every message up to and including the position of a page cursor as read by the user asking.
+func MarkRead(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// markSeen sets Seen on each message, reporting whether the user asking, if there is one, has read it. Users have
+// always seen the messages they sent.
+func markSeen(ctx context.Context, repo MessageRepository, messages []StoredMessage) error {
+	sender, ok := ctx.Value("sender").(Sender)
+
+	if !ok {
+		return nil
+	}
+
+	position, err := repo.GetReadPosition(ctx, sender.Id)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		seen := messages[i].Sender.Id == sender.Id || (position != nil && position.Covers(messages[i]))
+		messages[i].Seen = &seen
+	}
+
+	return nil
+}
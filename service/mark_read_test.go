@@ -0,0 +1,70 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestMarkRead_SeenAndUnreadCount ensures that marking messages read up to a cursor is reflected both in the unread
+// count and in whether listed messages are reported as seen.
+func TestMarkRead_SeenAndUnreadCount(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	repo := makeInMemoryRepo(t)
+	me := service.Sender{Id: "1", Username: "me"}
+	stored, _, err := repo.AddMessage(context.Background(), service.Message{Sender: service.Sender{Id: "2"},
+		Content: "hello", Location: service.Location{Lat: 40.0, Long: -105.0}})
+	ok(t, err)
+
+	router := chi.NewRouter()
+	router.With(service.GetMessagesMiddleware).Get("/messages", service.GetMessages)
+	router.With(service.GetUnreadCountMiddleware).Get("/messages/unread-count", service.GetUnreadCount)
+	router.With(service.MarkReadMiddleware).Put("/messages/read", service.MarkRead)
+	handler := withValues(router, map[string]interface{}{"repo": repo, "config": config, "sender": me})
+
+	check := func(seen bool, unread int) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/messages?lat=40&long=-105", nil))
+		equals(t, http.StatusOK, recorder.Code)
+
+		var messages []service.StoredMessage
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+		equals(t, 1, len(messages))
+		equals(t, &seen, messages[0].Seen)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/messages/unread-count?lat=40&long=-105",
+			nil))
+		equals(t, http.StatusOK, recorder.Code)
+
+		var response service.GetUnreadCountResponse
+		ok(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		equals(t, unread, response.Count)
+	}
+
+	check(false, 1)
+
+	cursor := service.CursorFor(stored)
+	body, err := json.Marshal(map[string]string{
+		"cursor": service.EncodeCursor(config.GetCursorSecret(), service.MessagePage{Cursor: &cursor}),
+	})
+	ok(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/messages/read", bytes.NewReader(body)))
+	equals(t, http.StatusNoContent, recorder.Code)
+
+	check(true, 0)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/messages/read",
+		bytes.NewReader([]byte(`{"cursor": "forged"}`))))
+	equals(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	createSchemaVersion = "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now())"
+	schemaVersionExists = "SELECT to_regclass('schema_version') IS NOT NULL"
+	selectSchemaVersion = "SELECT version, applied_at FROM schema_version"
+	insertSchemaVersion = "INSERT INTO schema_version (version, name) VALUES ($1, $2)"
+	// The advisory lock key is arbitrary, holding it stops replicas from migrating concurrently.
+	lockMigrations   = "SELECT pg_advisory_lock(7306150113)"
+	unlockMigrations = "SELECT pg_advisory_unlock(7306150113)"
+
+	postgresqlMigrationsDir = "migrations/postgresql"
+)
+
+//go:embed migrations/postgresql/*.sql
+var postgresqlMigrations embed.FS
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+// MigrationStatus reports whether a Migration has been applied to a database, AppliedAt is nil if it has not.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// PostgresqlMigrations retrieves the migrations embedded for the PostgreSQL repository, ordered by version. Each is
+// read from a file named <version>_<name>.sql.
+func PostgresqlMigrations() ([]Migration, error) {
+	entries, err := postgresqlMigrations.ReadDir(postgresqlMigrationsDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+		parts := strings.SplitN(strings.TrimSuffix(fileName, ".sql"), "_", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", fileName)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", fileName, err)
+		}
+
+		contents, err := postgresqlMigrations.ReadFile(path.Join(postgresqlMigrationsDir, fileName))
+
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], Sql: string(contents)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// PostgresqlMigrationStatus reports which embedded migrations have been applied to db.
+func PostgresqlMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := PostgresqlMigrations()
+
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// appliedMigrations retrieves when each applied migration version was applied, without creating the schema_version
+// table if it does not exist yet.
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+
+	var exists bool
+	err := db.QueryRowContext(ctx, schemaVersionExists).Scan(&exists)
+
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := db.QueryContext(ctx, selectSchemaVersion)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// MigratePostgresql applies every embedded migration that db has not seen yet, in version order and each in its own
+// transaction, describing its progress to out. With dryRun set the pending migrations are described but not applied.
+// Returns the migrations that were, or with dryRun would have been, applied.
+func MigratePostgresql(ctx context.Context, db *sql.DB, dryRun bool, out io.Writer) ([]Migration, error) {
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, lockMigrations)
+
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), unlockMigrations)
+
+	statuses, err := PostgresqlMigrationStatus(ctx, db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+
+	if len(pending) == 0 {
+		_, _ = fmt.Fprintln(out, "schema is up to date")
+		return pending, nil
+	}
+
+	if !dryRun {
+		_, err = conn.ExecContext(ctx, createSchemaVersion)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, migration := range pending {
+		if dryRun {
+			_, _ = fmt.Fprintf(out, "would apply %04d_%s:\n%s\n", migration.Version, migration.Name, migration.Sql)
+			continue
+		}
+
+		err = applyMigration(ctx, conn, migration)
+
+		if err != nil {
+			return nil, fmt.Errorf("applying migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, _ = fmt.Fprintf(out, "applied %04d_%s\n", migration.Version, migration.Name)
+	}
+
+	return pending, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migration.Sql)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, insertSchemaVersion, migration.Version, migration.Name)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,20 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/message/service"
+	"strings"
+	"testing"
+)
+
+// TestPostgresqlMigrations_Ordered ensures that the embedded migrations are numbered consecutively from 1 and none
+// are empty.
+func TestPostgresqlMigrations_Ordered(t *testing.T) {
+	migrations, err := service.PostgresqlMigrations()
+	ok(t, err)
+	equals(t, true, len(migrations) > 0)
+
+	for i, migration := range migrations {
+		equals(t, i+1, migration.Version)
+		equals(t, true, strings.TrimSpace(migration.Sql) != "")
+	}
+}
@@ -0,0 +1,5 @@
+-- login is owned by the auth service, it is only created here so that the message service can stand alone.
+CREATE TABLE IF NOT EXISTS login (
+    id       TEXT PRIMARY KEY,
+    username TEXT NOT NULL
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS message (
+    id          UUID PRIMARY KEY,
+    user_id     TEXT                     NOT NULL,
+    content     TEXT                     NOT NULL,
+    location    GEOMETRY(Point)          NOT NULL,
+    client_id   TEXT                     NOT NULL DEFAULT '',
+    sent_at     TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS message_location_idx ON message USING GIST (location);
+CREATE INDEX IF NOT EXISTS message_created_at_idx ON message (created_at, (id::text COLLATE "C"));
+CREATE INDEX IF NOT EXISTS message_user_id_idx ON message (user_id);
@@ -0,0 +1,10 @@
+ALTER TABLE message ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE message ADD COLUMN IF NOT EXISTS revision_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS message_revision (
+    message_id UUID                     NOT NULL REFERENCES message (id) ON DELETE CASCADE,
+    revision   INTEGER                  NOT NULL,
+    content    TEXT                     NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (message_id, revision)
+);
@@ -0,0 +1,11 @@
+-- Messages stored twice before client ids were enforced keep the id on their earliest copy only.
+UPDATE message m
+SET client_id = ''
+WHERE m.client_id <> ''
+  AND EXISTS (SELECT 1
+              FROM message e
+              WHERE e.user_id = m.user_id
+                AND e.client_id = m.client_id
+                AND (e.created_at, e.id::text) < (m.created_at, m.id::text));
+
+CREATE UNIQUE INDEX IF NOT EXISTS message_client_key_idx ON message (user_id, client_id) WHERE client_id <> '';
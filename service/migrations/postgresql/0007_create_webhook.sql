@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS webhook (
+    id         UUID PRIMARY KEY,
+    url        TEXT                     NOT NULL,
+    secret     TEXT                     NOT NULL,
+    center     JSONB,
+    radius     DOUBLE PRECISION         NOT NULL DEFAULT 0,
+    polygon    JSONB,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id              UUID PRIMARY KEY,
+    webhook_id      UUID                     NOT NULL REFERENCES webhook (id) ON DELETE CASCADE,
+    message_id      UUID                     NOT NULL,
+    payload         JSONB                    NOT NULL,
+    attempts        INTEGER                  NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    leased_until    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '-infinity',
+    last_error      TEXT                     NOT NULL DEFAULT '',
+    dead_at         TIMESTAMP WITH TIME ZONE,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON webhook_delivery (next_attempt_at) WHERE dead_at IS NULL;
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook_id_idx ON webhook_delivery (webhook_id);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS message_event (
+    seq        BIGSERIAL PRIMARY KEY,
+    type       TEXT                     NOT NULL,
+    message    JSONB                    NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
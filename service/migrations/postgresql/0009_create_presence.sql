@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS presence (
+    user_id      TEXT PRIMARY KEY,
+    username     TEXT                     NOT NULL,
+    location     GEOMETRY(Point)          NOT NULL,
+    visible      BOOLEAN                  NOT NULL,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS presence_location_idx ON presence USING GIST (location);
+CREATE INDEX IF NOT EXISTS presence_last_seen_at_idx ON presence (last_seen_at);
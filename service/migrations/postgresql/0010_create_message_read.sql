@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS message_read (
+    user_id    TEXT PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    message_id TEXT                     NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_key (
+    id               UUID PRIMARY KEY,
+    hash             TEXT                     NOT NULL UNIQUE,
+    service_id       TEXT                     NOT NULL,
+    service_username TEXT                     NOT NULL,
+    scopes           TEXT[]                   NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL
+);
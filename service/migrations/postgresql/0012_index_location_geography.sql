@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS message_location_idx;
+DROP INDEX IF EXISTS presence_location_idx;
+
+CREATE INDEX IF NOT EXISTS message_location_geography_idx ON message USING GIST ((location::geography));
+CREATE INDEX IF NOT EXISTS presence_location_geography_idx ON presence USING GIST ((location::geography));
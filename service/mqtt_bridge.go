@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/twinj/uuid"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MqttMessagesTopic prefixes the topics new messages are published to, a message is published to
+	// "messages/<g1>/<g2>/.../<g6>" where g1 through g6 are the characters of its location's geohash. Devices subscribe
+	// to the area around them with a wildcard such as "messages/9/x/j/#".
+	MqttMessagesTopic = "messages"
+	// MqttIngestTopic is where devices publish messages to be stored. It is kept apart from MqttMessagesTopic so that
+	// the tokens submissions carry never reach the devices subscribed to messages.
+	MqttIngestTopic = "ingest/messages"
+
+	// mqttGeohashPrecision is how many geohash characters a message's topic is made of.
+	mqttGeohashPrecision = 6
+	// mqttTimeout bounds connecting to the broker, publishing and storing a submission.
+	mqttTimeout = 10 * time.Second
+	// mqttQos is the quality of service messages are published and ingested at, at least once.
+	mqttQos = 1
+)
+
+// MqttTopic is the topic a message at location is published to.
+func MqttTopic(location Location) string {
+	geohash := EncodeGeohash(location, mqttGeohashPrecision)
+
+	return MqttMessagesTopic + "/" + strings.Join(strings.Split(geohash, ""), "/")
+}
+
+// MqttIngestRequest is the JSON payload a device publishes to MqttIngestTopic to store a message. Token is a bearer
+// token, validated just as it is on the Authorization header of an HTTP request.
+type MqttIngestRequest struct {
+	Token    string   `json:"token"`
+	Content  string   `json:"content"`
+	Location Location `json:"location"`
+	ClientId string   `json:"clientId"`
+}
+
+// MqttBridge publishes new messages to an MQTT broker and stores the messages devices submit through it.
+type MqttBridge struct {
+	client mqtt.Client
+	config Configuration
+	mut    sync.Mutex
+	// repo is where submissions are stored, nothing is ingested until it is set by Ingest.
+	repo MessageRepository
+}
+
+// MakeMqttBridge connects to the MQTT broker at brokerUrl, a username and password may be given in the url.
+// Submissions are authenticated according to config.
+func MakeMqttBridge(brokerUrl *url.URL, config Configuration) (*MqttBridge, error) {
+	bridge := &MqttBridge{config: config}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(brokerUrl.String()).
+		SetClientID("message-service-" + uuid.NewV4().String()).
+		SetAutoReconnect(true).
+		// Submissions are stored, and so published back to the broker, from the handler, which may not wait on the
+		// broker unless handlers run apart from the client's router.
+		SetOrderMatters(false).
+		// The broker forgets the ingest subscription whenever the connection drops, so it is renewed on every connect.
+		SetOnConnectHandler(func(client mqtt.Client) {
+			if err := bridge.subscribe(); err != nil {
+				log.Printf("mqtt bridge: %s", err)
+			}
+		})
+
+	bridge.client = mqtt.NewClient(options)
+	token := bridge.client.Connect()
+
+	if !token.WaitTimeout(mqttTimeout) {
+		bridge.client.Disconnect(0)
+		return nil, errors.New("timed out connecting to mqtt broker " + brokerUrl.Redacted())
+	}
+
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return bridge, nil
+}
+
+// Publish publishes a message to the topic for its location.
+func (mb *MqttBridge) Publish(ctx context.Context, msg StoredMessage) error {
+	payload, err := json.Marshal(msg)
+
+	if err != nil {
+		return err
+	}
+
+	token := mb.client.Publish(MqttTopic(msg.Location), mqttQos, false, payload)
+
+	return waitMqtt(ctx, token)
+}
+
+// Ingest starts storing the messages devices publish to MqttIngestTopic in repo. Submissions that cannot be
+// authenticated or stored are logged and dropped.
+func (mb *MqttBridge) Ingest(repo MessageRepository) error {
+	mb.mut.Lock()
+	mb.repo = repo
+	mb.mut.Unlock()
+
+	return mb.subscribe()
+}
+
+// subscribe subscribes to MqttIngestTopic, if Ingest has been called.
+func (mb *MqttBridge) subscribe() error {
+	mb.mut.Lock()
+	repo := mb.repo
+	mb.mut.Unlock()
+
+	if repo == nil {
+		return nil
+	}
+
+	token := mb.client.Subscribe(MqttIngestTopic, mqttQos, func(_ mqtt.Client, message mqtt.Message) {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+		defer cancel()
+
+		if err := mb.ingest(ctx, repo, message.Payload()); err != nil {
+			log.Printf("mqtt bridge: rejected submission: %s", err)
+		}
+	})
+
+	return waitMqtt(context.Background(), token)
+}
+
+// ingest authenticates a submission and stores it, if it is a valid message.
+func (mb *MqttBridge) ingest(ctx context.Context, repo MessageRepository, payload []byte) error {
+	var request MqttIngestRequest
+	err := json.Unmarshal(payload, &request)
+
+	if err != nil {
+		return errors.New("invalid submission: " + err.Error())
+	}
+
+	sender, grants, err := authenticate(mb.config, request.Token)
+
+	if err != nil {
+		return err
+	}
+
+	if !grants.Allows(ScopeMessagesWrite) {
+		return errors.New("token lacks the " + ScopeMessagesWrite + " scope")
+	}
+
+	message := Message{
+		Sender:   sender,
+		Content:  request.Content,
+		Location: request.Location,
+		ClientId: request.ClientId,
+	}
+	err = ValidateMessage(message)
+
+	if err != nil {
+		return errors.New("invalid submission: " + err.Error())
+	}
+
+	_, _, err = repo.AddMessage(ctx, message)
+
+	return err
+}
+
+// Close disconnects from the broker.
+func (mb *MqttBridge) Close() error {
+	mb.client.Disconnect(uint(time.Second / time.Millisecond))
+
+	return nil
+}
+
+// waitMqtt waits for an operation on the broker to complete, for at most mqttTimeout.
+func waitMqtt(ctx context.Context, token mqtt.Token) error {
+	ctx, cancel := context.WithTimeout(ctx, mqttTimeout)
+	defer cancel()
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return errors.New("mqtt broker did not respond: " + ctx.Err().Error())
+	}
+}
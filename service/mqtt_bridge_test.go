@@ -0,0 +1,163 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang-jwt/jwt"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/rs/zerolog"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startMqttBroker runs an embedded MQTT broker accepting any client for the duration of the test, returning its url.
+func startMqttBroker(tb testing.TB) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(tb, err)
+	address := listener.Addr().String()
+	ok(tb, listener.Close())
+
+	logger := zerolog.Nop()
+	server := mqtt.New(&mqtt.Options{Logger: &logger})
+	ok(tb, server.AddHook(new(auth.AllowHook), nil))
+	ok(tb, server.AddListener(listeners.NewTCP("test", address, nil)))
+	ok(tb, server.Serve())
+	tb.Cleanup(func() { _ = server.Close() })
+
+	return &url.URL{Scheme: "tcp", Host: address}
+}
+
+// subscribeMqtt connects a device to the broker at brokerUrl and collects the messages published to topic.
+func subscribeMqtt(tb testing.TB, brokerUrl *url.URL, topic string) <-chan service.StoredMessage {
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(brokerUrl.String()))
+	token := client.Connect()
+	equals(tb, true, token.WaitTimeout(5*time.Second))
+	ok(tb, token.Error())
+	tb.Cleanup(func() { client.Disconnect(0) })
+
+	received := make(chan service.StoredMessage, 10)
+	token = client.Subscribe(topic, 1, func(_ paho.Client, message paho.Message) {
+		var msg service.StoredMessage
+
+		if json.Unmarshal(message.Payload(), &msg) == nil {
+			received <- msg
+		}
+	})
+	equals(tb, true, token.WaitTimeout(5*time.Second))
+	ok(tb, token.Error())
+
+	return received
+}
+
+// publishMqtt publishes a payload to topic as a device connected to the broker at brokerUrl.
+func publishMqtt(tb testing.TB, brokerUrl *url.URL, topic string, payload interface{}) {
+	encoded, err := json.Marshal(payload)
+	ok(tb, err)
+
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(brokerUrl.String()))
+	token := client.Connect()
+	equals(tb, true, token.WaitTimeout(5*time.Second))
+	ok(tb, token.Error())
+	defer client.Disconnect(250)
+
+	token = client.Publish(topic, 1, false, encoded)
+	equals(tb, true, token.WaitTimeout(5*time.Second))
+	ok(tb, token.Error())
+}
+
+// receiveMqtt waits for a message to be received.
+func receiveMqtt(tb testing.TB, received <-chan service.StoredMessage) service.StoredMessage {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		tb.Fatal("timed out waiting for mqtt message")
+		return service.StoredMessage{}
+	}
+}
+
+// TestEncodeGeohash ensures that locations are encoded to the geohash of the cell they fall in.
+func TestEncodeGeohash(t *testing.T) {
+	equals(t, "u4pruydqqvj", service.EncodeGeohash(service.Location{Lat: 57.64911, Long: 10.40744}, 11))
+	equals(t, "9q5ctq", service.EncodeGeohash(service.Location{Lat: 34.05, Long: -118.24}, 6))
+	equals(t, "messages/9/q/5/c/t/q", service.MqttTopic(service.Location{Lat: 34.05, Long: -118.24}))
+}
+
+// TestMqttBridge_PublishToGeohashTopic ensures that new messages are published to the topic for their location, where
+// devices subscribed to the surrounding area receive them.
+func TestMqttBridge_PublishToGeohashTopic(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	brokerUrl := startMqttBroker(t)
+	bridge, err := service.MakeMqttBridge(brokerUrl, config)
+	ok(t, err)
+	defer bridge.Close()
+
+	received := subscribeMqtt(t, brokerUrl, "messages/9/q/5/#")
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), bridge)
+
+	_, _, err = repo.AddMessage(context.Background(), service.Message{Content: "elsewhere",
+		Location: service.Location{Lat: 40.0, Long: -105.0}})
+	ok(t, err)
+	stored, _, err := repo.AddMessage(context.Background(), service.Message{Content: "hello",
+		Location: service.Location{Lat: 34.05, Long: -118.24}})
+	ok(t, err)
+
+	equals(t, stored.Id, receiveMqtt(t, received).Id)
+	equals(t, 0, len(received))
+}
+
+// TestMqttBridge_Ingest ensures that submissions carrying a valid token are stored as the token's user, and that
+// submissions with an invalid token or an invalid message are dropped.
+func TestMqttBridge_Ingest(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	brokerUrl := startMqttBroker(t)
+	bridge, err := service.MakeMqttBridge(brokerUrl, config)
+	ok(t, err)
+	defer bridge.Close()
+
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), bridge)
+	ok(t, bridge.Ingest(repo))
+	received := subscribeMqtt(t, brokerUrl, service.MqttMessagesTopic+"/#")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      "1",
+		"username": "someone",
+		"email":    "someone@example.com",
+	}).SignedString([]byte(config.GetTokenSecretKey()))
+	ok(t, err)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      "2",
+		"username": "mallory",
+		"email":    "mallory@example.com",
+	}).SignedString([]byte("not the secret"))
+	ok(t, err)
+
+	location := service.Location{Lat: 34.05, Long: -118.24}
+	publishMqtt(t, brokerUrl, service.MqttIngestTopic, service.MqttIngestRequest{Token: forged, Content: "forged",
+		Location: location, ClientId: "client-1"})
+	publishMqtt(t, brokerUrl, service.MqttIngestTopic, service.MqttIngestRequest{Token: token, Content: "off the map",
+		Location: service.Location{Lat: 200, Long: -118.24}, ClientId: "client-3"})
+	publishMqtt(t, brokerUrl, service.MqttIngestTopic, service.MqttIngestRequest{Token: token, Location: location,
+		ClientId: "client-4"})
+	publishMqtt(t, brokerUrl, service.MqttIngestTopic, service.MqttIngestRequest{Token: token, Content: "hello",
+		Location: location, ClientId: "client-2"})
+
+	msg := receiveMqtt(t, received)
+	equals(t, "hello", msg.Content)
+	equals(t, service.Sender{Id: "1", Username: "someone"}, msg.Sender)
+
+	stored, err := repo.GetMessage(context.Background(), msg.Id)
+	ok(t, err)
+	equals(t, "hello", stored.Content)
+	equals(t, 0, len(received))
+}
@@ -1,9 +1,12 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/paulsmith/gogeos/geos"
 	"github.com/twinj/uuid"
 	"log"
@@ -11,114 +14,467 @@ import (
 )
 
 const (
-	insertMessage  = "INSERT INTO message (id, user_id, content, location, client_id, sent_at, received_at) VALUES ($1, $2, $3, ST_GeomFromText($4), $5, $6, $7) RETURNING created_at"
-	selectMessage  = "SELECT m.id, l.id as userId, l.username, m.content, m.location, m.created_at, m.client_id, m.sent_at, m.received_at FROM message m JOIN login l on m.user_id = l.id WHERE m.id = $1"
-	selectMessages = "SELECT m.id, l.id as userId, l.username, m.content, m.location, m.created_at, m.client_id, m.sent_at, m.received_at FROM message m JOIN login l on m.user_id = l.id WHERE ST_DistanceSphere(m.location, $1) <= $2 AND m.created_at > $3 ORDER BY m.created_at LIMIT $4"
+	// A message whose client id its sender has already used inserts nothing and returns no rows.
+	insertMessage = "INSERT INTO message (id, user_id, content, location, client_id, sent_at, received_at) VALUES ($1, $2, $3, ST_GeomFromText($4), $5, $6, $7) ON CONFLICT (user_id, client_id) WHERE client_id <> '' DO NOTHING RETURNING created_at"
+	deleteMessage = "UPDATE message SET content = '', deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL"
+	editMessage   = "UPDATE message SET content = $2, edited_at = $3, revision_count = $4 WHERE id = $1"
+
+	insertRevision  = "INSERT INTO message_revision (message_id, revision, content, created_at) VALUES ($1, $2, $3, $4)"
+	selectRevisions = "SELECT revision, content, created_at FROM message_revision WHERE message_id = $1 ORDER BY revision"
+	deleteRevisions = "DELETE FROM message_revision WHERE message_id = $1"
+
+	selectMessageColumns  = "SELECT m.id, l.id as userId, l.username, m.content, m.location, m.created_at, m.client_id, m.sent_at, m.received_at, m.deleted_at, m.edited_at, m.revision_count FROM message m JOIN login l on m.user_id = l.id"
+	selectMessage         = selectMessageColumns + " WHERE m.id = $1"
+	selectMessageForEdit  = selectMessage + " FOR UPDATE OF m"
+	selectMessageByClient = selectMessageColumns + " WHERE m.user_id = $1 AND m.client_id = $2"
+
+	// login belongs to the auth service, imported senders are only added when it does not know them yet so that reads,
+	// which take usernames from login, find their messages.
+	insertLogin   = "INSERT INTO login (id, username) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING"
+	importMessage = "INSERT INTO message (id, user_id, content, location, client_id, sent_at, received_at, created_at, deleted_at, edited_at, revision_count) VALUES ($1, $2, $3, ST_GeomFromText($4), $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (id) DO NOTHING"
+	upsertMessage = "INSERT INTO message (id, user_id, content, location, client_id, sent_at, received_at, created_at, deleted_at, edited_at, revision_count) VALUES ($1, $2, $3, ST_GeomFromText($4), $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (id) DO UPDATE SET user_id = EXCLUDED.user_id, content = EXCLUDED.content, location = EXCLUDED.location, client_id = EXCLUDED.client_id, sent_at = EXCLUDED.sent_at, received_at = EXCLUDED.received_at, created_at = EXCLUDED.created_at, deleted_at = EXCLUDED.deleted_at, edited_at = EXCLUDED.edited_at, revision_count = EXCLUDED.revision_count"
+
+	// Writers of events hold eventLogLock until they commit, so events become visible in sequence order and a reader
+	// never sees an event before an earlier numbered one that is still being written.
+	lockEventLog = "SELECT pg_advisory_xact_lock($1)"
+	insertEvent  = "INSERT INTO message_event (type, message) VALUES ($1, $2)"
+	selectEvents = "SELECT seq, type, message, created_at FROM message_event WHERE seq >= $1 ORDER BY seq LIMIT $2"
+	eventLogLock = 0x6d657373616765
+
+	// Message ids are compared as text in the C collation so that ties on created_at are broken exactly as the
+	// in memory repository breaks them. Areas are matched with ST_DWithin on geographies, on a sphere as the other
+	// repositories measure distance, so that the GIST index on location::geography serves them.
+	selectLatestMessages = selectMessageColumns + " WHERE ST_DWithin(m.location::geography, $1::geography, $2, false) ORDER BY m.created_at DESC, m.id::text COLLATE \"C\" DESC LIMIT $3"
+	selectOlderMessages  = selectMessageColumns + " WHERE ST_DWithin(m.location::geography, $1::geography, $2, false) AND (m.created_at, m.id::text COLLATE \"C\") < ($3, $4) ORDER BY m.created_at DESC, m.id::text COLLATE \"C\" DESC LIMIT $5"
+	selectNewerMessages  = selectMessageColumns + " WHERE ST_DWithin(m.location::geography, $1::geography, $2, false) AND (m.created_at, m.id::text COLLATE \"C\") > ($3, $4) ORDER BY m.created_at, m.id::text COLLATE \"C\" LIMIT $5"
 )
 
 type postgresqlMessageRepository struct {
 	db *sql.DB
 }
 
-func (p *postgresqlMessageRepository) AddMessage(message Message) (StoredMessage, error) {
+func (p *postgresqlMessageRepository) AddMessage(ctx context.Context, message Message) (StoredMessage, bool, error) {
 	id := uuid.NewV4().String()
 
+	tx, err := p.db.BeginTx(ctx, nil)
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, false, ctx.Err()
+	} else if err != nil {
+		return StoredMessage{}, false, newErrRepository(err.Error())
+	}
+	defer tx.Rollback()
+
 	receivedAt := time.Now().UTC()
-	row := p.db.QueryRow(insertMessage, id, message.Sender.Id, message.Content, fmt.Sprintf("POINT (%f %f)",
+	row := tx.QueryRowContext(ctx, insertMessage, id, message.Sender.Id, message.Content, fmt.Sprintf("POINT (%f %f)",
 		message.Location.Long, message.Location.Lat), message.ClientId, message.SentAt, receivedAt)
 
 	var createdAt time.Time
-	err := row.Scan(&createdAt)
+	err = row.Scan(&createdAt)
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, false, ctx.Err()
+	} else if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		existing, err := scanPostgresqlMessage(p.db.QueryRowContext(ctx, selectMessageByClient, message.Sender.Id,
+			message.ClientId))
+
+		if ctx.Err() != nil {
+			return StoredMessage{}, false, ctx.Err()
+		} else if err != nil {
+			return StoredMessage{}, false, newErrRepository(err.Error())
+		}
+
+		return existing, false, nil
+	} else if err != nil {
+		return StoredMessage{}, false, err
+	}
+
+	msg := StoredMessage{Id: id, CreatedAt: createdAt, ReceivedAt: receivedAt, Message: message}
+	err = recordEvent(ctx, tx, MessageCreatedEvent, msg)
+
+	if err == nil {
+		err = queuePostgresqlDeliveries(ctx, tx, msg)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err != nil {
-		return StoredMessage{}, err
+		return StoredMessage{}, false, postgresqlErr(ctx, err)
 	}
 
-	return StoredMessage{id, createdAt, receivedAt, message}, nil
+	return msg, true, nil
 }
 
-func (p *postgresqlMessageRepository) GetMessage(id string) (StoredMessage, error) {
-	row := p.db.QueryRow(selectMessage, id)
+// recordEvent logs a change to a message as part of the transaction making it.
+func recordEvent(ctx context.Context, tx *sql.Tx, eventType MessageEventType, message StoredMessage) error {
+	encoded, err := json.Marshal(message)
 
-	loc := make([]byte, 0)
-	var message StoredMessage
-	err := row.Scan(&message.Id, &message.Sender.Id, &message.Sender.Username, &message.Content, &loc,
-		&message.CreatedAt, &message.ClientId, &message.SentAt, &message.ReceivedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, lockEventLog, eventLogLock)
 
-	if err == sql.ErrNoRows {
+	if err == nil {
+		_, err = tx.ExecContext(ctx, insertEvent, string(eventType), string(encoded))
+	}
+
+	return err
+}
+
+func (p *postgresqlMessageRepository) GetEvents(ctx context.Context, from int64, limit int) ([]MessageEvent, error) {
+	rows, err := p.db.QueryContext(ctx, selectEvents, from, limit)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+	defer rows.Close()
+
+	events := make([]MessageEvent, 0)
+
+	for rows.Next() {
+		var event MessageEvent
+		var message []byte
+		err = rows.Scan(&event.Seq, &event.Type, &message, &event.CreatedAt)
+
+		if err == nil {
+			err = json.Unmarshal(message, &event.Message)
+		}
+
+		if err != nil {
+			return nil, postgresqlErr(ctx, err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	return events, nil
+}
+
+func (p *postgresqlMessageRepository) GetMessage(ctx context.Context, id string) (StoredMessage, error) {
+	message, err := scanPostgresqlMessage(p.db.QueryRowContext(ctx, selectMessage, id))
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	} else if err == sql.ErrNoRows || isInvalidPostgresqlId(err) {
 		return StoredMessage{}, nil
 	} else if err != nil {
 		return StoredMessage{}, newErrRepository(err.Error())
 	}
 
+	return message, nil
+}
+
+// scanPostgresqlMessage reads a message from a row holding the columns of selectMessageColumns.
+func scanPostgresqlMessage(row rowScanner) (StoredMessage, error) {
+	loc := make([]byte, 0)
+	var deletedAt, editedAt sql.NullTime
+	var message StoredMessage
+	err := row.Scan(&message.Id, &message.Sender.Id, &message.Sender.Username, &message.Content, &loc,
+		&message.CreatedAt, &message.ClientId, &message.SentAt, &message.ReceivedAt, &deletedAt, &editedAt,
+		&message.RevisionCount)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	if deletedAt.Valid {
+		message.DeletedAt = &deletedAt.Time
+	}
+
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.Time
+	}
+
 	geom, err := geos.FromHex(string(loc))
 
 	if err != nil {
-		return StoredMessage{}, newErrRepository(err.Error())
+		return StoredMessage{}, err
 	}
 
 	message.Location.Long, err = geom.X()
 
 	if err != nil {
-		return StoredMessage{}, newErrRepository(err.Error())
+		return StoredMessage{}, err
 	}
 
 	message.Location.Lat, err = geom.Y()
 
 	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	return message, nil
+}
+
+func (p *postgresqlMessageRepository) DeleteMessage(ctx context.Context, id string) (StoredMessage, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	var result sql.Result
+
+	if err == nil {
+		defer tx.Rollback()
+
+		result, err = tx.ExecContext(ctx, deleteMessage, id, time.Now().UTC())
+	}
+
+	// Earlier revisions would otherwise keep the content the tombstone removes.
+	if err == nil {
+		_, err = tx.ExecContext(ctx, deleteRevisions, id)
+	}
+
+	var deleted int64
+
+	if err == nil {
+		deleted, err = result.RowsAffected()
+	}
+
+	// Only a message deleted now is logged, not one that was already a tombstone.
+	if err == nil && deleted > 0 {
+		var tombstone StoredMessage
+		tombstone, err = scanPostgresqlMessage(tx.QueryRowContext(ctx, selectMessage, id))
+
+		if err == nil {
+			err = recordEvent(ctx, tx, MessageDeletedEvent, tombstone)
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	} else if err != nil {
 		return StoredMessage{}, newErrRepository(err.Error())
 	}
 
+	message, err := p.GetMessage(ctx, id)
+
+	if err != nil {
+		return StoredMessage{}, err
+	} else if message.Id == "" {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+
 	return message, nil
 }
 
-func (p *postgresqlMessageRepository) GetMessagesForLocation(location Location, radiusMeters float64, limit int, after time.Time) ([]StoredMessage, error) {
-	rows, err := p.db.Query(selectMessages, fmt.Sprintf("POINT (%f %f)", location.Long, location.Lat),
-		radiusMeters, after, limit)
+func (p *postgresqlMessageRepository) EditMessage(ctx context.Context, id string, content string) (StoredMessage,
+	error) {
+	tx, err := p.db.BeginTx(ctx, nil)
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
 	} else if err != nil {
-		log.Println(err)
+		return StoredMessage{}, newErrRepository(err.Error())
+	}
+	defer tx.Rollback()
+
+	existing, err := scanPostgresqlMessage(tx.QueryRowContext(ctx, selectMessageForEdit, id))
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	} else if err == sql.ErrNoRows {
+		return StoredMessage{}, ErrMessageNotFound
+	} else if err != nil {
+		return StoredMessage{}, newErrRepository(err.Error())
+	} else if existing.DeletedAt != nil {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+
+	message, revision := existing.edit(content, time.Now().UTC())
+	_, err = tx.ExecContext(ctx, insertRevision, id, revision.Revision, revision.Content, revision.CreatedAt)
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, editMessage, id, message.Content, message.EditedAt, message.RevisionCount)
+	}
+
+	if err == nil {
+		err = recordEvent(ctx, tx, MessageEditedEvent, message)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if ctx.Err() != nil {
+		return StoredMessage{}, ctx.Err()
+	} else if err != nil {
+		return StoredMessage{}, newErrRepository(err.Error())
+	}
+
+	return message, nil
+}
+
+func (p *postgresqlMessageRepository) GetRevisions(ctx context.Context, id string) ([]MessageRevision, error) {
+	message, err := p.GetMessage(ctx, id)
+
+	if err != nil {
 		return nil, err
+	} else if message.Id == "" {
+		return nil, ErrMessageNotFound
 	}
 
-	messages := make([]StoredMessage, 0)
+	rows, err := p.db.QueryContext(ctx, selectRevisions, id)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, newErrRepository(err.Error())
+	}
+	defer rows.Close()
+
+	revisions := make([]MessageRevision, 0)
 
 	for rows.Next() {
-		loc := make([]byte, 0)
-		var message StoredMessage
-		err := rows.Scan(&message.Id, &message.Sender.Id, &message.Sender.Username, &message.Content, &loc,
-			&message.CreatedAt, &message.ClientId, &message.SentAt, &message.ReceivedAt)
+		var revision MessageRevision
+		err = rows.Scan(&revision.Revision, &revision.Content, &revision.CreatedAt)
 
-		if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
 			return nil, newErrRepository(err.Error())
 		}
 
-		geom, err := geos.FromHex(string(loc))
+		revisions = append(revisions, revision)
+	}
 
-		if err != nil {
-			return nil, newErrRepository(err.Error())
-		}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err := rows.Err(); err != nil {
+		return nil, newErrRepository(err.Error())
+	}
 
-		message.Location.Long, err = geom.X()
+	return revisions, nil
+}
 
-		if err != nil {
-			return nil, newErrRepository(err.Error())
-		}
+func (p *postgresqlMessageRepository) GetMessagesForLocation(ctx context.Context, location Location,
+	radiusMeters float64, limit int, page MessagePage) ([]StoredMessage, error) {
+	point := fmt.Sprintf("POINT (%f %f)", location.Long, location.Lat)
+
+	var rows *sql.Rows
+	var err error
+	if page.Cursor == nil {
+		rows, err = p.db.QueryContext(ctx, selectLatestMessages, point, radiusMeters, limit)
+	} else if page.Direction == NewerPage {
+		rows, err = p.db.QueryContext(ctx, selectNewerMessages, point, radiusMeters, page.Cursor.CreatedAt,
+			page.Cursor.Id, limit)
+	} else {
+		rows, err = p.db.QueryContext(ctx, selectOlderMessages, point, radiusMeters, page.Cursor.CreatedAt,
+			page.Cursor.Id, limit)
+	}
 
-		message.Location.Lat, err = geom.Y()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
 
-		if err != nil {
+	messages := make([]StoredMessage, 0)
+
+	for rows.Next() {
+		message, err := scanPostgresqlMessage(rows)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
 			return nil, newErrRepository(err.Error())
 		}
 
 		messages = append(messages, message)
 	}
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err := rows.Err(); err != nil {
+		return nil, newErrRepository(err.Error())
+	}
+
+	if page.Cursor != nil && page.Direction == NewerPage {
+		reverseMessages(messages)
+	}
+
 	return messages, nil
 }
 
+func (p *postgresqlMessageRepository) ImportMessage(ctx context.Context, message StoredMessage,
+	overwrite bool) (bool, error) {
+	query := importMessage
+
+	if overwrite {
+		query = upsertMessage
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, postgresqlErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, insertLogin, message.Sender.Id, message.Sender.Username)
+
+	if err != nil {
+		return false, postgresqlErr(ctx, err)
+	}
+
+	result, err := tx.ExecContext(ctx, query, message.Id, message.Sender.Id, message.Content,
+		fmt.Sprintf("POINT (%f %f)", message.Location.Long, message.Location.Lat), message.ClientId, message.SentAt,
+		message.ReceivedAt, message.CreatedAt, message.DeletedAt, message.EditedAt, message.RevisionCount)
+
+	if err != nil {
+		return false, postgresqlErr(ctx, err)
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return false, newErrRepository(err.Error())
+	} else if affected == 0 {
+		return false, nil
+	}
+
+	err = recordEvent(ctx, tx, MessageImportedEvent, message)
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return false, postgresqlErr(ctx, err)
+	}
+
+	return true, nil
+}
+
+// postgresqlErr reports a cancelled or timed out context in preference to the error the driver produced because of it.
+// isInvalidPostgresqlId reports whether err is PostgreSQL refusing an id that is not a UUID, SQLSTATE 22P02. No row can
+// have such an id, so it is treated as naming nothing, as in the other repositories.
+func isInvalidPostgresqlId(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == "22P02"
+}
+
+func postgresqlErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return newErrRepository(err.Error())
+}
+
 func MakePostgresqlRespository(db *sql.DB) (MessageRepository, error) {
 	return &postgresqlMessageRepository{db}, nil
 }
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+const (
+	insertApiKey       = "INSERT INTO api_key (id, hash, service_id, service_username, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	selectApiKeys      = "SELECT id, hash, service_id, service_username, scopes, created_at FROM api_key ORDER BY created_at, id"
+	selectApiKeyByHash = "SELECT id, hash, service_id, service_username, scopes, created_at FROM api_key WHERE hash = $1"
+	deleteApiKey       = "DELETE FROM api_key WHERE id = $1"
+	// Messages take their sender's username from login, which the auth service fills for users. Service identities
+	// are added here, their namespace keeps them apart from the auth service's rows.
+	upsertServiceLogin = "INSERT INTO login (id, username) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET username = excluded.username"
+)
+
+func scanPostgresqlApiKey(row rowScanner) (ApiKey, error) {
+	var key ApiKey
+
+	err := row.Scan(&key.Id, &key.Hash, &key.Service.Id, &key.Service.Username, pq.Array(&key.Scopes),
+		&key.CreatedAt)
+
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	return key, nil
+}
+
+func (p *postgresqlMessageRepository) AddApiKey(ctx context.Context, key ApiKey) (ApiKey, error) {
+	key.Id = uuid.NewV4().String()
+	key.Key = ""
+	key.CreatedAt = time.Now().UTC()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return ApiKey{}, postgresqlErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, upsertServiceLogin, key.Service.Id, key.Service.Username)
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, insertApiKey, key.Id, key.Hash, key.Service.Id, key.Service.Username,
+			pq.Array(key.Scopes), key.CreatedAt)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return ApiKey{}, postgresqlErr(ctx, err)
+	}
+
+	return key, nil
+}
+
+func (p *postgresqlMessageRepository) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	rows, err := p.db.QueryContext(ctx, selectApiKeys)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+	defer rows.Close()
+
+	keys := make([]ApiKey, 0)
+
+	for rows.Next() {
+		key, err := scanPostgresqlApiKey(rows)
+
+		if err != nil {
+			return nil, postgresqlErr(ctx, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	return keys, nil
+}
+
+func (p *postgresqlMessageRepository) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	key, err := scanPostgresqlApiKey(p.db.QueryRowContext(ctx, selectApiKeyByHash, hash))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return ApiKey{}, ErrApiKeyNotFound
+	} else if err != nil {
+		return ApiKey{}, postgresqlErr(ctx, err)
+	}
+
+	return key, nil
+}
+
+func (p *postgresqlMessageRepository) DeleteApiKey(ctx context.Context, id string) error {
+	result, err := p.db.ExecContext(ctx, deleteApiKey, id)
+
+	if isInvalidPostgresqlId(err) && ctx.Err() == nil {
+		return ErrApiKeyNotFound
+	} else if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return postgresqlErr(ctx, err)
+	} else if deleted == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/twinj/uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	messageAddedChannel = "message_added"
+	notifyMessageAdded  = "SELECT pg_notify($1, $2)"
+
+	// How long the listener waits before reconnecting after losing its connection, doubling up to the maximum.
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+	// lookupTimeout bounds fetching a message announced by another instance.
+	lookupTimeout = 10 * time.Second
+)
+
+// messageAddedNotification is the payload of a message_added notification. Only the message id is sent, notification
+// payloads are limited to 8000 bytes which a message's content could exceed.
+type messageAddedNotification struct {
+	Id string `json:"id"`
+	// Origin identifies the instance that stored the message, which has already delivered it to its own
+	// subscribers.
+	Origin string `json:"origin"`
+}
+
+// postgresqlBroker relays new messages between instances through PostgreSQL's LISTEN and NOTIFY. Each instance
+// delivers the messages it stores straight to its own subscribers and announces them, the others look up each
+// announced message and deliver it to theirs.
+type postgresqlBroker struct {
+	feed     *Feed
+	db       *sql.DB
+	listener *pq.Listener
+	repo     MessageRepository
+	origin   string
+	stopped  sync.WaitGroup
+}
+
+// MakePostgresqlBroker constructs a Broker that shares new messages with every instance connected to the PostgreSQL
+// database at pgUrl, looking up the messages other instances announce in repo. Messages are announced through db, a
+// pool connected to the same database which the broker does not close, and received over a dedicated connection.
+func MakePostgresqlBroker(db *sql.DB, pgUrl string, repo MessageRepository) (Broker, error) {
+	listener := pq.NewListener(pgUrl, listenerMinReconnect, listenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("message broker listener: %s", err)
+			}
+		})
+
+	err := listener.Listen(messageAddedChannel)
+
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	broker := &postgresqlBroker{
+		feed:     NewFeed(),
+		db:       db,
+		listener: listener,
+		repo:     repo,
+		origin:   uuid.NewV4().String(),
+	}
+
+	broker.stopped.Add(1)
+	go broker.listen()
+
+	return broker, nil
+}
+
+func (pb *postgresqlBroker) Publish(ctx context.Context, msg StoredMessage) error {
+	pb.feed.Publish(msg)
+
+	payload, err := json.Marshal(messageAddedNotification{Id: msg.Id, Origin: pb.origin})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = pb.db.ExecContext(ctx, notifyMessageAdded, messageAddedChannel, string(payload))
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return newErrRepository(err.Error())
+	}
+
+	return nil
+}
+
+func (pb *postgresqlBroker) Subscribe(center Location, radiusMeters float64) *Subscription {
+	return pb.feed.Subscribe(center, radiusMeters)
+}
+
+// listen delivers the messages other instances announce until the listener is closed.
+func (pb *postgresqlBroker) listen() {
+	defer pb.stopped.Done()
+
+	for notification := range pb.listener.Notify {
+		// A nil notification follows a reconnect, anything announced while disconnected was missed.
+		if notification == nil {
+			log.Println("message broker listener reconnected, live subscribers may have missed messages")
+			continue
+		}
+
+		var added messageAddedNotification
+		err := json.Unmarshal([]byte(notification.Extra), &added)
+
+		if err != nil {
+			log.Printf("message broker listener: invalid notification: %s", err)
+			continue
+		}
+
+		if added.Origin == pb.origin {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		msg, err := pb.repo.GetMessage(ctx, added.Id)
+		cancel()
+
+		if err != nil {
+			log.Printf("message broker listener: %s", err)
+		} else if msg.Id == "" {
+			log.Printf("message broker listener: announced message %s not found", added.Id)
+		} else {
+			pb.feed.Publish(msg)
+		}
+	}
+}
+
+func (pb *postgresqlBroker) Close() error {
+	err := pb.listener.Close()
+	pb.stopped.Wait()
+
+	return err
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	upsertPresence = "INSERT INTO presence (user_id, username, location, visible, last_seen_at) VALUES ($1, $2, ST_GeomFromText($3), $4, $5) ON CONFLICT (user_id) DO UPDATE SET username = EXCLUDED.username, location = EXCLUDED.location, visible = EXCLUDED.visible, last_seen_at = EXCLUDED.last_seen_at"
+	// Usernames are compared in the C collation so that they are ordered exactly as the in memory repository orders
+	// them.
+	selectPresence = "SELECT user_id, username, ST_Y(location), ST_X(location), visible, last_seen_at FROM presence WHERE last_seen_at > $3 AND ST_DWithin(location::geography, $1::geography, $2, false) ORDER BY username COLLATE \"C\", user_id COLLATE \"C\""
+	expirePresence = "DELETE FROM presence WHERE last_seen_at <= $1"
+)
+
+func (p *postgresqlMessageRepository) Heartbeat(ctx context.Context, presence Presence) error {
+	_, err := p.db.ExecContext(ctx, upsertPresence, presence.Sender.Id, presence.Sender.Username,
+		fmt.Sprintf("POINT (%f %f)", presence.Location.Long, presence.Location.Lat), presence.Visible,
+		presence.LastSeenAt)
+
+	if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (p *postgresqlMessageRepository) GetPresence(ctx context.Context, location Location, radiusMeters float64,
+	activeSince time.Time) ([]Presence, error) {
+	point := fmt.Sprintf("POINT (%f %f)", location.Long, location.Lat)
+	rows, err := p.db.QueryContext(ctx, selectPresence, point, radiusMeters, activeSince)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+	defer rows.Close()
+
+	nearby := make([]Presence, 0)
+
+	for rows.Next() {
+		var presence Presence
+
+		err = rows.Scan(&presence.Sender.Id, &presence.Sender.Username, &presence.Location.Lat,
+			&presence.Location.Long, &presence.Visible, &presence.LastSeenAt)
+
+		if err != nil {
+			return nil, postgresqlErr(ctx, err)
+		}
+
+		nearby = append(nearby, presence)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	return nearby, nil
+}
+
+func (p *postgresqlMessageRepository) ExpirePresence(ctx context.Context, activeSince time.Time) error {
+	_, err := p.db.ExecContext(ctx, expirePresence, activeSince)
+
+	if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	return nil
+}
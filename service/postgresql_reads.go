@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	// A position behind the one already recorded updates nothing. Message ids are compared as text in the C
+	// collation, as they are when paging.
+	upsertRead   = "INSERT INTO message_read (user_id, created_at, message_id) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET created_at = EXCLUDED.created_at, message_id = EXCLUDED.message_id WHERE (message_read.created_at, message_read.message_id COLLATE \"C\") < (EXCLUDED.created_at, EXCLUDED.message_id COLLATE \"C\")"
+	selectRead   = "SELECT created_at, message_id FROM message_read WHERE user_id = $1"
+	selectUnread = "SELECT count(*) FROM message m LEFT JOIN message_read r ON r.user_id = $3 WHERE ST_DWithin(m.location::geography, $1::geography, $2, false) AND m.deleted_at IS NULL AND m.user_id <> $3 AND (r.user_id IS NULL OR (m.created_at, m.id::text COLLATE \"C\") > (r.created_at, r.message_id COLLATE \"C\"))"
+)
+
+func (p *postgresqlMessageRepository) MarkRead(ctx context.Context, userId string,
+	position MessageCursor) (MessageCursor, error) {
+	_, err := p.db.ExecContext(ctx, upsertRead, userId, position.CreatedAt, position.Id)
+
+	if err != nil {
+		return MessageCursor{}, postgresqlErr(ctx, err)
+	}
+
+	current, err := p.GetReadPosition(ctx, userId)
+
+	if err != nil {
+		return MessageCursor{}, err
+	}
+
+	return *current, nil
+}
+
+func (p *postgresqlMessageRepository) GetReadPosition(ctx context.Context, userId string) (*MessageCursor, error) {
+	var position MessageCursor
+
+	err := p.db.QueryRowContext(ctx, selectRead, userId).Scan(&position.CreatedAt, &position.Id)
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	position.CreatedAt = position.CreatedAt.UTC()
+
+	return &position, nil
+}
+
+func (p *postgresqlMessageRepository) CountUnread(ctx context.Context, userId string, location Location,
+	radiusMeters float64) (int, error) {
+	var count int
+	point := fmt.Sprintf("POINT (%f %f)", location.Long, location.Lat)
+
+	err := p.db.QueryRowContext(ctx, selectUnread, point, radiusMeters, userId).Scan(&count)
+
+	if err != nil {
+		return 0, postgresqlErr(ctx, err)
+	}
+
+	return count, nil
+}
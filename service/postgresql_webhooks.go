@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+const (
+	insertWebhook  = "INSERT INTO webhook (id, url, secret, center, radius, polygon, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	selectWebhook  = "SELECT id, url, secret, center, radius, polygon, created_at FROM webhook WHERE id = $1"
+	selectWebhooks = "SELECT id, url, secret, center, radius, polygon, created_at FROM webhook ORDER BY created_at, id"
+	// Deliveries owed to the webhook are removed by the foreign key's cascade.
+	deleteWebhook = "DELETE FROM webhook WHERE id = $1"
+
+	deliveryColumns = "id, webhook_id, message_id, payload, attempts, next_attempt_at, last_error, dead_at, created_at"
+	insertDelivery  = "INSERT INTO webhook_delivery (id, webhook_id, message_id, payload, attempts, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	// Rows another dispatcher is claiming are skipped rather than waited on.
+	claimDeliveries   = "UPDATE webhook_delivery SET leased_until = $2 WHERE id IN (SELECT id FROM webhook_delivery WHERE dead_at IS NULL AND next_attempt_at <= $1 AND leased_until <= $1 ORDER BY next_attempt_at LIMIT $3 FOR UPDATE SKIP LOCKED) RETURNING " + deliveryColumns
+	completeDelivery  = "DELETE FROM webhook_delivery WHERE id = $1"
+	retryDelivery     = "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3, leased_until = '-infinity' WHERE id = $1"
+	killDelivery      = "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = $2, dead_at = $3, leased_until = '-infinity' WHERE id = $1"
+	selectDeadLetters = "SELECT " + deliveryColumns + " FROM webhook_delivery WHERE dead_at IS NOT NULL ORDER BY dead_at, id"
+)
+
+func scanPostgresqlWebhook(row rowScanner) (Webhook, error) {
+	var webhook Webhook
+	var center, polygon []byte
+
+	err := row.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, &center, &webhook.Radius, &polygon,
+		&webhook.CreatedAt)
+
+	if err == nil && center != nil {
+		err = json.Unmarshal(center, &webhook.Center)
+	}
+
+	if err == nil && polygon != nil {
+		err = json.Unmarshal(polygon, &webhook.Polygon)
+	}
+
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+func scanPostgresqlDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload []byte
+	var deadAt sql.NullTime
+
+	err := row.Scan(&delivery.Id, &delivery.WebhookId, &delivery.MessageId, &payload, &delivery.Attempts,
+		&delivery.NextAttemptAt, &delivery.LastError, &deadAt, &delivery.CreatedAt)
+
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	if deadAt.Valid {
+		delivery.DeadAt = &deadAt.Time
+	}
+
+	delivery.Payload = payload
+
+	return delivery, nil
+}
+
+// jsonColumn encodes an optional value for a JSONB column, returning NULL when absent is set.
+func jsonColumn(value interface{}, absent bool) (interface{}, error) {
+	if absent {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(encoded), nil
+}
+
+func (p *postgresqlMessageRepository) AddWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	webhook.Id = uuid.NewV4().String()
+	webhook.CreatedAt = time.Now().UTC()
+
+	center, err := jsonColumn(webhook.Center, webhook.Center == nil)
+
+	if err != nil {
+		return Webhook{}, newErrRepository(err.Error())
+	}
+
+	polygon, err := jsonColumn(webhook.Polygon, len(webhook.Polygon) == 0)
+
+	if err != nil {
+		return Webhook{}, newErrRepository(err.Error())
+	}
+
+	_, err = p.db.ExecContext(ctx, insertWebhook, webhook.Id, webhook.Url, webhook.Secret, center, webhook.Radius,
+		polygon, webhook.CreatedAt)
+
+	if err != nil {
+		return Webhook{}, postgresqlErr(ctx, err)
+	}
+
+	return webhook, nil
+}
+
+func (p *postgresqlMessageRepository) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	webhook, err := scanPostgresqlWebhook(p.db.QueryRowContext(ctx, selectWebhook, id))
+
+	if (err == sql.ErrNoRows || isInvalidPostgresqlId(err)) && ctx.Err() == nil {
+		return Webhook{}, ErrWebhookNotFound
+	} else if err != nil {
+		return Webhook{}, postgresqlErr(ctx, err)
+	}
+
+	return webhook, nil
+}
+
+func (p *postgresqlMessageRepository) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := p.db.QueryContext(ctx, selectWebhooks)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	webhooks, err := scanPostgresqlWebhooks(rows)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	return webhooks, nil
+}
+
+// scanPostgresqlWebhooks reads every webhook in rows and closes them.
+func scanPostgresqlWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+	webhooks := make([]Webhook, 0)
+
+	for rows.Next() {
+		webhook, err := scanPostgresqlWebhook(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (p *postgresqlMessageRepository) DeleteWebhook(ctx context.Context, id string) error {
+	result, err := p.db.ExecContext(ctx, deleteWebhook, id)
+
+	if isInvalidPostgresqlId(err) && ctx.Err() == nil {
+		return ErrWebhookNotFound
+	} else if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return postgresqlErr(ctx, err)
+	} else if deleted == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// queuePostgresqlDeliveries queues a new message for the webhooks whose area contains it, as part of the transaction
+// storing it.
+func queuePostgresqlDeliveries(ctx context.Context, tx *sql.Tx, msg StoredMessage) error {
+	rows, err := tx.QueryContext(ctx, selectWebhooks)
+
+	if err != nil {
+		return err
+	}
+
+	registered, err := scanPostgresqlWebhooks(rows)
+
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := webhookDeliveries(registered, msg)
+
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		_, err = tx.ExecContext(ctx, insertDelivery, delivery.Id, delivery.WebhookId, delivery.MessageId,
+			string(delivery.Payload), delivery.Attempts, delivery.NextAttemptAt, delivery.CreatedAt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *postgresqlMessageRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]WebhookDelivery, error) {
+	rows, err := p.db.QueryContext(ctx, claimDeliveries, now, now.Add(lease), limit)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery, err := scanPostgresqlDelivery(rows)
+
+		if err != nil {
+			return nil, postgresqlErr(ctx, err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	// RETURNING produces rows in no particular order.
+	sortDeliveries(deliveries)
+
+	return deliveries, nil
+}
+
+func (p *postgresqlMessageRepository) CompleteDelivery(ctx context.Context, id string) error {
+	_, err := p.db.ExecContext(ctx, completeDelivery, id)
+
+	if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (p *postgresqlMessageRepository) FailDelivery(ctx context.Context, id string, lastError string,
+	nextAttemptAt *time.Time) error {
+	var err error
+
+	if nextAttemptAt != nil {
+		_, err = p.db.ExecContext(ctx, retryDelivery, id, lastError, *nextAttemptAt)
+	} else {
+		_, err = p.db.ExecContext(ctx, killDelivery, id, lastError, time.Now().UTC())
+	}
+
+	if err != nil {
+		return postgresqlErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (p *postgresqlMessageRepository) GetDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	rows, err := p.db.QueryContext(ctx, selectDeadLetters)
+
+	if err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery, err := scanPostgresqlDelivery(rows)
+
+		if err != nil {
+			return nil, postgresqlErr(ctx, err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, postgresqlErr(ctx, err)
+	}
+
+	return deliveries, nil
+}
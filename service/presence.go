@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PresenceTtl is how long a heartbeat keeps a user active, clients are expected to send one well within it.
+const PresenceTtl = 2 * time.Minute
+
+// Presence is the latest heartbeat a user sent, saying where they are active.
+type Presence struct {
+	Sender   `json:"sender"`
+	Location `json:"location"`
+	// Visible is set when the user opts in to their username being shown to those nearby.
+	Visible    bool      `json:"visible"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+}
+
+func (p Presence) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// sortPresence orders presences by username, then by user id.
+func sortPresence(presence []Presence) {
+	sort.Slice(presence, func(i, j int) bool {
+		if presence[i].Username != presence[j].Username {
+			return presence[i].Username < presence[j].Username
+		}
+
+		return presence[i].Id < presence[j].Id
+	})
+}
+
+// PresenceRepository stores the heartbeats of active users.
+type PresenceRepository interface {
+	// Heartbeat records that a user is active, replacing their previous heartbeat.
+	Heartbeat(ctx context.Context, presence Presence) error
+	// GetPresence retrieves the users whose latest heartbeat, sent after activeSince, was within radiusMeters of
+	// location, ordered by username and then user id.
+	GetPresence(ctx context.Context, location Location, radiusMeters float64, activeSince time.Time) ([]Presence,
+		error)
+	// ExpirePresence removes the heartbeats sent before activeSince.
+	ExpirePresence(ctx context.Context, activeSince time.Time) error
+}
+
+// NewPresenceRepository retrieves the PresenceRepository sharing storage with repo.
+func NewPresenceRepository(repo MessageRepository) (PresenceRepository, error) {
+	presence, ok := repo.(PresenceRepository)
+
+	if !ok {
+		return nil, newErrRepository("repository does not support presence")
+	}
+
+	return presence, nil
+}
+
+// ExpirePresence removes stale heartbeats every PresenceTtl until ctx is done. Stale heartbeats are never returned by
+// GetPresence, expiring them only reclaims their storage.
+func ExpirePresence(ctx context.Context, presence PresenceRepository) {
+	ticker := time.NewTicker(PresenceTtl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		err := presence.ExpirePresence(ctx, time.Now().UTC().Add(-PresenceTtl))
+
+		if err != nil && ctx.Err() == nil {
+			log.Printf("presence expiry: %s", err)
+		}
+	}
+}
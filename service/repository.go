@@ -1,18 +1,56 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"time"
+	"log"
 )
 
-// MessageRepository represents a data source through which users can be managed.
+// MessageRepository represents a data source through which users can be managed. Every method takes the context of
+// the request being served so that work is abandoned once the request is cancelled or times out.
 type MessageRepository interface {
-	AddMessage(message Message) (StoredMessage, error)
-	GetMessage(id string) (StoredMessage, error)
-	GetMessagesForLocation(location Location, radiusMeters float64, limit int, after time.Time) ([]StoredMessage, error)
+	// AddMessage stores a new message. A message with a ClientId is only stored once per sender, adding it again
+	// returns the message already stored along with false to report that nothing was added.
+	AddMessage(ctx context.Context, message Message) (StoredMessage, bool, error)
+	GetMessage(ctx context.Context, id string) (StoredMessage, error)
+	// GetMessagesForLocation retrieves up to limit messages within radiusMeters of location that fall on the given
+	// page. Results are always ordered newest first by (createdAt, id).
+	GetMessagesForLocation(ctx context.Context, location Location, radiusMeters float64, limit int,
+		page MessagePage) ([]StoredMessage, error)
+	// ImportMessage stores a message under its existing id and creation time. When a message with the same id is
+	// already stored it is replaced if overwrite is true and left alone otherwise. Reports whether anything was
+	// written.
+	ImportMessage(ctx context.Context, message StoredMessage, overwrite bool) (bool, error)
+	// DeleteMessage replaces a message with a tombstone and returns it. Deleting a message that is already deleted
+	// returns its existing tombstone, deleting one that does not exist returns ErrMessageNotFound.
+	DeleteMessage(ctx context.Context, id string) (StoredMessage, error)
+	// EditMessage replaces a message's content, keeping the content it replaces as a revision, and returns the edited
+	// message. Returns ErrMessageNotFound if there is no such message and ErrMessageDeleted if it has been deleted.
+	EditMessage(ctx context.Context, id string, content string) (StoredMessage, error)
+	// GetRevisions retrieves the prior versions of a message's content, oldest first. Revisions are discarded when a
+	// message is deleted.
+	GetRevisions(ctx context.Context, id string) ([]MessageRevision, error)
+	// GetEvents retrieves up to limit events from the log of changes to messages, in sequence order, starting with
+	// the event numbered from. Each change is logged atomically with the change itself, replayed AddMessage calls and
+	// deletes of messages already deleted are not logged.
+	GetEvents(ctx context.Context, from int64, limit int) ([]MessageEvent, error)
+	// MarkRead records that a user has seen every message up to and including position in the (createdAt, id)
+	// ordering and returns the user's read position. A position behind the one already recorded leaves it unchanged.
+	MarkRead(ctx context.Context, userId string, position MessageCursor) (MessageCursor, error)
+	// GetReadPosition retrieves how far a user has read, nil if they have not marked anything read.
+	GetReadPosition(ctx context.Context, userId string) (*MessageCursor, error)
+	// CountUnread counts the messages within radiusMeters of location past a user's read position, leaving out
+	// deleted messages and the user's own.
+	CountUnread(ctx context.Context, userId string, location Location, radiusMeters float64) (int, error)
 }
 
+// ErrMessageNotFound is returned by MessageRepository methods that require an existing message when there is none.
+var ErrMessageNotFound error = errRepository{errors.New("message not found")}
+
+// ErrMessageDeleted is returned by MessageRepository methods that cannot act on a deleted message.
+var ErrMessageDeleted error = errRepository{errors.New("message deleted")}
+
 // NewMessageRepository constructs a UserRepository from the given configuration.
 func NewMessageRepository(config Configuration) (MessageRepository, error) {
 	var err error
@@ -27,14 +65,47 @@ func NewMessageRepository(config Configuration) (MessageRepository, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		if config.GetPgAutoMigrate() {
+			_, err = MigratePostgresql(context.Background(), db, false, log.Writer())
+
+			if err != nil {
+				return nil, err
+			}
+		}
 		repo, err = MakePostgresqlRespository(db)
+	case SqliteRepo:
+		var db *sql.DB
+		db, err = sql.Open("sqlite", config.GetSqlitePath())
+
+		if err != nil {
+			return nil, err
+		}
+		repo, err = MakeSqliteRepository(db)
 	default:
 		err = newErrRepository("repository type unimplemented")
 	}
 
+	if err == nil && config.GetInitDataSet() != "" {
+		err = loadInitDataset(repo, config)
+	}
+
 	return repo, err
 }
 
+func loadInitDataset(repo MessageRepository, config Configuration) error {
+	report, err := LoadDatasetFile(context.Background(), repo, config.GetInitDataSet(), config.GetInitDataSetMode())
+
+	for _, recordErr := range report.Errors {
+		log.Println(recordErr)
+	}
+
+	log.Printf("loaded %d messages from %s, %d skipped, %d failed", report.Loaded, config.GetInitDataSet(),
+		report.Skipped, report.Failed)
+
+	return err
+}
+
 type errRepository struct {
 	err error
 }
@@ -0,0 +1,534 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stone1549/yapyapyap/message/service"
+	"testing"
+	"time"
+)
+
+// testGetMessagesForLocationPaging ensures that paging in both directions visits every message exactly once in newest
+// first order.
+func testGetMessagesForLocationPaging(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+
+	stored := make([]service.StoredMessage, 0)
+	for i := 0; i < 5; i++ {
+		msg, _, err := repo.AddMessage(ctx, service.Message{Location: loc})
+		ok(t, err)
+		stored = append(stored, msg)
+	}
+
+	first, err := repo.GetMessagesForLocation(ctx, loc, 100, 2, service.MessagePage{})
+	ok(t, err)
+	equals(t, 2, len(first))
+
+	oldest := service.CursorFor(first[1])
+	second, err := repo.GetMessagesForLocation(ctx, loc, 100, 10,
+		service.MessagePage{Cursor: &oldest, Direction: service.OlderPage})
+	ok(t, err)
+	equals(t, 3, len(second))
+
+	all := append(first, second...)
+	for i := 1; i < len(all); i++ {
+		equals(t, true, service.CursorFor(all[i]).Before(all[i-1]))
+	}
+
+	back, err := repo.GetMessagesForLocation(ctx, loc, 100, 10,
+		service.MessagePage{Cursor: &oldest, Direction: service.NewerPage})
+	ok(t, err)
+	equals(t, first[:1], back)
+}
+
+// testGetMessagesForLocationRadius ensures that only messages inside the radius are returned, including those on the
+// far side of the antimeridian and across a pole, and that a message exactly on the radius is inside it.
+func testGetMessagesForLocationRadius(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	cases := []struct {
+		center  service.Location
+		inside  []service.Location
+		outside []service.Location
+	}{
+		{
+			center:  service.Location{Lat: 40.0, Long: -105.0},
+			inside:  []service.Location{{Lat: 40.0005, Long: -105.0}, {Lat: 40.0, Long: -105.0005}},
+			outside: []service.Location{{Lat: 40.01, Long: -105.0}, {Lat: -40.0, Long: 75.0}},
+		},
+		{
+			center:  service.Location{Lat: 0.0, Long: 179.9999},
+			inside:  []service.Location{{Lat: 0.0, Long: -179.9999}, {Lat: 0.0, Long: 179.9995}},
+			outside: []service.Location{{Lat: 0.0, Long: -179.99}, {Lat: 0.0, Long: 0.0}},
+		},
+		{
+			center:  service.Location{Lat: 89.9999, Long: 0.0},
+			inside:  []service.Location{{Lat: 89.9999, Long: 180.0}, {Lat: 89.9999, Long: 90.0}},
+			outside: []service.Location{{Lat: 89.99, Long: 0.0}},
+		},
+	}
+
+	for _, c := range cases {
+		repo := makeRepo(t)
+		ctx := context.Background()
+
+		for _, loc := range append(c.inside, c.outside...) {
+			_, _, err := repo.AddMessage(ctx, service.Message{Location: loc})
+			ok(t, err)
+		}
+
+		messages, err := repo.GetMessagesForLocation(ctx, c.center, 100, 100, service.MessagePage{})
+		ok(t, err)
+		equals(t, len(c.inside), len(messages))
+	}
+
+	// A message at the center of a zero radius lies exactly on its boundary.
+	repo := makeRepo(t)
+	center := service.Location{Lat: 40.0, Long: -105.0}
+	_, _, err := repo.AddMessage(context.Background(), service.Message{Location: center})
+	ok(t, err)
+
+	messages, err := repo.GetMessagesForLocation(context.Background(), center, 0, 100, service.MessagePage{})
+	ok(t, err)
+	equals(t, 1, len(messages))
+}
+
+// testDeleteMessage ensures that deleting a message leaves a tombstone in its place, both when fetched by id and in
+// location queries, and that deleting again is harmless.
+func testDeleteMessage(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+
+	stored, _, err := repo.AddMessage(ctx, service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: loc,
+	})
+	ok(t, err)
+
+	tombstone, err := repo.DeleteMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, stored.Id, tombstone.Id)
+	equals(t, "", tombstone.Content)
+	equals(t, true, tombstone.DeletedAt != nil)
+
+	msg, err := repo.GetMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, tombstone, msg)
+
+	messages, err := repo.GetMessagesForLocation(ctx, loc, 100, 10, service.MessagePage{})
+	ok(t, err)
+	equals(t, []service.StoredMessage{tombstone}, messages)
+
+	again, err := repo.DeleteMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, tombstone, again)
+
+	_, err = repo.DeleteMessage(ctx, "missing")
+	equals(t, service.ErrMessageNotFound, err)
+}
+
+// testEditMessage ensures that editing a message replaces its content while keeping every earlier version as a
+// revision, and that deleting it removes them.
+func testEditMessage(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+
+	stored, _, err := repo.AddMessage(ctx, service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "helo",
+		Location: loc,
+	})
+	ok(t, err)
+
+	revisions, err := repo.GetRevisions(ctx, stored.Id)
+	ok(t, err)
+	equals(t, 0, len(revisions))
+
+	first, err := repo.EditMessage(ctx, stored.Id, "hello")
+	ok(t, err)
+	equals(t, "hello", first.Content)
+	equals(t, 1, first.RevisionCount)
+	equals(t, true, first.EditedAt != nil)
+
+	second, err := repo.EditMessage(ctx, stored.Id, "hello there")
+	ok(t, err)
+	equals(t, 2, second.RevisionCount)
+
+	msg, err := repo.GetMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, second, msg)
+
+	revisions, err = repo.GetRevisions(ctx, stored.Id)
+	ok(t, err)
+	equals(t, []service.MessageRevision{
+		{Revision: 0, Content: "helo", CreatedAt: stored.CreatedAt},
+		{Revision: 1, Content: "hello", CreatedAt: *first.EditedAt},
+	}, revisions)
+
+	_, err = repo.EditMessage(ctx, "missing", "hello")
+	equals(t, service.ErrMessageNotFound, err)
+
+	_, err = repo.GetRevisions(ctx, "missing")
+	equals(t, service.ErrMessageNotFound, err)
+
+	_, err = repo.DeleteMessage(ctx, stored.Id)
+	ok(t, err)
+
+	revisions, err = repo.GetRevisions(ctx, stored.Id)
+	ok(t, err)
+	equals(t, 0, len(revisions))
+
+	_, err = repo.EditMessage(ctx, stored.Id, "too late")
+	equals(t, service.ErrMessageDeleted, err)
+}
+
+// testAddMessageIdempotent ensures that a message added again under the same sender and client id is only stored once,
+// while other senders and messages without a client id are unaffected.
+func testAddMessageIdempotent(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+	msg := service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: loc,
+		ClientId: "client-1",
+	}
+
+	stored, added, err := repo.AddMessage(ctx, msg)
+	ok(t, err)
+	equals(t, true, added)
+
+	replayed, added, err := repo.AddMessage(ctx, msg)
+	ok(t, err)
+	equals(t, false, added)
+	equals(t, stored.Id, replayed.Id)
+
+	other := msg
+	other.Sender = service.Sender{Id: "2", Username: "someone else"}
+	_, added, err = repo.AddMessage(ctx, other)
+	ok(t, err)
+	equals(t, true, added)
+
+	anonymous := msg
+	anonymous.ClientId = ""
+
+	for i := 0; i < 2; i++ {
+		_, added, err = repo.AddMessage(ctx, anonymous)
+		ok(t, err)
+		equals(t, true, added)
+	}
+
+	messages, err := repo.GetMessagesForLocation(ctx, loc, 100, 10, service.MessagePage{})
+	ok(t, err)
+	equals(t, 4, len(messages))
+}
+
+// testWebhookOutbox ensures that messages are queued for the webhooks whose area contains them, that claimed
+// deliveries are hidden until retried or their lease lapses, and that failed deliveries are retried or dead lettered.
+func testWebhookOutbox(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	webhooks, err := service.NewWebhookRepository(repo)
+	ok(t, err)
+
+	circle, err := webhooks.AddWebhook(ctx, service.Webhook{
+		Url:    "https://example.com/circle",
+		Secret: "secret",
+		Center: &service.Location{Lat: 40.0, Long: -105.0},
+		Radius: 1000,
+	})
+	ok(t, err)
+
+	polygon, err := webhooks.AddWebhook(ctx, service.Webhook{
+		Url:    "https://example.com/polygon",
+		Secret: "secret",
+		Polygon: []service.Location{
+			{Lat: 39.9, Long: -105.1}, {Lat: 39.9, Long: -104.9}, {Lat: 40.1, Long: -104.9}, {Lat: 40.1, Long: -105.1},
+		},
+	})
+	ok(t, err)
+
+	registered, err := webhooks.GetWebhooks(ctx)
+	ok(t, err)
+	equals(t, []service.Webhook{circle, polygon}, registered)
+
+	sender := service.Sender{Id: "1", Username: "someone"}
+
+	// Inside both areas, then inside only the polygon, then outside both.
+	for _, loc := range []service.Location{{Lat: 40.0, Long: -105.0}, {Lat: 40.09, Long: -104.91}, {Lat: 41.0, Long: -105.0}} {
+		_, _, err = repo.AddMessage(ctx, service.Message{Sender: sender, Content: "hello", Location: loc})
+		ok(t, err)
+	}
+
+	now := time.Now().UTC()
+	claimed, err := webhooks.ClaimDeliveries(ctx, now, time.Minute, 10)
+	ok(t, err)
+	equals(t, 3, len(claimed))
+
+	again, err := webhooks.ClaimDeliveries(ctx, now, time.Minute, 10)
+	ok(t, err)
+	equals(t, 0, len(again))
+
+	var payload service.WebhookPayload
+	ok(t, json.Unmarshal(claimed[0].Payload, &payload))
+	equals(t, service.MessageCreatedWebhookEvent, payload.Event)
+	equals(t, claimed[0].Id, payload.DeliveryId)
+	equals(t, claimed[0].MessageId, payload.Message.Id)
+
+	retryAt := now.Add(time.Hour)
+	ok(t, webhooks.CompleteDelivery(ctx, claimed[0].Id))
+	ok(t, webhooks.FailDelivery(ctx, claimed[1].Id, "503 Service Unavailable", &retryAt))
+	ok(t, webhooks.FailDelivery(ctx, claimed[2].Id, "404 Not Found", nil))
+
+	due, err := webhooks.ClaimDeliveries(ctx, now.Add(30*time.Minute), time.Minute, 10)
+	ok(t, err)
+	equals(t, 0, len(due))
+
+	due, err = webhooks.ClaimDeliveries(ctx, retryAt, time.Minute, 10)
+	ok(t, err)
+	equals(t, 1, len(due))
+	equals(t, claimed[1].Id, due[0].Id)
+	equals(t, 1, due[0].Attempts)
+	equals(t, "503 Service Unavailable", due[0].LastError)
+
+	dead, err := webhooks.GetDeadLetters(ctx)
+	ok(t, err)
+	equals(t, 1, len(dead))
+	equals(t, claimed[2].Id, dead[0].Id)
+	equals(t, true, dead[0].DeadAt != nil)
+
+	ok(t, webhooks.DeleteWebhook(ctx, claimed[1].WebhookId))
+	equals(t, service.ErrWebhookNotFound, webhooks.DeleteWebhook(ctx, claimed[1].WebhookId))
+
+	due, err = webhooks.ClaimDeliveries(ctx, retryAt.Add(time.Hour), time.Minute, 10)
+	ok(t, err)
+	equals(t, 0, len(due))
+}
+
+// testEventLog ensures that adds, edits, deletes and imports are logged in sequence, that replays and repeated deletes
+// are not, and that the log can be read from any position.
+func testEventLog(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	msg := service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: service.Location{Lat: 40.0, Long: -105.0},
+		ClientId: "client-1",
+	}
+
+	stored, _, err := repo.AddMessage(ctx, msg)
+	ok(t, err)
+	_, _, err = repo.AddMessage(ctx, msg)
+	ok(t, err)
+	edited, err := repo.EditMessage(ctx, stored.Id, "edited")
+	ok(t, err)
+	tombstone, err := repo.DeleteMessage(ctx, stored.Id)
+	ok(t, err)
+	_, err = repo.DeleteMessage(ctx, stored.Id)
+	ok(t, err)
+
+	imported := service.StoredMessage{Id: "imported", CreatedAt: stored.CreatedAt, Message: msg}
+	imported.ClientId = ""
+	_, err = repo.ImportMessage(ctx, imported, false)
+	ok(t, err)
+
+	events, err := repo.GetEvents(ctx, 1, 100)
+	ok(t, err)
+	equals(t, 4, len(events))
+
+	expected := []struct {
+		eventType service.MessageEventType
+		message   service.StoredMessage
+	}{
+		{service.MessageCreatedEvent, stored},
+		{service.MessageEditedEvent, edited},
+		{service.MessageDeletedEvent, tombstone},
+		{service.MessageImportedEvent, imported},
+	}
+
+	for i, event := range events {
+		equals(t, int64(i+1), event.Seq)
+		equals(t, expected[i].eventType, event.Type)
+		equals(t, expected[i].message.Id, event.Message.Id)
+		equals(t, expected[i].message.Content, event.Message.Content)
+		equals(t, expected[i].message.DeletedAt != nil, event.Message.DeletedAt != nil)
+	}
+
+	page, err := repo.GetEvents(ctx, 2, 2)
+	ok(t, err)
+	equals(t, 2, len(page))
+	equals(t, int64(2), page[0].Seq)
+	equals(t, int64(3), page[1].Seq)
+
+	page, err = repo.GetEvents(ctx, 5, 100)
+	ok(t, err)
+	equals(t, 0, len(page))
+}
+
+// testPresence ensures that only the latest heartbeat of each user counts, that users are found near the location
+// they last sent, and that stale heartbeats are neither found nor kept once expired.
+func testPresence(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	presenceRepo, err := service.NewPresenceRepository(makeRepo(t))
+	ok(t, err)
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	center := service.Location{Lat: 40.0, Long: -105.0}
+	heartbeats := []service.Presence{
+		{Sender: service.Sender{Id: "1", Username: "bob"}, Location: service.Location{Lat: 40.001, Long: -105.0},
+			Visible: true, LastSeenAt: now},
+		{Sender: service.Sender{Id: "2", Username: "alice"}, Location: service.Location{Lat: 41.0, Long: -105.0},
+			LastSeenAt: now.Add(-time.Minute)},
+		{Sender: service.Sender{Id: "2", Username: "alice"}, Location: center, LastSeenAt: now},
+		{Sender: service.Sender{Id: "3", Username: "carol"}, Location: service.Location{Lat: 41.0, Long: -105.0},
+			Visible: true, LastSeenAt: now},
+		{Sender: service.Sender{Id: "4", Username: "dave"}, Location: center, Visible: true,
+			LastSeenAt: now.Add(-time.Hour)},
+	}
+
+	for _, heartbeat := range heartbeats {
+		ok(t, presenceRepo.Heartbeat(ctx, heartbeat))
+	}
+
+	nearby, err := presenceRepo.GetPresence(ctx, center, 1000, now.Add(-service.PresenceTtl))
+	ok(t, err)
+	equals(t, []service.Presence{heartbeats[2], heartbeats[0]}, nearby)
+
+	nearby, err = presenceRepo.GetPresence(ctx, center, 1000, now.Add(-2*time.Hour))
+	ok(t, err)
+	equals(t, 3, len(nearby))
+
+	ok(t, presenceRepo.ExpirePresence(ctx, now.Add(-service.PresenceTtl)))
+	nearby, err = presenceRepo.GetPresence(ctx, center, 1000, now.Add(-2*time.Hour))
+	ok(t, err)
+	equals(t, 2, len(nearby))
+}
+
+// testReadReceipts ensures that unread messages are counted past a user's read position, leaving out messages that
+// are deleted, far away or the user's own, and that read positions never move backwards.
+func testReadReceipts(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	center := service.Location{Lat: 40.0, Long: -105.0}
+	me := service.Sender{Id: "1", Username: "me"}
+	other := service.Sender{Id: "2", Username: "other"}
+
+	for _, msg := range []service.Message{
+		{Sender: other, Content: "one", Location: center},
+		{Sender: me, Content: "mine", Location: center},
+		{Sender: other, Content: "two", Location: center},
+		{Sender: other, Content: "three", Location: center},
+		{Sender: other, Content: "far", Location: service.Location{Lat: 41.0, Long: -105.0}},
+	} {
+		_, _, err := repo.AddMessage(ctx, msg)
+		ok(t, err)
+	}
+
+	position, err := repo.GetReadPosition(ctx, me.Id)
+	ok(t, err)
+	equals(t, (*service.MessageCursor)(nil), position)
+
+	unread, err := repo.CountUnread(ctx, me.Id, center, 1000)
+	ok(t, err)
+	equals(t, 3, unread)
+
+	newestFirst, err := repo.GetMessagesForLocation(ctx, center, 1000, 10, service.MessagePage{})
+	ok(t, err)
+	equals(t, 4, len(newestFirst))
+
+	// Messages stored in quick succession can share a creation time, so which are unread depends on their ids.
+	read := service.CursorFor(newestFirst[2])
+	marked, err := repo.MarkRead(ctx, me.Id, read)
+	ok(t, err)
+	equals(t, read, marked)
+
+	expected := 0
+
+	for _, msg := range newestFirst[:2] {
+		if msg.Sender.Id != me.Id {
+			expected++
+		}
+	}
+
+	unread, err = repo.CountUnread(ctx, me.Id, center, 1000)
+	ok(t, err)
+	equals(t, expected, unread)
+
+	marked, err = repo.MarkRead(ctx, me.Id, service.CursorFor(newestFirst[3]))
+	ok(t, err)
+	equals(t, read, marked)
+
+	_, err = repo.DeleteMessage(ctx, newestFirst[0].Id)
+	ok(t, err)
+
+	if newestFirst[0].Sender.Id != me.Id {
+		expected--
+	}
+
+	unread, err = repo.CountUnread(ctx, me.Id, center, 1000)
+	ok(t, err)
+	equals(t, expected, unread)
+
+	// Only my message is unread by the other user, unless it was the one deleted.
+	expected = 1
+
+	if newestFirst[0].Sender.Id == me.Id {
+		expected = 0
+	}
+
+	unread, err = repo.CountUnread(ctx, other.Id, center, 1000)
+	ok(t, err)
+	equals(t, expected, unread)
+}
+
+// testApiKeys ensures that API keys are found by their hash until they are revoked.
+func testApiKeys(t *testing.T, makeRepo func(testing.TB) service.MessageRepository) {
+	repo := makeRepo(t)
+	ctx := context.Background()
+	keys, err := service.NewApiKeyRepository(repo)
+	ok(t, err)
+
+	kiosk, err := keys.AddApiKey(ctx, service.ApiKey{
+		Hash:    "kiosk-hash",
+		Service: service.Sender{Id: "service:kiosk", Username: "Lobby kiosk"},
+		Scopes:  []string{service.ScopeMessagesRead},
+	})
+	ok(t, err)
+	equals(t, true, kiosk.Id != "")
+
+	bot, err := keys.AddApiKey(ctx, service.ApiKey{
+		Hash:    "bot-hash",
+		Service: service.Sender{Id: "service:alerts", Username: "Alerts"},
+		Scopes:  []string{service.ScopeMessagesRead, service.ScopeMessagesWrite},
+	})
+	ok(t, err)
+
+	stored, err := keys.GetApiKeys(ctx)
+	ok(t, err)
+	equals(t, 2, len(stored))
+
+	found, err := keys.GetApiKeyByHash(ctx, "bot-hash")
+	ok(t, err)
+	equals(t, bot.Id, found.Id)
+	equals(t, bot.Service, found.Service)
+	equals(t, bot.Scopes, found.Scopes)
+
+	_, err = keys.GetApiKeyByHash(ctx, "unknown-hash")
+	equals(t, service.ErrApiKeyNotFound, err)
+
+	ok(t, keys.DeleteApiKey(ctx, kiosk.Id))
+	equals(t, service.ErrApiKeyNotFound, keys.DeleteApiKey(ctx, kiosk.Id))
+
+	_, err = keys.GetApiKeyByHash(ctx, "kiosk-hash")
+	equals(t, service.ErrApiKeyNotFound, err)
+
+	stored, err = keys.GetApiKeys(ctx)
+	ok(t, err)
+	equals(t, 1, len(stored))
+	equals(t, bot.Id, stored[0].Id)
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sort"
+)
+
+const (
+	// metersPerDegreeLat is the approximate length of one degree of latitude.
+	metersPerDegreeLat = 111320.0
+	// maxQueryCells is the most cells a query may visit on a level before a coarser level is used instead.
+	maxQueryCells = 16
+)
+
+// indexCellDegrees lists the cell size of each level of a spatialIndex from coarsest to finest. The first level is
+// a single cell holding every message, the rest shrink by a factor of four from roughly 1250km down to 75m.
+var indexCellDegrees = []float64{360, 11.25, 2.8125, 0.703125, 0.17578125, 0.0439453125, 0.010986328125,
+	0.00274658203125, 0.0006866455078125}
+
+// boundingBox is a latitude/longitude aligned rectangle that does not cross the antimeridian.
+type boundingBox struct {
+	minLat  float64
+	maxLat  float64
+	minLong float64
+	maxLong float64
+}
+
+// boundingBoxes returns one or two rectangles which together cover the circle of the given radius around location.
+// Two are needed when the circle crosses the antimeridian.
+func boundingBoxes(location Location, radiusMeters float64) []boundingBox {
+	latDelta := radiusMeters / metersPerDegreeLat
+	box := boundingBox{
+		minLat:  math.Max(location.Lat-latDelta, -90),
+		maxLat:  math.Min(location.Lat+latDelta, 90),
+		minLong: -180,
+		maxLong: 180,
+	}
+
+	cosLat := math.Min(math.Cos(toRadians(location.Lat-latDelta)), math.Cos(toRadians(location.Lat+latDelta)))
+
+	// Near the poles the circle can span every longitude.
+	if location.Lat+latDelta >= 90 || location.Lat-latDelta <= -90 || cosLat <= 0 || latDelta/cosLat >= 180 {
+		return []boundingBox{box}
+	}
+
+	longDelta := latDelta / cosLat
+	box.minLong, box.maxLong = location.Long-longDelta, location.Long+longDelta
+
+	if box.minLong < -180 {
+		wrapped := box
+		wrapped.minLong, wrapped.maxLong = box.minLong+360, 180
+		box.minLong = -180
+
+		return []boundingBox{box, wrapped}
+	} else if box.maxLong > 180 {
+		wrapped := box
+		wrapped.minLong, wrapped.maxLong = -180, box.maxLong-360
+		box.maxLong = 180
+
+		return []boundingBox{box, wrapped}
+	}
+
+	return []boundingBox{box}
+}
+
+// spatialIndex buckets messages into a hierarchy of latitude/longitude grid cells so that location queries only visit
+// messages near the query circle. Every level holds every message and every cell is kept sorted by (createdAt, id),
+// which lets a query merge its cells in page order and stop as soon as it has enough results.
+type spatialIndex struct {
+	levels []*indexLevel
+}
+
+type indexLevel struct {
+	cellDegrees float64
+	rows        int
+	cols        int
+	cells       map[int][]*StoredMessage
+}
+
+func newSpatialIndex() *spatialIndex {
+	levels := make([]*indexLevel, 0, len(indexCellDegrees))
+
+	for _, cellDegrees := range indexCellDegrees {
+		levels = append(levels, &indexLevel{
+			cellDegrees: cellDegrees,
+			rows:        int(math.Ceil(180 / cellDegrees)),
+			cols:        int(math.Ceil(360 / cellDegrees)),
+			cells:       make(map[int][]*StoredMessage),
+		})
+	}
+
+	return &spatialIndex{levels}
+}
+
+// insert adds a message to every level of the index.
+func (si *spatialIndex) insert(msg *StoredMessage) {
+	for _, level := range si.levels {
+		key := level.cellKey(level.row(msg.Lat), level.col(msg.Long))
+		cell := level.cells[key]
+
+		// New messages almost always belong at the end of their cell.
+		pos := sort.Search(len(cell), func(i int) bool {
+			return CursorFor(*msg).Before(*cell[i])
+		})
+		cell = append(cell, nil)
+		copy(cell[pos+1:], cell[pos:])
+		cell[pos] = msg
+		level.cells[key] = cell
+	}
+}
+
+// remove deletes a message previously inserted with the same location, createdAt and id from every level of the
+// index.
+func (si *spatialIndex) remove(msg *StoredMessage) {
+	for _, level := range si.levels {
+		key := level.cellKey(level.row(msg.Lat), level.col(msg.Long))
+		cell := level.cells[key]
+
+		pos := sort.Search(len(cell), func(i int) bool {
+			return !CursorFor(*msg).After(*cell[i])
+		})
+
+		if pos < len(cell) && cell[pos].Id == msg.Id {
+			level.cells[key] = append(cell[:pos], cell[pos+1:]...)
+		}
+	}
+}
+
+func (il *indexLevel) row(lat float64) int {
+	row := int(math.Floor((lat + 90) / il.cellDegrees))
+
+	if row < 0 {
+		return 0
+	} else if row >= il.rows {
+		return il.rows - 1
+	}
+
+	return row
+}
+
+func (il *indexLevel) col(long float64) int {
+	col := int(math.Floor((long + 180) / il.cellDegrees))
+
+	return ((col % il.cols) + il.cols) % il.cols
+}
+
+func (il *indexLevel) cellKey(row, col int) int {
+	return row*il.cols + col
+}
+
+// covering returns the keys of every cell on the level that intersects the bounding box of the given circle, or nil
+// if there are more than maxQueryCells of them.
+func (il *indexLevel) covering(location Location, radiusMeters float64) []int {
+	latDelta := radiusMeters / metersPerDegreeLat
+	minRow, maxRow := il.row(location.Lat-latDelta), il.row(location.Lat+latDelta)
+
+	minCol, maxCol := 0, il.cols-1
+	cosLat := math.Min(math.Cos(toRadians(location.Lat-latDelta)), math.Cos(toRadians(location.Lat+latDelta)))
+
+	// Near the poles the circle can span every longitude.
+	if location.Lat+latDelta < 90 && location.Lat-latDelta > -90 && cosLat > 0 {
+		longDelta := latDelta / cosLat
+
+		if longDelta < 180 {
+			minCol = int(math.Floor((location.Long - longDelta + 180) / il.cellDegrees))
+			maxCol = int(math.Floor((location.Long + longDelta + 180) / il.cellDegrees))
+		}
+	}
+
+	if maxCol-minCol >= il.cols {
+		minCol, maxCol = 0, il.cols-1
+	}
+
+	if (maxRow-minRow+1)*(maxCol-minCol+1) > maxQueryCells {
+		return nil
+	}
+
+	keys := make([]int, 0, (maxRow-minRow+1)*(maxCol-minCol+1))
+	for row := minRow; row <= maxRow; row++ {
+		for col := minCol; col <= maxCol; col++ {
+			// Columns past either side of the antimeridian wrap around.
+			keys = append(keys, il.cellKey(row, ((col%il.cols)+il.cols)%il.cols))
+		}
+	}
+
+	return keys
+}
+
+// query retrieves up to limit messages on the given page for which matches returns true, newest first. Only the
+// cells of the finest level that covers the circle with at most maxQueryCells cells are visited.
+func (si *spatialIndex) query(ctx context.Context, location Location, radiusMeters float64, limit int,
+	page MessagePage, matches func(*StoredMessage) bool) ([]StoredMessage, error) {
+	var keys []int
+	var level *indexLevel
+
+	for i := len(si.levels) - 1; i >= 0 && keys == nil; i-- {
+		level = si.levels[i]
+		keys = level.covering(location, radiusMeters)
+	}
+
+	newer := page.Cursor != nil && page.Direction == NewerPage
+	iterators := &cellIterators{newer: newer}
+
+	for _, key := range keys {
+		cell := level.cells[key]
+
+		if len(cell) == 0 {
+			continue
+		}
+
+		var pos int
+		if page.Cursor == nil {
+			pos = len(cell) - 1
+		} else if newer {
+			pos = sort.Search(len(cell), func(i int) bool {
+				return page.Cursor.Before(*cell[i])
+			})
+		} else {
+			pos = sort.Search(len(cell), func(i int) bool {
+				return !page.Cursor.After(*cell[i])
+			}) - 1
+		}
+
+		if pos >= 0 && pos < len(cell) {
+			iterators.cells = append(iterators.cells, &cellIterator{cell, pos})
+		}
+	}
+
+	heap.Init(iterators)
+
+	messages := make([]StoredMessage, 0)
+	for scanned := 0; iterators.Len() > 0 && len(messages) < limit; scanned++ {
+		if scanned%scanCheckInterval == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		it := iterators.cells[0]
+		msg := it.current()
+
+		if matches(msg) {
+			messages = append(messages, *msg)
+		}
+
+		if newer {
+			it.pos++
+		} else {
+			it.pos--
+		}
+
+		if it.pos < 0 || it.pos >= len(it.cell) {
+			heap.Pop(iterators)
+		} else {
+			heap.Fix(iterators, 0)
+		}
+	}
+
+	if newer {
+		reverseMessages(messages)
+	}
+
+	return messages, nil
+}
+
+type cellIterator struct {
+	cell []*StoredMessage
+	pos  int
+}
+
+func (ci *cellIterator) current() *StoredMessage {
+	return ci.cell[ci.pos]
+}
+
+// cellIterators is a heap of cell iterators ordered so that the next message in page order is always on top.
+type cellIterators struct {
+	cells []*cellIterator
+	newer bool
+}
+
+func (ci *cellIterators) Len() int {
+	return len(ci.cells)
+}
+
+func (ci *cellIterators) Less(i, j int) bool {
+	if ci.newer {
+		return CursorFor(*ci.cells[i].current()).Before(*ci.cells[j].current())
+	}
+
+	return CursorFor(*ci.cells[i].current()).After(*ci.cells[j].current())
+}
+
+func (ci *cellIterators) Swap(i, j int) {
+	ci.cells[i], ci.cells[j] = ci.cells[j], ci.cells[i]
+}
+
+func (ci *cellIterators) Push(x interface{}) {
+	ci.cells = append(ci.cells, x.(*cellIterator))
+}
+
+func (ci *cellIterators) Pop() interface{} {
+	last := ci.cells[len(ci.cells)-1]
+	ci.cells = ci.cells[:len(ci.cells)-1]
+
+	return last
+}
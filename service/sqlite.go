@@ -0,0 +1,574 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/twinj/uuid"
+	_ "modernc.org/sqlite"
+	"time"
+)
+
+const (
+	createSqliteMessage = "CREATE TABLE IF NOT EXISTS message (id TEXT PRIMARY KEY, user_id TEXT NOT NULL, username TEXT NOT NULL, content TEXT NOT NULL, lat REAL NOT NULL, long REAL NOT NULL, client_id TEXT NOT NULL, sent_at TEXT NOT NULL, received_at TEXT NOT NULL, created_at INTEGER NOT NULL)"
+	createSqliteCreated = "CREATE INDEX IF NOT EXISTS message_created_at ON message (created_at, id)"
+	// message_location is keyed by the rowid of the message it locates.
+	createSqliteLocation = "CREATE VIRTUAL TABLE IF NOT EXISTS message_location USING rtree(id, min_lat, max_lat, min_long, max_long)"
+
+	addSqliteDeletedAt     = "ALTER TABLE message ADD COLUMN deleted_at TEXT"
+	addSqliteEditedAt      = "ALTER TABLE message ADD COLUMN edited_at TEXT"
+	addSqliteRevisionCount = "ALTER TABLE message ADD COLUMN revision_count INTEGER NOT NULL DEFAULT 0"
+	createSqliteRevision   = "CREATE TABLE IF NOT EXISTS message_revision (message_id TEXT NOT NULL, revision INTEGER NOT NULL, content TEXT NOT NULL, created_at TEXT NOT NULL, PRIMARY KEY (message_id, revision))"
+	// Messages stored twice before client ids were enforced keep the id on their first copy only.
+	clearSqliteDuplicateClientIds = "UPDATE message SET client_id = '' WHERE client_id <> '' AND rowid NOT IN (SELECT MIN(rowid) FROM message WHERE client_id <> '' GROUP BY user_id, client_id)"
+	createSqliteClientKey         = "CREATE UNIQUE INDEX IF NOT EXISTS message_client_key ON message (user_id, client_id) WHERE client_id <> ''"
+
+	insertSqliteMessage  = "INSERT INTO message (id, user_id, username, content, lat, long, client_id, sent_at, received_at, created_at, deleted_at, edited_at, revision_count) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)"
+	updateSqliteMessage  = "UPDATE message SET user_id = $2, username = $3, content = $4, lat = $5, long = $6, client_id = $7, sent_at = $8, received_at = $9, created_at = $10, deleted_at = $11, edited_at = $12, revision_count = $13 WHERE id = $1"
+	selectSqliteRowId    = "SELECT rowid FROM message WHERE id = $1"
+	insertSqliteLocation = "INSERT INTO message_location (id, min_lat, max_lat, min_long, max_long) VALUES ($1, $2, $2, $3, $3)"
+	updateSqliteLocation = "UPDATE message_location SET min_lat = $2, max_lat = $2, min_long = $3, max_long = $3 WHERE id = $1"
+	selectSqliteMessage  = "SELECT id, user_id, username, content, lat, long, created_at, client_id, sent_at, received_at, deleted_at, edited_at, revision_count FROM message WHERE id = $1"
+	selectSqliteByClient = "SELECT id, user_id, username, content, lat, long, created_at, client_id, sent_at, received_at, deleted_at, edited_at, revision_count FROM message WHERE user_id = $1 AND client_id = $2"
+	deleteSqliteMessage  = "UPDATE message SET content = '', deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL"
+	editSqliteMessage    = "UPDATE message SET content = $2, edited_at = $3, revision_count = $4 WHERE id = $1"
+
+	insertSqliteRevision  = "INSERT INTO message_revision (message_id, revision, content, created_at) VALUES ($1, $2, $3, $4)"
+	selectSqliteRevisions = "SELECT revision, content, created_at FROM message_revision WHERE message_id = $1 ORDER BY revision"
+	deleteSqliteRevisions = "DELETE FROM message_revision WHERE message_id = $1"
+
+	// Events are numbered by an autoincrement key, which never reuses the number of an event that was removed.
+	createSqliteEvent  = "CREATE TABLE IF NOT EXISTS message_event (seq INTEGER PRIMARY KEY AUTOINCREMENT, type TEXT NOT NULL, message TEXT NOT NULL, created_at INTEGER NOT NULL)"
+	insertSqliteEvent  = "INSERT INTO message_event (type, message, created_at) VALUES ($1, $2, $3)"
+	selectSqliteEvents = "SELECT seq, type, message, created_at FROM message_event WHERE seq >= $1 ORDER BY seq LIMIT $2"
+
+	// Candidates inside the bounding boxes are streamed in page order and filtered by exact distance as they arrive.
+	// A circle crossing the antimeridian needs two boxes, otherwise the second box repeats the first.
+	selectSqliteCandidates = "SELECT m.id, m.user_id, m.username, m.content, m.lat, m.long, m.created_at, m.client_id, m.sent_at, m.received_at, m.deleted_at, m.edited_at, m.revision_count FROM message m JOIN message_location r ON r.id = m.rowid WHERE r.max_lat >= $1 AND r.min_lat <= $2 AND ((r.max_long >= $3 AND r.min_long <= $4) OR (r.max_long >= $5 AND r.min_long <= $6))"
+	selectSqliteLatest     = selectSqliteCandidates + " ORDER BY m.created_at DESC, m.id DESC"
+	selectSqliteOlder      = selectSqliteCandidates + " AND (m.created_at, m.id) < ($7, $8) ORDER BY m.created_at DESC, m.id DESC"
+	selectSqliteNewer      = selectSqliteCandidates + " AND (m.created_at, m.id) > ($7, $8) ORDER BY m.created_at, m.id"
+)
+
+// sqliteMigrations lists the statements that bring the schema from each version to the next, the schema version of a
+// database is kept in its user_version pragma.
+var sqliteMigrations = [][]string{
+	{createSqliteMessage, createSqliteCreated, createSqliteLocation},
+	{addSqliteDeletedAt},
+	{addSqliteEditedAt, addSqliteRevisionCount, createSqliteRevision},
+	{clearSqliteDuplicateClientIds, createSqliteClientKey},
+	{createSqliteWebhook, createSqliteDelivery, createSqliteDeliveryDue},
+	{createSqliteEvent},
+	{createSqlitePresence, createSqlitePresenceSeen},
+	{createSqliteRead},
+	{createSqliteApiKey},
+}
+
+type sqliteMessageRepository struct {
+	db *sql.DB
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSqliteMessage(row rowScanner) (StoredMessage, error) {
+	var message StoredMessage
+	var createdAt int64
+	var sentAt, receivedAt string
+	var deletedAt, editedAt sql.NullString
+
+	err := row.Scan(&message.Id, &message.Sender.Id, &message.Sender.Username, &message.Content,
+		&message.Location.Lat, &message.Location.Long, &createdAt, &message.ClientId, &sentAt, &receivedAt,
+		&deletedAt, &editedAt, &message.RevisionCount)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	message.DeletedAt, err = parseSqliteTime(deletedAt)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	message.EditedAt, err = parseSqliteTime(editedAt)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	message.CreatedAt = time.Unix(0, createdAt).UTC()
+	message.SentAt, err = time.Parse(time.RFC3339Nano, sentAt)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	message.ReceivedAt, err = time.Parse(time.RFC3339Nano, receivedAt)
+
+	if err != nil {
+		return StoredMessage{}, err
+	}
+
+	return message, nil
+}
+
+// parseSqliteTime reads an optional timestamp column, returning nil when it is NULL.
+func parseSqliteTime(value sql.NullString) (*time.Time, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, value.String)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+func formatSqliteTime(value *time.Time) sql.NullString {
+	if value == nil {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: value.Format(time.RFC3339Nano), Valid: true}
+}
+
+func sqliteMessageArgs(message StoredMessage) []interface{} {
+	return []interface{}{message.Id, message.Sender.Id, message.Sender.Username, message.Content,
+		message.Location.Lat, message.Location.Long, message.ClientId, message.SentAt.Format(time.RFC3339Nano),
+		message.ReceivedAt.Format(time.RFC3339Nano), message.CreatedAt.UnixNano(),
+		formatSqliteTime(message.DeletedAt), formatSqliteTime(message.EditedAt), message.RevisionCount}
+}
+
+func (s *sqliteMessageRepository) AddMessage(ctx context.Context, message Message) (StoredMessage, bool, error) {
+	key, hasKey := message.clientKey()
+
+	if hasKey {
+		existing, err := s.getMessageByClientKey(ctx, key)
+
+		if err != nil {
+			return StoredMessage{}, false, err
+		} else if existing.Id != "" {
+			return existing, false, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	msg := StoredMessage{Id: uuid.NewV4().String(), CreatedAt: now, ReceivedAt: now, Message: message}
+
+	_, err := s.storeMessage(ctx, msg, false, MessageCreatedEvent)
+
+	if err != nil && hasKey {
+		// A concurrent submission of the same message may have been stored first.
+		existing, lookupErr := s.getMessageByClientKey(ctx, key)
+
+		if lookupErr == nil && existing.Id != "" {
+			return existing, false, nil
+		}
+	}
+
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+
+	return msg, true, nil
+}
+
+// getMessageByClientKey retrieves the message stored under a client key, or an empty message if there is none.
+func (s *sqliteMessageRepository) getMessageByClientKey(ctx context.Context, key clientKey) (StoredMessage, error) {
+	message, err := scanSqliteMessage(s.db.QueryRowContext(ctx, selectSqliteByClient, key.senderId, key.clientId))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return StoredMessage{}, nil
+	} else if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+
+	return message, nil
+}
+
+func (s *sqliteMessageRepository) ImportMessage(ctx context.Context, message StoredMessage,
+	overwrite bool) (bool, error) {
+	return s.storeMessage(ctx, message, overwrite, MessageImportedEvent)
+}
+
+// storeMessage writes a message under its id, as ImportMessage describes, logging an event of the given type if it does.
+// New messages are queued for the webhooks watching their location along with it.
+func (s *sqliteMessageRepository) storeMessage(ctx context.Context, message StoredMessage, overwrite bool,
+	eventType MessageEventType) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, sqliteErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var rowId int64
+	err = tx.QueryRowContext(ctx, selectSqliteRowId, message.Id).Scan(&rowId)
+
+	if err == sql.ErrNoRows {
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, insertSqliteMessage, sqliteMessageArgs(message)...)
+
+		if err != nil {
+			return false, sqliteErr(ctx, err)
+		}
+
+		rowId, err = result.LastInsertId()
+
+		if err != nil {
+			return false, sqliteErr(ctx, err)
+		}
+
+		_, err = tx.ExecContext(ctx, insertSqliteLocation, rowId, message.Location.Lat, message.Location.Long)
+	} else if err == nil && overwrite {
+		_, err = tx.ExecContext(ctx, updateSqliteMessage, sqliteMessageArgs(message)...)
+
+		if err == nil {
+			_, err = tx.ExecContext(ctx, updateSqliteLocation, rowId, message.Location.Lat, message.Location.Long)
+		}
+	} else if err == nil {
+		return false, nil
+	}
+
+	if err == nil {
+		err = recordSqliteEvent(ctx, tx, eventType, message)
+	}
+
+	if err == nil && eventType == MessageCreatedEvent {
+		err = queueSqliteDeliveries(ctx, tx, message)
+	}
+
+	if err != nil {
+		return false, sqliteErr(ctx, err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, sqliteErr(ctx, err)
+	}
+
+	return true, nil
+}
+
+func (s *sqliteMessageRepository) GetMessage(ctx context.Context, id string) (StoredMessage, error) {
+	message, err := scanSqliteMessage(s.db.QueryRowContext(ctx, selectSqliteMessage, id))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return StoredMessage{}, nil
+	} else if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+
+	return message, nil
+}
+
+func (s *sqliteMessageRepository) DeleteMessage(ctx context.Context, id string) (StoredMessage, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, deleteSqliteMessage, id, time.Now().UTC().Format(time.RFC3339Nano))
+
+	// Earlier revisions would otherwise keep the content the tombstone removes.
+	if err == nil {
+		_, err = tx.ExecContext(ctx, deleteSqliteRevisions, id)
+	}
+
+	var deleted int64
+
+	if err == nil {
+		deleted, err = result.RowsAffected()
+	}
+
+	// Only a message deleted now is logged, not one that was already a tombstone.
+	if err == nil && deleted > 0 {
+		var tombstone StoredMessage
+		tombstone, err = scanSqliteMessage(tx.QueryRowContext(ctx, selectSqliteMessage, id))
+
+		if err == nil {
+			err = recordSqliteEvent(ctx, tx, MessageDeletedEvent, tombstone)
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+
+	message, err := s.GetMessage(ctx, id)
+
+	if err != nil {
+		return StoredMessage{}, err
+	} else if message.Id == "" {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+
+	return message, nil
+}
+
+func (s *sqliteMessageRepository) EditMessage(ctx context.Context, id string, content string) (StoredMessage,
+	error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	existing, err := scanSqliteMessage(tx.QueryRowContext(ctx, selectSqliteMessage, id))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return StoredMessage{}, ErrMessageNotFound
+	} else if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	} else if existing.DeletedAt != nil {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+
+	message, revision := existing.edit(content, time.Now().UTC())
+	_, err = tx.ExecContext(ctx, insertSqliteRevision, id, revision.Revision, revision.Content,
+		revision.CreatedAt.Format(time.RFC3339Nano))
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, editSqliteMessage, id, message.Content, formatSqliteTime(message.EditedAt),
+			message.RevisionCount)
+	}
+
+	if err == nil {
+		err = recordSqliteEvent(ctx, tx, MessageEditedEvent, message)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return StoredMessage{}, sqliteErr(ctx, err)
+	}
+
+	return message, nil
+}
+
+func (s *sqliteMessageRepository) GetRevisions(ctx context.Context, id string) ([]MessageRevision, error) {
+	message, err := s.GetMessage(ctx, id)
+
+	if err != nil {
+		return nil, err
+	} else if message.Id == "" {
+		return nil, ErrMessageNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, selectSqliteRevisions, id)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	revisions := make([]MessageRevision, 0)
+
+	for rows.Next() {
+		var revision MessageRevision
+		var createdAt string
+		err = rows.Scan(&revision.Revision, &revision.Content, &createdAt)
+
+		if err == nil {
+			revision.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+		}
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return revisions, nil
+}
+
+func (s *sqliteMessageRepository) GetMessagesForLocation(ctx context.Context, location Location,
+	radiusMeters float64, limit int, page MessagePage) ([]StoredMessage, error) {
+	boxes := boundingBoxes(location, radiusMeters)
+
+	if len(boxes) == 1 {
+		boxes = append(boxes, boxes[0])
+	}
+
+	// Both boxes share the same latitude range.
+	args := []interface{}{boxes[0].minLat, boxes[0].maxLat, boxes[0].minLong, boxes[0].maxLong, boxes[1].minLong,
+		boxes[1].maxLong}
+	query := selectSqliteLatest
+
+	if page.Cursor != nil {
+		args = append(args, page.Cursor.CreatedAt.UnixNano(), page.Cursor.Id)
+
+		if page.Direction == NewerPage {
+			query = selectSqliteNewer
+		} else {
+			query = selectSqliteOlder
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	messages := make([]StoredMessage, 0)
+
+	for len(messages) < limit && rows.Next() {
+		message, err := scanSqliteMessage(rows)
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		if distance(location, message.Location) <= radiusMeters {
+			messages = append(messages, message)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	if page.Cursor != nil && page.Direction == NewerPage {
+		reverseMessages(messages)
+	}
+
+	return messages, nil
+}
+
+// recordSqliteEvent logs a change to a message as part of the transaction making it.
+func recordSqliteEvent(ctx context.Context, tx *sql.Tx, eventType MessageEventType, message StoredMessage) error {
+	encoded, err := json.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, insertSqliteEvent, string(eventType), string(encoded), time.Now().UnixNano())
+
+	return err
+}
+
+func (s *sqliteMessageRepository) GetEvents(ctx context.Context, from int64, limit int) ([]MessageEvent, error) {
+	rows, err := s.db.QueryContext(ctx, selectSqliteEvents, from, limit)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	events := make([]MessageEvent, 0)
+
+	for rows.Next() {
+		var event MessageEvent
+		var message string
+		var createdAt int64
+		err = rows.Scan(&event.Seq, &event.Type, &message, &createdAt)
+
+		if err == nil {
+			err = json.Unmarshal([]byte(message), &event.Message)
+		}
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		event.CreatedAt = time.Unix(0, createdAt).UTC()
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return events, nil
+}
+
+// sqliteErr reports a cancelled or timed out context in preference to the error the driver produced because of it.
+func sqliteErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return newErrRepository(err.Error())
+}
+
+// MakeSqliteRepository constructs a MessageRepository backed by the given SQLite database, bringing its schema up to
+// date first.
+func MakeSqliteRepository(db *sql.DB) (MessageRepository, error) {
+	// SQLite allows a single writer, funnelling every statement through one connection avoids busy errors and keeps
+	// in memory databases from being opened once per connection.
+	db.SetMaxOpenConns(1)
+
+	err := migrateSqlite(db)
+
+	if err != nil {
+		return nil, newErrRepository(err.Error())
+	}
+
+	return &sqliteMessageRepository{db}, nil
+}
+
+func migrateSqlite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range sqliteMigrations[version] {
+			_, err = tx.Exec(statement)
+
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+
+		// Pragmas do not accept bound parameters.
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"github.com/twinj/uuid"
+	"strings"
+	"time"
+)
+
+const (
+	// Scopes are stored space separated, as in the scope claim of a token.
+	createSqliteApiKey = "CREATE TABLE IF NOT EXISTS api_key (id TEXT PRIMARY KEY, hash TEXT NOT NULL UNIQUE, service_id TEXT NOT NULL, service_username TEXT NOT NULL, scopes TEXT NOT NULL, created_at INTEGER NOT NULL)"
+
+	insertSqliteApiKey       = "INSERT INTO api_key (id, hash, service_id, service_username, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	selectSqliteApiKeys      = "SELECT id, hash, service_id, service_username, scopes, created_at FROM api_key ORDER BY created_at, id"
+	selectSqliteApiKeyByHash = "SELECT id, hash, service_id, service_username, scopes, created_at FROM api_key WHERE hash = $1"
+	deleteSqliteApiKey       = "DELETE FROM api_key WHERE id = $1"
+)
+
+func scanSqliteApiKey(row rowScanner) (ApiKey, error) {
+	var key ApiKey
+	var scopes string
+	var createdAt int64
+
+	err := row.Scan(&key.Id, &key.Hash, &key.Service.Id, &key.Service.Username, &scopes, &createdAt)
+
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	key.Scopes = strings.Fields(scopes)
+	key.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return key, nil
+}
+
+func (s *sqliteMessageRepository) AddApiKey(ctx context.Context, key ApiKey) (ApiKey, error) {
+	key.Id = uuid.NewV4().String()
+	key.Key = ""
+	key.CreatedAt = time.Now().UTC()
+
+	_, err := s.db.ExecContext(ctx, insertSqliteApiKey, key.Id, key.Hash, key.Service.Id, key.Service.Username,
+		strings.Join(key.Scopes, " "), key.CreatedAt.UnixNano())
+
+	if err != nil {
+		return ApiKey{}, sqliteErr(ctx, err)
+	}
+
+	return key, nil
+}
+
+func (s *sqliteMessageRepository) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	rows, err := s.db.QueryContext(ctx, selectSqliteApiKeys)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	keys := make([]ApiKey, 0)
+
+	for rows.Next() {
+		key, err := scanSqliteApiKey(rows)
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return keys, nil
+}
+
+func (s *sqliteMessageRepository) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	key, err := scanSqliteApiKey(s.db.QueryRowContext(ctx, selectSqliteApiKeyByHash, hash))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return ApiKey{}, ErrApiKeyNotFound
+	} else if err != nil {
+		return ApiKey{}, sqliteErr(ctx, err)
+	}
+
+	return key, nil
+}
+
+func (s *sqliteMessageRepository) DeleteApiKey(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, deleteSqliteApiKey, id)
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return sqliteErr(ctx, err)
+	} else if deleted == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	return nil
+}
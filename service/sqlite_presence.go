@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// last_seen_at is unix nanoseconds so that it compares numerically.
+	createSqlitePresence     = "CREATE TABLE IF NOT EXISTS presence (user_id TEXT PRIMARY KEY, username TEXT NOT NULL, lat REAL NOT NULL, long REAL NOT NULL, visible INTEGER NOT NULL, last_seen_at INTEGER NOT NULL)"
+	createSqlitePresenceSeen = "CREATE INDEX IF NOT EXISTS presence_last_seen_at ON presence (last_seen_at)"
+
+	upsertSqlitePresence = "INSERT INTO presence (user_id, username, lat, long, visible, last_seen_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id) DO UPDATE SET username = excluded.username, lat = excluded.lat, long = excluded.long, visible = excluded.visible, last_seen_at = excluded.last_seen_at"
+	selectSqlitePresence = "SELECT user_id, username, lat, long, visible, last_seen_at FROM presence WHERE last_seen_at > $1 AND lat >= $2 AND lat <= $3 AND ((long >= $4 AND long <= $5) OR (long >= $6 AND long <= $7)) ORDER BY username, user_id"
+	expireSqlitePresence = "DELETE FROM presence WHERE last_seen_at <= $1"
+)
+
+func (s *sqliteMessageRepository) Heartbeat(ctx context.Context, presence Presence) error {
+	_, err := s.db.ExecContext(ctx, upsertSqlitePresence, presence.Sender.Id, presence.Sender.Username,
+		presence.Location.Lat, presence.Location.Long, presence.Visible, presence.LastSeenAt.UnixNano())
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (s *sqliteMessageRepository) GetPresence(ctx context.Context, location Location, radiusMeters float64,
+	activeSince time.Time) ([]Presence, error) {
+	boxes := boundingBoxes(location, radiusMeters)
+
+	if len(boxes) == 1 {
+		boxes = append(boxes, boxes[0])
+	}
+
+	rows, err := s.db.QueryContext(ctx, selectSqlitePresence, activeSince.UnixNano(), boxes[0].minLat,
+		boxes[0].maxLat, boxes[0].minLong, boxes[0].maxLong, boxes[1].minLong, boxes[1].maxLong)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	nearby := make([]Presence, 0)
+
+	for rows.Next() {
+		var presence Presence
+		var lastSeenAt int64
+
+		err = rows.Scan(&presence.Sender.Id, &presence.Sender.Username, &presence.Location.Lat,
+			&presence.Location.Long, &presence.Visible, &lastSeenAt)
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		presence.LastSeenAt = time.Unix(0, lastSeenAt).UTC()
+
+		if distance(location, presence.Location) <= radiusMeters {
+			nearby = append(nearby, presence)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return nearby, nil
+}
+
+func (s *sqliteMessageRepository) ExpirePresence(ctx context.Context, activeSince time.Time) error {
+	_, err := s.db.ExecContext(ctx, expireSqlitePresence, activeSince.UnixNano())
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	// created_at is unix nanoseconds, as it is for messages, so read positions compare with them directly.
+	createSqliteRead = "CREATE TABLE IF NOT EXISTS message_read (user_id TEXT PRIMARY KEY, created_at INTEGER NOT NULL, message_id TEXT NOT NULL)"
+
+	// A position behind the one already recorded updates nothing.
+	upsertSqliteRead = "INSERT INTO message_read (user_id, created_at, message_id) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET created_at = excluded.created_at, message_id = excluded.message_id WHERE (message_read.created_at, message_read.message_id) < (excluded.created_at, excluded.message_id)"
+	selectSqliteRead = "SELECT created_at, message_id FROM message_read WHERE user_id = $1"
+	// Unread candidates inside the bounding boxes are filtered by exact distance once retrieved.
+	selectSqliteUnread = "SELECT m.lat, m.long FROM message m JOIN message_location r ON r.id = m.rowid LEFT JOIN message_read mr ON mr.user_id = $7 WHERE r.max_lat >= $1 AND r.min_lat <= $2 AND ((r.max_long >= $3 AND r.min_long <= $4) OR (r.max_long >= $5 AND r.min_long <= $6)) AND m.deleted_at IS NULL AND m.user_id <> $7 AND (mr.user_id IS NULL OR (m.created_at, m.id) > (mr.created_at, mr.message_id))"
+)
+
+func (s *sqliteMessageRepository) MarkRead(ctx context.Context, userId string,
+	position MessageCursor) (MessageCursor, error) {
+	_, err := s.db.ExecContext(ctx, upsertSqliteRead, userId, position.CreatedAt.UnixNano(), position.Id)
+
+	if err != nil {
+		return MessageCursor{}, sqliteErr(ctx, err)
+	}
+
+	current, err := s.GetReadPosition(ctx, userId)
+
+	if err != nil {
+		return MessageCursor{}, err
+	}
+
+	return *current, nil
+}
+
+func (s *sqliteMessageRepository) GetReadPosition(ctx context.Context, userId string) (*MessageCursor, error) {
+	var createdAt int64
+	var position MessageCursor
+
+	err := s.db.QueryRowContext(ctx, selectSqliteRead, userId).Scan(&createdAt, &position.Id)
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	position.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return &position, nil
+}
+
+func (s *sqliteMessageRepository) CountUnread(ctx context.Context, userId string, location Location,
+	radiusMeters float64) (int, error) {
+	boxes := boundingBoxes(location, radiusMeters)
+
+	if len(boxes) == 1 {
+		boxes = append(boxes, boxes[0])
+	}
+
+	rows, err := s.db.QueryContext(ctx, selectSqliteUnread, boxes[0].minLat, boxes[0].maxLat, boxes[0].minLong,
+		boxes[0].maxLong, boxes[1].minLong, boxes[1].maxLong, userId)
+
+	if err != nil {
+		return 0, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	count := 0
+
+	for rows.Next() {
+		var candidate Location
+		err = rows.Scan(&candidate.Lat, &candidate.Long)
+
+		if err != nil {
+			return 0, sqliteErr(ctx, err)
+		}
+
+		if distance(location, candidate) <= radiusMeters {
+			count++
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, sqliteErr(ctx, err)
+	}
+
+	return count, nil
+}
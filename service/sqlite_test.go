@@ -0,0 +1,118 @@
+package service_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stone1549/yapyapyap/message/service"
+	"path/filepath"
+	"testing"
+)
+
+func makeSqliteRepo(tb testing.TB) service.MessageRepository {
+	db, err := sql.Open("sqlite", ":memory:")
+	ok(tb, err)
+
+	repo, err := service.MakeSqliteRepository(db)
+	ok(tb, err)
+
+	return repo
+}
+
+// TestSqlite_AddGetSuccess ensures that a stored message can be retrieved by id.
+func TestSqlite_AddGetSuccess(t *testing.T) {
+	repo := makeSqliteRepo(t)
+	ctx := context.Background()
+
+	stored, _, err := repo.AddMessage(ctx, service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: service.Location{Lat: 40.0, Long: -105.0},
+	})
+	ok(t, err)
+
+	msg, err := repo.GetMessage(ctx, stored.Id)
+	ok(t, err)
+	equals(t, stored, msg)
+}
+
+// TestSqlite_GetMessagesForLocationPaging ensures that paging in both directions visits every message exactly once
+// in newest first order.
+func TestSqlite_GetMessagesForLocationPaging(t *testing.T) {
+	testGetMessagesForLocationPaging(t, makeSqliteRepo)
+}
+
+// TestSqlite_GetMessagesForLocationRadius ensures that only messages inside the radius are returned.
+func TestSqlite_GetMessagesForLocationRadius(t *testing.T) {
+	testGetMessagesForLocationRadius(t, makeSqliteRepo)
+}
+
+// TestSqlite_FileSmallSet ensures that a file backed repository keeps a loaded dataset across reopening.
+func TestSqlite_FileSmallSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "message.db")
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite", path)
+	ok(t, err)
+	repo, err := service.MakeSqliteRepository(db)
+	ok(t, err)
+
+	report, err := service.LoadDatasetFile(ctx, repo, "../data/small_set.json", service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 4, report.Loaded)
+	ok(t, db.Close())
+
+	db, err = sql.Open("sqlite", path)
+	ok(t, err)
+	defer db.Close()
+	repo, err = service.MakeSqliteRepository(db)
+	ok(t, err)
+
+	report, err = service.LoadDatasetFile(ctx, repo, "../data/small_set.json", service.SkipExistingMode)
+	ok(t, err)
+	equals(t, 4, report.Skipped)
+
+	messages, err := repo.GetMessagesForLocation(ctx, service.Location{Lat: 40.0176, Long: -105.2797}, 5000, 10,
+		service.MessagePage{})
+	ok(t, err)
+	equals(t, 4, len(messages))
+}
+
+// TestSqlite_DeleteMessage ensures that deleted messages are replaced by tombstones.
+func TestSqlite_DeleteMessage(t *testing.T) {
+	testDeleteMessage(t, makeSqliteRepo)
+}
+
+// TestSqlite_EditMessage ensures that edits keep the earlier versions of a message.
+func TestSqlite_EditMessage(t *testing.T) {
+	testEditMessage(t, makeSqliteRepo)
+}
+
+// TestSqlite_AddMessageIdempotent ensures that retried submissions are stored once.
+func TestSqlite_AddMessageIdempotent(t *testing.T) {
+	testAddMessageIdempotent(t, makeSqliteRepo)
+}
+
+// TestSqlite_WebhookOutbox ensures that webhook deliveries are queued, claimed, retried and dead lettered.
+func TestSqlite_WebhookOutbox(t *testing.T) {
+	testWebhookOutbox(t, makeSqliteRepo)
+}
+
+// TestSqlite_EventLog ensures that changes to messages are logged in sequence.
+func TestSqlite_EventLog(t *testing.T) {
+	testEventLog(t, makeSqliteRepo)
+}
+
+// TestSqlite_Presence ensures that heartbeats are found near where they were sent until they go stale.
+func TestSqlite_Presence(t *testing.T) {
+	testPresence(t, makeSqliteRepo)
+}
+
+// TestSqlite_ReadReceipts ensures that unread messages are counted past each user's read position.
+func TestSqlite_ReadReceipts(t *testing.T) {
+	testReadReceipts(t, makeSqliteRepo)
+}
+
+// TestSqlite_ApiKeys ensures that API keys are found by their hash until they are revoked.
+func TestSqlite_ApiKeys(t *testing.T) {
+	testApiKeys(t, makeSqliteRepo)
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+const (
+	// A webhook's center and polygon are stored as JSON, areas are only ever matched in Go.
+	createSqliteWebhook = "CREATE TABLE IF NOT EXISTS webhook (id TEXT PRIMARY KEY, url TEXT NOT NULL, secret TEXT NOT NULL, center TEXT, radius REAL NOT NULL, polygon TEXT, created_at INTEGER NOT NULL)"
+	// Times are unix nanoseconds so that they sort and compare numerically.
+	createSqliteDelivery    = "CREATE TABLE IF NOT EXISTS webhook_delivery (id TEXT PRIMARY KEY, webhook_id TEXT NOT NULL, message_id TEXT NOT NULL, payload TEXT NOT NULL, attempts INTEGER NOT NULL, next_attempt_at INTEGER NOT NULL, leased_until INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', dead_at INTEGER, created_at INTEGER NOT NULL)"
+	createSqliteDeliveryDue = "CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery (next_attempt_at) WHERE dead_at IS NULL"
+
+	insertSqliteWebhook  = "INSERT INTO webhook (id, url, secret, center, radius, polygon, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	selectSqliteWebhook  = "SELECT id, url, secret, center, radius, polygon, created_at FROM webhook WHERE id = $1"
+	selectSqliteWebhooks = "SELECT id, url, secret, center, radius, polygon, created_at FROM webhook ORDER BY created_at, id"
+	deleteSqliteWebhook  = "DELETE FROM webhook WHERE id = $1"
+
+	insertSqliteDelivery    = "INSERT INTO webhook_delivery (id, webhook_id, message_id, payload, attempts, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	claimSqliteDeliveries   = "UPDATE webhook_delivery SET leased_until = $2 WHERE id IN (SELECT id FROM webhook_delivery WHERE dead_at IS NULL AND next_attempt_at <= $1 AND leased_until <= $1 ORDER BY next_attempt_at LIMIT $3) RETURNING id, webhook_id, message_id, payload, attempts, next_attempt_at, last_error, dead_at, created_at"
+	completeSqliteDelivery  = "DELETE FROM webhook_delivery WHERE id = $1"
+	retrySqliteDelivery     = "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3, leased_until = 0 WHERE id = $1"
+	killSqliteDelivery      = "UPDATE webhook_delivery SET attempts = attempts + 1, last_error = $2, dead_at = $3, leased_until = 0 WHERE id = $1"
+	deleteSqliteDeliveries  = "DELETE FROM webhook_delivery WHERE webhook_id = $1"
+	selectSqliteDeadLetters = "SELECT id, webhook_id, message_id, payload, attempts, next_attempt_at, last_error, dead_at, created_at FROM webhook_delivery WHERE dead_at IS NOT NULL ORDER BY dead_at, id"
+)
+
+func scanSqliteWebhook(row rowScanner) (Webhook, error) {
+	var webhook Webhook
+	var center, polygon sql.NullString
+	var createdAt int64
+
+	err := row.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, &center, &webhook.Radius, &polygon, &createdAt)
+
+	if err == nil && center.Valid {
+		err = json.Unmarshal([]byte(center.String), &webhook.Center)
+	}
+
+	if err == nil && polygon.Valid {
+		err = json.Unmarshal([]byte(polygon.String), &webhook.Polygon)
+	}
+
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	webhook.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return webhook, nil
+}
+
+func scanSqliteDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	var nextAttemptAt, createdAt int64
+	var deadAt sql.NullInt64
+
+	err := row.Scan(&delivery.Id, &delivery.WebhookId, &delivery.MessageId, &payload, &delivery.Attempts,
+		&nextAttemptAt, &delivery.LastError, &deadAt, &createdAt)
+
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	if deadAt.Valid {
+		dead := time.Unix(0, deadAt.Int64).UTC()
+		delivery.DeadAt = &dead
+	}
+
+	delivery.Payload = json.RawMessage(payload)
+	delivery.NextAttemptAt = time.Unix(0, nextAttemptAt).UTC()
+	delivery.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return delivery, nil
+}
+
+func (s *sqliteMessageRepository) AddWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	webhook.Id = uuid.NewV4().String()
+	webhook.CreatedAt = time.Now().UTC()
+
+	center, err := jsonColumn(webhook.Center, webhook.Center == nil)
+
+	if err != nil {
+		return Webhook{}, newErrRepository(err.Error())
+	}
+
+	polygon, err := jsonColumn(webhook.Polygon, len(webhook.Polygon) == 0)
+
+	if err != nil {
+		return Webhook{}, newErrRepository(err.Error())
+	}
+
+	_, err = s.db.ExecContext(ctx, insertSqliteWebhook, webhook.Id, webhook.Url, webhook.Secret, center,
+		webhook.Radius, polygon, webhook.CreatedAt.UnixNano())
+
+	if err != nil {
+		return Webhook{}, sqliteErr(ctx, err)
+	}
+
+	return webhook, nil
+}
+
+func (s *sqliteMessageRepository) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	webhook, err := scanSqliteWebhook(s.db.QueryRowContext(ctx, selectSqliteWebhook, id))
+
+	if err == sql.ErrNoRows && ctx.Err() == nil {
+		return Webhook{}, ErrWebhookNotFound
+	} else if err != nil {
+		return Webhook{}, sqliteErr(ctx, err)
+	}
+
+	return webhook, nil
+}
+
+func (s *sqliteMessageRepository) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, selectSqliteWebhooks)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	webhooks, err := scanSqliteWebhooks(rows)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return webhooks, nil
+}
+
+// scanSqliteWebhooks reads every webhook in rows and closes them.
+func scanSqliteWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+	webhooks := make([]Webhook, 0)
+
+	for rows.Next() {
+		webhook, err := scanSqliteWebhook(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (s *sqliteMessageRepository) DeleteWebhook(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, deleteSqliteWebhook, id)
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil {
+		return sqliteErr(ctx, err)
+	} else if deleted == 0 {
+		return ErrWebhookNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, deleteSqliteDeliveries, id)
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	return nil
+}
+
+// queueSqliteDeliveries queues a new message for the webhooks whose area contains it, as part of the transaction
+// storing it.
+func queueSqliteDeliveries(ctx context.Context, tx *sql.Tx, msg StoredMessage) error {
+	rows, err := tx.QueryContext(ctx, selectSqliteWebhooks)
+
+	if err != nil {
+		return err
+	}
+
+	registered, err := scanSqliteWebhooks(rows)
+
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := webhookDeliveries(registered, msg)
+
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		_, err = tx.ExecContext(ctx, insertSqliteDelivery, delivery.Id, delivery.WebhookId, delivery.MessageId,
+			string(delivery.Payload), delivery.Attempts, delivery.NextAttemptAt.UnixNano(),
+			delivery.CreatedAt.UnixNano())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteMessageRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, claimSqliteDeliveries, now.UnixNano(), now.Add(lease).UnixNano(), limit)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery, err := scanSqliteDelivery(rows)
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	// RETURNING produces rows in no particular order.
+	sortDeliveries(deliveries)
+
+	return deliveries, nil
+}
+
+func (s *sqliteMessageRepository) CompleteDelivery(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, completeSqliteDelivery, id)
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (s *sqliteMessageRepository) FailDelivery(ctx context.Context, id string, lastError string,
+	nextAttemptAt *time.Time) error {
+	var err error
+
+	if nextAttemptAt != nil {
+		_, err = s.db.ExecContext(ctx, retrySqliteDelivery, id, lastError, nextAttemptAt.UnixNano())
+	} else {
+		_, err = s.db.ExecContext(ctx, killSqliteDelivery, id, lastError, time.Now().UnixNano())
+	}
+
+	if err != nil {
+		return sqliteErr(ctx, err)
+	}
+
+	return nil
+}
+
+func (s *sqliteMessageRepository) GetDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, selectSqliteDeadLetters)
+
+	if err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery, err := scanSqliteDelivery(rows)
+
+		if err != nil {
+			return nil, sqliteErr(ctx, err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(ctx, err)
+	}
+
+	return deliveries, nil
+}
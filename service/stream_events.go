@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventPollInterval is how often a caught up event stream checks the log for new events. The log is polled rather
+// than pushed so that every instance sharing a database sees every event, whichever instance wrote it.
+const eventPollInterval = time.Second
+
+// StreamEvents follows the event log as server-sent events, starting from the from parameter, or from the event after
+// the one named by the Last-Event-ID header when a client reconnects. Each event's id is its sequence number.
+func StreamEvents(writer http.ResponseWriter, request *http.Request) {
+	repo, ok := request.Context().Value("repo").(MessageRepository)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("streaming unsupported"))
+		return
+	}
+
+	from, errResp := parseEventSeq(request.URL.Query().Get("from"), "from parameter")
+
+	if lastEventId := request.Header.Get("Last-Event-ID"); lastEventId != "" {
+		var last int64
+		last, errResp = parseEventSeq(lastEventId, "Last-Event-ID header")
+		from = last + 1
+	}
+
+	if errResp != nil {
+		RenderResponse(writer, request, errResp)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		events, err := repo.GetEvents(request.Context(), from, replayPageSize)
+
+		if err != nil {
+			if request.Context().Err() == nil {
+				log.Println(err)
+			}
+
+			return
+		}
+
+		for _, event := range events {
+			err = writeLogEvent(writer, event)
+
+			if err != nil {
+				return
+			}
+
+			from = event.Seq + 1
+		}
+
+		flusher.Flush()
+
+		// A full page means more events are waiting already.
+		if len(events) == replayPageSize {
+			continue
+		}
+
+		select {
+		case <-poll.C:
+		case <-heartbeat.C:
+			_, err = io.WriteString(writer, ": heartbeat\n\n")
+
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func writeLogEvent(writer io.Writer, event MessageEvent) error {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+
+	return err
+}
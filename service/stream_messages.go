@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// streamWriteWait is how long a frame may take to write before the client is considered gone.
+	streamWriteWait = 10 * time.Second
+	// streamPongWait is how long the client may go without answering a ping.
+	streamPongWait = 60 * time.Second
+	// streamPingInterval is how often the client is pinged, it must be shorter than streamPongWait.
+	streamPingInterval = streamPongWait * 9 / 10
+
+	// moveBackfillWindow is how far back the messages sent after a move reach, and so how long the ids of the
+	// messages a client has been sent are remembered.
+	moveBackfillWindow = 15 * time.Minute
+	// moveBackfillLimit is the most messages sent after a move.
+	moveBackfillLimit = 100
+	// backfillTimeout bounds fetching the messages sent after a move.
+	backfillTimeout = 10 * time.Second
+)
+
+// StreamEventType identifies what a StreamEvent reports.
+type StreamEventType string
+
+const (
+	// MessageStreamEvent reports a message stored inside the subscribed area.
+	MessageStreamEvent StreamEventType = "message"
+	// ErrorStreamEvent reports a command the server could not carry out.
+	ErrorStreamEvent StreamEventType = "error"
+)
+
+// StreamEvent is a single frame pushed to a streaming client.
+type StreamEvent struct {
+	Type    StreamEventType `json:"type"`
+	Message *StoredMessage  `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// StreamCommandType identifies what a StreamCommand asks for.
+type StreamCommandType string
+
+// MoveStreamCommand moves the subscribed area to Location, and changes its radius if Radius is set.
+const MoveStreamCommand StreamCommandType = "move"
+
+// StreamCommand is a frame a WebSocket client sends to adjust its subscription.
+type StreamCommand struct {
+	Type     StreamCommandType `json:"type"`
+	Location *Location         `json:"location,omitempty"`
+	Radius   float64           `json:"radius,omitempty"`
+}
+
+// seenMessages remembers which messages a streaming client has been sent, by id, for as long as they could be sent
+// again.
+type seenMessages struct {
+	createdAtById map[string]time.Time
+}
+
+func newSeenMessages() *seenMessages {
+	return &seenMessages{make(map[string]time.Time)}
+}
+
+func (sm *seenMessages) add(msg StoredMessage) {
+	sm.createdAtById[msg.Id] = msg.CreatedAt
+}
+
+func (sm *seenMessages) contains(id string) bool {
+	_, found := sm.createdAtById[id]
+
+	return found
+}
+
+// prune forgets messages created before horizon, which are too old to be sent again.
+func (sm *seenMessages) prune(horizon time.Time) {
+	for id, createdAt := range sm.createdAtById {
+		if createdAt.Before(horizon) {
+			delete(sm.createdAtById, id)
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// Clients authenticate with a bearer token rather than cookies, so a cross origin page gains nothing by opening a
+	// stream, this matches the CORS policy applied to every other route.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+func StreamMessagesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		broker, ok := request.Context().Value("broker").(Broker)
+
+		if !ok {
+			RenderResponse(writer, request, NewInternalServerErr("broker not configured"))
+			return
+		}
+
+		center, radiusInMeters, errResp := parseArea(request)
+
+		if errResp != nil {
+			RenderResponse(writer, request, errResp)
+			return
+		}
+
+		sub := broker.Subscribe(center, radiusInMeters)
+		defer sub.Close()
+
+		ctx := context.WithValue(request.Context(), "subscription", sub)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// StreamMessages pushes each message delivered to the subscription to the client until either side goes away, over a
+// WebSocket when the request asks to be upgraded to one and as server-sent events otherwise.
+func StreamMessages(writer http.ResponseWriter, request *http.Request) {
+	sub, ok := request.Context().Value("subscription").(*Subscription)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("internal error"))
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(request) {
+		streamWebSocket(writer, request, sub)
+	} else {
+		streamServerSentEvents(writer, request, sub)
+	}
+}
+
+// streamWebSocket upgrades the request to a WebSocket and sends a StreamEvent frame for each message, handling the
+// StreamCommands the client sends. A client that falls too far behind is disconnected with a try again later close
+// frame, it can catch up with GET /messages before reconnecting.
+func streamWebSocket(writer http.ResponseWriter, request *http.Request, sub *Subscription) {
+	repo, ok := request.Context().Value("repo").(MessageRepository)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(writer, request, nil)
+
+	if err != nil {
+		// The upgrader has already replied with an error.
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	commands := make(chan StreamCommand)
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go readStream(conn, commands, gone, done)
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	seen := newSeenMessages()
+
+	for {
+		select {
+		case msg, open := <-sub.Messages():
+			if !open {
+				closeStream(conn, sub.Err())
+				return
+			}
+
+			if seen.contains(msg.Id) {
+				continue
+			}
+
+			seen.add(msg)
+			err = writeStreamEvent(conn, StreamEvent{Type: MessageStreamEvent, Message: &msg})
+		case command := <-commands:
+			err = handleStreamCommand(request.Context(), conn, repo, sub, seen, command)
+		case <-ticker.C:
+			seen.prune(time.Now().Add(-moveBackfillWindow))
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait))
+		case <-gone:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleStreamCommand carries out a command sent by a streaming client. A move also sends the recent messages inside
+// the area it newly covers, oldest first, skipping any the client has already been sent.
+func handleStreamCommand(ctx context.Context, conn *websocket.Conn, repo MessageRepository, sub *Subscription,
+	seen *seenMessages, command StreamCommand) error {
+	if command.Type != MoveStreamCommand {
+		return writeStreamEvent(conn, StreamEvent{Type: ErrorStreamEvent, Error: "unknown command"})
+	}
+
+	if command.Location == nil || ValidateLocation(*command.Location) != nil || command.Radius < 0 {
+		return writeStreamEvent(conn, StreamEvent{Type: ErrorStreamEvent, Error: "invalid move command"})
+	}
+
+	oldCenter, oldRadius := sub.Area()
+	radius := oldRadius
+
+	if command.Radius > 0 {
+		radius = command.Radius
+	}
+
+	sub.Move(*command.Location, radius)
+
+	ctx, cancel := context.WithTimeout(ctx, backfillTimeout)
+	defer cancel()
+
+	horizon := time.Now().Add(-moveBackfillWindow)
+	messages, err := repo.GetMessagesForLocation(ctx, *command.Location, radius, moveBackfillLimit, MessagePage{})
+
+	if err != nil {
+		log.Println(err)
+		return writeStreamEvent(conn, StreamEvent{Type: ErrorStreamEvent, Error: "unable to fetch recent messages"})
+	}
+
+	seen.prune(horizon)
+
+	// Pages are ordered newest first, events are sent oldest first.
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+
+		if msg.CreatedAt.Before(horizon) || seen.contains(msg.Id) ||
+			distance(oldCenter, msg.Location) <= oldRadius {
+			continue
+		}
+
+		seen.add(msg)
+		err = writeStreamEvent(conn, StreamEvent{Type: MessageStreamEvent, Message: &msg})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeStreamEvent(conn *websocket.Conn, event StreamEvent) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+
+	return conn.WriteJSON(event)
+}
+
+// readStream consumes frames from the client, passing on the commands it sends and processing pongs and close frames,
+// until the client stops answering or disconnects, when gone is closed. done is closed once commands are no longer
+// wanted.
+func readStream(conn *websocket.Conn, commands chan<- StreamCommand, gone chan<- struct{}, done <-chan struct{}) {
+	defer close(gone)
+
+	_ = conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	for {
+		_, frame, err := conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		// A frame that is not a command is passed on as one without a type, which is reported as unknown.
+		var command StreamCommand
+		_ = json.Unmarshal(frame, &command)
+
+		select {
+		case commands <- command:
+		case <-done:
+			return
+		}
+	}
+}
+
+func closeStream(conn *websocket.Conn, err error) {
+	code, text := websocket.CloseNormalClosure, ""
+
+	if err == ErrSlowConsumer {
+		code, text = websocket.CloseTryAgainLater, err.Error()
+	}
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text),
+		time.Now().Add(streamWriteWait))
+}
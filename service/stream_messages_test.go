@@ -0,0 +1,100 @@
+package service_test
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamMessages_Push ensures that a WebSocket client is sent the messages stored inside its area once it has
+// subscribed.
+func TestStreamMessages_Push(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+
+	router := chi.NewRouter()
+	router.With(service.StreamMessagesMiddleware).Get("/messages/stream", service.StreamMessages)
+	server := httptest.NewServer(withValues(router, map[string]interface{}{"broker": broker, "repo": repo}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/messages/stream?lat=40&long=-105&radius=1000"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	ok(t, err)
+	defer conn.Close()
+
+	stored, _, err := repo.AddMessage(context.Background(), service.Message{Content: "hello",
+		Location: service.Location{Lat: 40.0, Long: -105.0}})
+	ok(t, err)
+
+	ok(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var event service.StreamEvent
+	ok(t, conn.ReadJSON(&event))
+	equals(t, service.MessageStreamEvent, event.Type)
+	equals(t, stored.Id, event.Message.Id)
+}
+
+// TestStreamMessages_BadArea ensures that a subscription without a center is rejected before upgrading.
+func TestStreamMessages_BadArea(t *testing.T) {
+	router := chi.NewRouter()
+	router.With(service.StreamMessagesMiddleware).Get("/messages/stream", service.StreamMessages)
+	server := httptest.NewServer(withValues(router, map[string]interface{}{"broker": service.NewInProcessBroker()}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/messages/stream?long=-105"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	notOk(t, err)
+	equals(t, 400, resp.StatusCode)
+}
+
+// TestStreamMessages_Move ensures that moving a subscription sends the recent messages in the newly covered area, then
+// delivers messages stored there live, without ever sending a message twice.
+func TestStreamMessages_Move(t *testing.T) {
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+	ctx := context.Background()
+	destination := service.Location{Lat: 41.0, Long: -105.0}
+
+	before, _, err := repo.AddMessage(ctx, service.Message{Content: "before", Location: destination})
+	ok(t, err)
+
+	router := chi.NewRouter()
+	router.With(service.StreamMessagesMiddleware).Get("/messages/stream", service.StreamMessages)
+	server := httptest.NewServer(withValues(router, map[string]interface{}{"broker": broker, "repo": repo}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/messages/stream?lat=40&long=-105&radius=1000"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	ok(t, err)
+	defer conn.Close()
+	ok(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	move := service.StreamCommand{Type: service.MoveStreamCommand, Location: &destination}
+	ok(t, conn.WriteJSON(move))
+
+	var event service.StreamEvent
+	ok(t, conn.ReadJSON(&event))
+	equals(t, before.Id, event.Message.Id)
+
+	live, _, err := repo.AddMessage(ctx, service.Message{Content: "live", Location: destination})
+	ok(t, err)
+	ok(t, conn.ReadJSON(&event))
+	equals(t, live.Id, event.Message.Id)
+
+	// Moving within the area already covered sends nothing again.
+	ok(t, conn.WriteJSON(service.StreamCommand{Type: service.MoveStreamCommand, Location: &destination,
+		Radius: 2000}))
+	after, _, err := repo.AddMessage(ctx, service.Message{Content: "after", Location: destination})
+	ok(t, err)
+	ok(t, conn.ReadJSON(&event))
+	equals(t, after.Id, event.Message.Id)
+
+	ok(t, conn.WriteJSON(service.StreamCommand{Type: service.MoveStreamCommand}))
+	ok(t, conn.ReadJSON(&event))
+	equals(t, service.ErrorStreamEvent, event.Type)
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// sseHeartbeatInterval is how often an idle event stream sends a comment, keeping proxies from timing it out.
+	sseHeartbeatInterval = 15 * time.Second
+	// replayPageSize is how many missed messages are fetched at a time when resuming an event stream.
+	replayPageSize = 100
+)
+
+// streamServerSentEvents sends each message as a text/event-stream event whose id is a cursor positioned at it. A
+// client resuming with the Last-Event-ID header, or a cursor or after parameter, is first sent the messages stored
+// inside the area since that position and then continues live. A client that falls too far behind has its stream
+// ended, reconnecting resumes from the last event it received.
+func streamServerSentEvents(writer http.ResponseWriter, request *http.Request, sub *Subscription) {
+	config, ok := request.Context().Value("config").(Configuration)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("config not found"))
+		return
+	}
+
+	repo, ok := request.Context().Value("repo").(MessageRepository)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("repo not configured"))
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+
+	if !ok {
+		RenderResponse(writer, request, NewInternalServerErr("streaming unsupported"))
+		return
+	}
+
+	secret := config.GetCursorSecret()
+	page, errResp := parsePage(request, secret)
+
+	if lastEventId := request.Header.Get("Last-Event-ID"); lastEventId != "" {
+		var err error
+		page, err = DecodeCursor(secret, lastEventId)
+
+		if err != nil {
+			resp := NewBadRequestErr("invalid Last-Event-ID header")
+			errResp = &resp
+		}
+	}
+
+	if errResp != nil {
+		RenderResponse(writer, request, errResp)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Messages stored while the replay runs may also have been delivered to the subscription.
+	replayed := make(map[string]struct{})
+
+	if page.Cursor != nil {
+		cursor := *page.Cursor
+		center, radiusMeters := sub.Area()
+
+		for {
+			messages, err := repo.GetMessagesForLocation(request.Context(), center, radiusMeters,
+				replayPageSize, MessagePage{Cursor: &cursor, Direction: NewerPage})
+
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			// Pages are ordered newest first, events are sent oldest first.
+			for i := len(messages) - 1; i >= 0; i-- {
+				replayed[messages[i].Id] = struct{}{}
+				err = writeMessageEvent(writer, secret, messages[i])
+
+				if err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+
+			if len(messages) < replayPageSize {
+				break
+			}
+
+			cursor = CursorFor(messages[0])
+		}
+	}
+
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case msg, open := <-sub.Messages():
+			if !open {
+				return
+			}
+
+			if _, found := replayed[msg.Id]; found {
+				delete(replayed, msg.Id)
+				continue
+			}
+
+			err = writeMessageEvent(writer, secret, msg)
+		case <-ticker.C:
+			_, err = io.WriteString(writer, ": heartbeat\n\n")
+		case <-request.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeMessageEvent(writer io.Writer, secret []byte, msg StoredMessage) error {
+	data, err := json.Marshal(msg)
+
+	if err != nil {
+		return err
+	}
+
+	cursor := CursorFor(msg)
+	id := EncodeCursor(secret, MessagePage{Cursor: &cursor, Direction: NewerPage})
+	_, err = fmt.Fprintf(writer, "id: %s\nevent: %s\ndata: %s\n\n", id, MessageStreamEvent, data)
+
+	return err
+}
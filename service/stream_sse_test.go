@@ -0,0 +1,105 @@
+package service_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/message/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent reads the next event from a text/event-stream, skipping comments, and returns its id and message.
+func readEvent(tb testing.TB, reader *bufio.Reader) (string, service.StoredMessage) {
+	var id string
+	var msg service.StoredMessage
+
+	for {
+		line, err := reader.ReadString('\n')
+		ok(tb, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && id != "":
+			return id, msg
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			ok(tb, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg))
+		}
+	}
+}
+
+// TestStreamMessages_ServerSentEventsResume ensures that an event stream resumed with Last-Event-ID is sent the
+// messages it missed, oldest first, and then continues live.
+func TestStreamMessages_ServerSentEventsResume(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	broker := service.NewInProcessBroker()
+	repo := service.NewPublishingRepository(makeInMemoryRepo(t), broker)
+	loc := service.Location{Lat: 40.0, Long: -105.0}
+	ctx := context.Background()
+
+	stored := make([]service.StoredMessage, 0)
+
+	for _, content := range []string{"one", "two", "three"} {
+		msg, _, err := repo.AddMessage(ctx, service.Message{Content: content, Location: loc})
+		ok(t, err)
+		stored = append(stored, msg)
+	}
+
+	router := chi.NewRouter()
+	router.With(service.StreamMessagesMiddleware).Get("/messages/stream", service.StreamMessages)
+	server := httptest.NewServer(withValues(router, map[string]interface{}{"broker": broker, "repo": repo,
+		"config": config}))
+	defer server.Close()
+
+	cursor := service.CursorFor(stored[0])
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/messages/stream?lat=40&long=-105&radius=1000", nil)
+	ok(t, err)
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Last-Event-ID", service.EncodeCursor(config.GetCursorSecret(),
+		service.MessagePage{Cursor: &cursor, Direction: service.NewerPage}))
+
+	response, err := http.DefaultClient.Do(request)
+	ok(t, err)
+	defer response.Body.Close()
+	equals(t, http.StatusOK, response.StatusCode)
+	equals(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(response.Body)
+	_, msg := readEvent(t, reader)
+	equals(t, stored[1].Id, msg.Id)
+	id, msg := readEvent(t, reader)
+	equals(t, stored[2].Id, msg.Id)
+
+	page, err := service.DecodeCursor(config.GetCursorSecret(), id)
+	ok(t, err)
+	equals(t, stored[2].Id, page.Cursor.Id)
+
+	live, _, err := repo.AddMessage(ctx, service.Message{Content: "four", Location: loc})
+	ok(t, err)
+	_, msg = readEvent(t, reader)
+	equals(t, live.Id, msg.Id)
+}
+
+// TestStreamMessages_ServerSentEventsBadLastEventId ensures that a forged Last-Event-ID is rejected.
+func TestStreamMessages_ServerSentEventsBadLastEventId(t *testing.T) {
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	router := chi.NewRouter()
+	router.With(service.StreamMessagesMiddleware).Get("/messages/stream", service.StreamMessages)
+
+	request := httptest.NewRequest(http.MethodGet, "/messages/stream?lat=40&long=-105", nil)
+	request.Header.Set("Last-Event-ID", "forged")
+	recorder := httptest.NewRecorder()
+	withValues(router, map[string]interface{}{"broker": service.NewInProcessBroker(), "repo": makeInMemoryRepo(t),
+		"config": config}).ServeHTTP(recorder, request)
+
+	equals(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/twinj/uuid"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Webhook is a partner's registration to be notified of the messages stored inside an area, given either as a center
+// and radius or as a polygon.
+type Webhook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Secret signs every delivery, it is only revealed when the webhook is registered.
+	Secret    string     `json:"secret,omitempty"`
+	Center    *Location  `json:"center,omitempty"`
+	Radius    float64    `json:"radius,omitempty"`
+	Polygon   []Location `json:"polygon,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+func (w Webhook) Render(rw http.ResponseWriter, _ *http.Request) error {
+	rw.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// Contains reports whether a location falls inside the webhook's area.
+func (w Webhook) Contains(location Location) bool {
+	if w.Center != nil {
+		return distance(*w.Center, location) <= w.Radius
+	}
+
+	return polygonContains(w.Polygon, location)
+}
+
+// polygonContains reports whether a location falls inside a polygon by counting the edges that a ray cast east from it
+// crosses. Coordinates are treated as planar, which is accurate enough for the neighbourhood sized areas webhooks
+// watch.
+func polygonContains(polygon []Location, location Location) bool {
+	inside := false
+
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+
+		if (a.Lat > location.Lat) != (b.Lat > location.Lat) &&
+			location.Long < (b.Long-a.Long)*(location.Lat-a.Lat)/(b.Lat-a.Lat)+a.Long {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// ValidateWebhook reports why a webhook cannot be registered, if it cannot.
+func ValidateWebhook(webhook Webhook) error {
+	target, err := url.Parse(webhook.Url)
+
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+
+	if (webhook.Center == nil) == (len(webhook.Polygon) == 0) {
+		return errors.New("exactly one of center or polygon is required")
+	}
+
+	if webhook.Center != nil {
+		if webhook.Radius <= 0 {
+			return errors.New("radius must be positive")
+		}
+
+		return ValidateLocation(*webhook.Center)
+	}
+
+	if len(webhook.Polygon) < 3 {
+		return errors.New("polygon needs at least 3 points")
+	}
+
+	for _, point := range webhook.Polygon {
+		err = ValidateLocation(point)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WebhookEvent identifies what a WebhookPayload reports.
+type WebhookEvent string
+
+// MessageCreatedWebhookEvent reports a message stored inside the webhook's area.
+const MessageCreatedWebhookEvent WebhookEvent = "message.created"
+
+// WebhookPayload is the JSON body POSTed to a webhook.
+type WebhookPayload struct {
+	Event      WebhookEvent  `json:"event"`
+	WebhookId  string        `json:"webhookId"`
+	DeliveryId string        `json:"deliveryId"`
+	Message    StoredMessage `json:"message"`
+}
+
+// WebhookDelivery is a payload waiting in the outbox to be POSTed to a webhook, or one that was given up on.
+type WebhookDelivery struct {
+	Id        string          `json:"id"`
+	WebhookId string          `json:"webhookId"`
+	MessageId string          `json:"messageId"`
+	Payload   json.RawMessage `json:"payload"`
+	// Attempts counts the failed attempts so far, NextAttemptAt is when the next is due.
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LastError     string    `json:"lastError,omitempty"`
+	// DeadAt is set once the delivery has been moved to the dead letter list.
+	DeadAt    *time.Time `json:"deadAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// fail returns the delivery after a failed attempt, due again at nextAttemptAt or dead as of now when nextAttemptAt is
+// nil.
+func (wd WebhookDelivery) fail(lastError string, nextAttemptAt *time.Time, now time.Time) WebhookDelivery {
+	wd.Attempts++
+	wd.LastError = lastError
+
+	if nextAttemptAt != nil {
+		wd.NextAttemptAt = *nextAttemptAt
+	} else {
+		wd.DeadAt = &now
+	}
+
+	return wd
+}
+
+// sortDeliveries orders deliveries by when they are due, earliest first.
+func sortDeliveries(deliveries []WebhookDelivery) {
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt.Before(deliveries[j].NextAttemptAt)
+	})
+}
+
+// WebhookRepository stores webhook registrations and the outbox of deliveries owed to them. Deliveries are queued by
+// the MessageRepository sharing its storage, along with each message it adds.
+type WebhookRepository interface {
+	AddWebhook(ctx context.Context, webhook Webhook) (Webhook, error)
+	// GetWebhook retrieves a webhook, returning ErrWebhookNotFound if there is no such webhook.
+	GetWebhook(ctx context.Context, id string) (Webhook, error)
+	GetWebhooks(ctx context.Context) ([]Webhook, error)
+	// DeleteWebhook removes a webhook along with the deliveries still owed to it.
+	DeleteWebhook(ctx context.Context, id string) error
+	// ClaimDeliveries retrieves up to limit deliveries due by now, oldest first, and hides them from other claims
+	// until lease has passed so that only one dispatcher attempts each.
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	// CompleteDelivery removes a delivery that succeeded from the outbox.
+	CompleteDelivery(ctx context.Context, id string) error
+	// FailDelivery records a failed attempt at a delivery, which is retried at nextAttemptAt or, when nextAttemptAt is
+	// nil, moved to the dead letter list.
+	FailDelivery(ctx context.Context, id string, lastError string, nextAttemptAt *time.Time) error
+	// GetDeadLetters retrieves the deliveries that were given up on, oldest first.
+	GetDeadLetters(ctx context.Context) ([]WebhookDelivery, error)
+}
+
+// ErrWebhookNotFound is returned by WebhookRepository methods that require an existing webhook when there is none.
+var ErrWebhookNotFound error = errRepository{errors.New("webhook not found")}
+
+// NewWebhookRepository retrieves the WebhookRepository sharing storage with repo.
+func NewWebhookRepository(repo MessageRepository) (WebhookRepository, error) {
+	webhooks, ok := repo.(WebhookRepository)
+
+	if !ok {
+		return nil, newErrRepository("repository does not support webhooks")
+	}
+
+	return webhooks, nil
+}
+
+// webhookDeliveries builds a delivery of msg to every webhook in registered whose area contains it. Repositories queue
+// them as part of storing a new message, so that no message is stored without them.
+func webhookDeliveries(registered []Webhook, msg StoredMessage) ([]WebhookDelivery, error) {
+	var err error
+	now := time.Now().UTC()
+	deliveries := make([]WebhookDelivery, 0)
+
+	for _, webhook := range registered {
+		if !webhook.Contains(msg.Location) {
+			continue
+		}
+
+		delivery := WebhookDelivery{
+			Id:            uuid.NewV4().String(),
+			WebhookId:     webhook.Id,
+			MessageId:     msg.Id,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		delivery.Payload, err = json.Marshal(WebhookPayload{
+			Event:      MessageCreatedWebhookEvent,
+			WebhookId:  webhook.Id,
+			DeliveryId: delivery.Id,
+			Message:    msg,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
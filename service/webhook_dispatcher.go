@@ -0,0 +1,198 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries "sha256=" followed by the hex encoded HMAC-SHA256, keyed by the webhook's secret,
+	// of the WebhookTimestampHeader value, a period and the body.
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader carries the unix time the delivery was attempted at, so receivers can reject replays.
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookIdHeader        = "X-Webhook-Id"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	// webhookPollInterval is how often the outbox is checked for deliveries that are due.
+	webhookPollInterval = 5 * time.Second
+	// webhookBatchSize is the most deliveries claimed at once.
+	webhookBatchSize = 50
+	// webhookTimeout bounds a single attempt. Deliveries are attempted one after another, so the lease on a batch
+	// outlasts attempting all of it and no other dispatcher attempts the same delivery.
+	webhookTimeout = 10 * time.Second
+	webhookLease   = (webhookBatchSize + 1) * webhookTimeout
+	// A delivery is retried after webhookBaseBackoff, doubling after each failure up to webhookMaxBackoff, and is moved
+	// to the dead letter list after webhookMaxAttempts failures.
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookMaxAttempts = 10
+)
+
+// SignWebhookPayload computes the value of WebhookSignatureHeader for a body sent at timestamp.
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait before the next attempt at a delivery that has failed attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+
+	return backoff
+}
+
+// WebhookDispatcher POSTs the deliveries queued in a WebhookRepository's outbox to their webhooks.
+type WebhookDispatcher struct {
+	webhooks WebhookRepository
+	client   *http.Client
+}
+
+// NewWebhookClient constructs the client deliveries are sent with. It does not follow redirects, which would carry a
+// signed delivery to whichever host the redirect names, so a redirected delivery fails instead.
+func NewWebhookClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// NewWebhookDispatcher constructs a WebhookDispatcher sending deliveries with client.
+func NewWebhookDispatcher(webhooks WebhookRepository, client *http.Client) *WebhookDispatcher {
+	return &WebhookDispatcher{webhooks: webhooks, client: client}
+}
+
+// Run dispatches due deliveries until ctx is done.
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := wd.DispatchDue(ctx, time.Now().UTC())
+
+		if err != nil && ctx.Err() == nil {
+			log.Printf("webhook dispatcher: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DispatchDue attempts every delivery due by now. A delivery that fails is rescheduled, or moved to the dead letter
+// list once it has failed too often or its webhook is gone.
+func (wd *WebhookDispatcher) DispatchDue(ctx context.Context, now time.Time) error {
+	start := time.Now()
+
+	for {
+		// Each batch is leased from when it is claimed, after the batches before it were attempted.
+		claimedAt := now.Add(time.Since(start))
+		deliveries, err := wd.webhooks.ClaimDeliveries(ctx, claimedAt, webhookLease, webhookBatchSize)
+
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			err = wd.dispatch(ctx, delivery, claimedAt)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// dispatch attempts a single delivery and records the outcome.
+func (wd *WebhookDispatcher) dispatch(ctx context.Context, delivery WebhookDelivery, now time.Time) error {
+	webhook, err := wd.webhooks.GetWebhook(ctx, delivery.WebhookId)
+
+	if errors.Is(err, ErrWebhookNotFound) {
+		return wd.webhooks.FailDelivery(ctx, delivery.Id, err.Error(), nil)
+	} else if err != nil {
+		return err
+	}
+
+	err = wd.post(ctx, webhook, delivery)
+
+	if err == nil {
+		return wd.webhooks.CompleteDelivery(ctx, delivery.Id)
+	} else if ctx.Err() != nil {
+		// The attempt was abandoned rather than failed, its lease lapses and it is attempted again.
+		return ctx.Err()
+	}
+
+	attempts := delivery.Attempts + 1
+
+	if attempts >= webhookMaxAttempts {
+		return wd.webhooks.FailDelivery(ctx, delivery.Id, err.Error(), nil)
+	}
+
+	nextAttemptAt := now.Add(webhookBackoff(attempts))
+
+	return wd.webhooks.FailDelivery(ctx, delivery.Id, err.Error(), &nextAttemptAt)
+}
+
+// post sends a delivery's payload to its webhook, any response other than a 2xx is a failure.
+func (wd *WebhookDispatcher) post(ctx context.Context, webhook Webhook, delivery WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(delivery.Payload))
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookIdHeader, webhook.Id)
+	request.Header.Set(WebhookDeliveryHeader, delivery.Id)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, delivery.Payload))
+
+	response, err := wd.client.Do(request)
+
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Draining the body lets the connection be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("webhook responded " + response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stone1549/yapyapyap/message/service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueDelivery registers a webhook for url and stores a message inside its area, returning the webhook.
+func queueDelivery(tb testing.TB, repo service.MessageRepository, url string) service.Webhook {
+	ctx := context.Background()
+	webhooks, err := service.NewWebhookRepository(repo)
+	ok(tb, err)
+
+	webhook, err := webhooks.AddWebhook(ctx, service.Webhook{
+		Url:    url,
+		Secret: "secret",
+		Center: &service.Location{Lat: 40.0, Long: -105.0},
+		Radius: 1000,
+	})
+	ok(tb, err)
+
+	_, _, err = repo.AddMessage(ctx, service.Message{
+		Sender:   service.Sender{Id: "1", Username: "someone"},
+		Content:  "hello",
+		Location: service.Location{Lat: 40.0, Long: -105.0},
+	})
+	ok(tb, err)
+
+	return webhook
+}
+
+// TestWebhookDispatcher_SignedDelivery ensures that a delivery is POSTed with a valid signature and leaves the outbox
+// once the webhook accepts it.
+func TestWebhookDispatcher_SignedDelivery(t *testing.T) {
+	var mut sync.Mutex
+	received := make([]*http.Request, 0)
+	bodies := make([][]byte, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		mut.Lock()
+		received = append(received, request)
+		bodies = append(bodies, body)
+		mut.Unlock()
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	repo := makeInMemoryRepo(t)
+	webhook := queueDelivery(t, repo, server.URL)
+	webhooks, err := service.NewWebhookRepository(repo)
+	ok(t, err)
+
+	dispatcher := service.NewWebhookDispatcher(webhooks, server.Client())
+	ok(t, dispatcher.DispatchDue(context.Background(), time.Now().UTC()))
+
+	equals(t, 1, len(received))
+	request, body := received[0], bodies[0]
+	equals(t, webhook.Id, request.Header.Get(service.WebhookIdHeader))
+	equals(t, service.SignWebhookPayload("secret", request.Header.Get(service.WebhookTimestampHeader), body),
+		request.Header.Get(service.WebhookSignatureHeader))
+
+	var payload service.WebhookPayload
+	ok(t, json.Unmarshal(body, &payload))
+	equals(t, request.Header.Get(service.WebhookDeliveryHeader), payload.DeliveryId)
+	equals(t, "hello", payload.Message.Content)
+
+	// Nothing is left to deliver, however late it gets.
+	ok(t, dispatcher.DispatchDue(context.Background(), time.Now().Add(24*time.Hour)))
+	equals(t, 1, len(received))
+}
+
+// TestWebhookDispatcher_DeadLetter ensures that a failing delivery is retried with growing delays and moved to the
+// dead letter list once it has failed too often.
+func TestWebhookDispatcher_DeadLetter(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		attempts++
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	repo := makeInMemoryRepo(t)
+	queueDelivery(t, repo, server.URL)
+	webhooks, err := service.NewWebhookRepository(repo)
+	ok(t, err)
+
+	ctx := context.Background()
+	dispatcher := service.NewWebhookDispatcher(webhooks, server.Client())
+	now := time.Now().UTC()
+	ok(t, dispatcher.DispatchDue(ctx, now))
+	equals(t, 1, attempts)
+
+	// The retry is not due straight away.
+	ok(t, dispatcher.DispatchDue(ctx, now.Add(time.Second)))
+	equals(t, 1, attempts)
+
+	for i := 0; i < 20; i++ {
+		now = now.Add(2 * time.Hour)
+		ok(t, dispatcher.DispatchDue(ctx, now))
+	}
+
+	equals(t, 10, attempts)
+
+	dead, err := webhooks.GetDeadLetters(ctx)
+	ok(t, err)
+	equals(t, 1, len(dead))
+	equals(t, 10, dead[0].Attempts)
+	equals(t, "webhook responded 503 Service Unavailable", dead[0].LastError)
+}
+
+// TestWebhookDispatcher_NoRedirects ensures that a delivery is not re-sent to the host a webhook redirects it to, and
+// fails instead.
+func TestWebhookDispatcher_NoRedirects(t *testing.T) {
+	redirected := 0
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		redirected++
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer elsewhere.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, elsewhere.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	repo := makeInMemoryRepo(t)
+	queueDelivery(t, repo, server.URL)
+	webhooks, err := service.NewWebhookRepository(repo)
+	ok(t, err)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	ok(t, service.NewWebhookDispatcher(webhooks, service.NewWebhookClient()).DispatchDue(ctx, now))
+	equals(t, 0, redirected)
+
+	due, err := webhooks.ClaimDeliveries(ctx, now.Add(time.Hour), time.Minute, 10)
+	ok(t, err)
+	equals(t, 1, len(due))
+	equals(t, "webhook responded 307 Temporary Redirect", due[0].LastError)
+}